@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Vendor name for Axis cameras
+const VendorAxis = "Axis"
+
+// axisEventNames maps the event names used in Axis HTTP notification templates
+// to our standardized types
+var axisEventNames = map[string]string{
+	"motion":            "MotionDetection",
+	"motionalarm":       "MotionDetection",
+	"vmd":               "MotionDetection",
+	"vmd4":              "MotionDetection",
+	"tampering":         "TamperDetection",
+	"tamper":            "TamperDetection",
+	"videoloss":         "VideoLoss",
+	"signalloss":        "VideoLoss",
+	"input":             "IOAlarm",
+	"digitalinput":      "IOAlarm",
+	"io":                "IOAlarm",
+	"linecrossing":      "LineCrossing",
+	"crossline":         "LineCrossing",
+	"intrusion":         "IntrusionDetection",
+	"fenceguard":        "IntrusionDetection",
+	"storage":           "StorageFailure",
+	"storagefailure":    "StorageFailure",
+	"storagedisruption": "StorageFailure",
+}
+
+// axisEventFields are the notification template keys with a fixed meaning,
+// all other keys are passed through as event details
+var axisEventFields = struct {
+	eventType []string
+	device    []string
+	channel   []string
+	state     []string
+	time      []string
+}{
+	eventType: []string{"event", "topic", "type"},
+	device:    []string{"device", "serial", "camera"},
+	channel:   []string{"channel", "source", "videosource"},
+	state:     []string{"state", "active"},
+	time:      []string{"time", "timestamp"},
+}
+
+func init() {
+	registerAdapter("axis", newAxisAdapter)
+}
+
+// axisAdapter receives Axis action rule HTTP notifications and VAPIX event XML
+type axisAdapter struct {
+	cfg AdapterConfig
+}
+
+// newAxisAdapter creates the Axis ingest adapter
+func newAxisAdapter(cfg AdapterConfig) (IngestAdapter, error) {
+	return &axisAdapter{cfg: cfg}, nil
+}
+
+func (a *axisAdapter) Name() string { return VendorAxis }
+
+func (a *axisAdapter) Routes() []string {
+	return adapterRoutes(a.cfg, "/axis/event")
+}
+
+func (a *axisAdapter) Methods() []string {
+	return []string{http.MethodPost, http.MethodGet}
+}
+
+func (a *axisAdapter) Authenticate(r *http.Request) bool {
+	return checkAdapterAuth(r, a.cfg.Username, a.cfg.Password)
+}
+
+// Parse decodes VAPIX event XML, a JSON or form body template, or plain query parameters
+func (a *axisAdapter) Parse(r *http.Request, body []byte) ([]Event, error) {
+	deviceID := requestDeviceID(r, "AXIS")
+	trimmed := bytes.TrimSpace(body)
+
+	// VAPIX event stream XML
+	if len(trimmed) > 0 && trimmed[0] == '<' {
+		messages, err := decodeONVIFNotifications(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 {
+			return nil, fmt.Errorf("no NotificationMessage found in Axis XML")
+		}
+
+		events := make([]Event, 0, len(messages))
+		for _, msg := range messages {
+			event := convertONVIFNotification(msg, VendorAxis, deviceID, string(body))
+			token, _ := onvifItemValue(msg.Message.Message.Source.SimpleItems, onvifChannelItems...)
+			event.ChannelID = axisChannelID(token)
+			events = append(events, event)
+		}
+		return events, nil
+	}
+
+	// Query parameters are the base, a body template overrides them
+	fields := map[string]interface{}{}
+	for key, values := range r.URL.Query() {
+		if len(values) > 0 {
+			fields[key] = values[0]
+		}
+	}
+
+	if len(trimmed) > 0 {
+		if trimmed[0] == '{' {
+			var bodyFields map[string]interface{}
+			if err := json.Unmarshal(trimmed, &bodyFields); err != nil {
+				return nil, fmt.Errorf("error parsing Axis JSON body: %v", err)
+			}
+			for key, value := range bodyFields {
+				fields[key] = value
+			}
+		} else {
+			values, err := url.ParseQuery(string(trimmed))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing Axis form body: %v", err)
+			}
+			for key, value := range values {
+				if len(value) > 0 {
+					fields[key] = value[0]
+				}
+			}
+		}
+	}
+
+	if _, ok := axisField(fields, axisEventFields.eventType); !ok {
+		return nil, fmt.Errorf("missing Axis event name, expected one of %s", strings.Join(axisEventFields.eventType, ", "))
+	}
+
+	return []Event{convertAxisNotification(fields, deviceID, string(body))}, nil
+}
+
+// axisField returns the first non-empty value for any of the given keys
+func axisField(fields map[string]interface{}, keys []string) (string, bool) {
+	for _, key := range keys {
+		for name, value := range fields {
+			if !strings.EqualFold(name, key) {
+				continue
+			}
+			if text := strings.TrimSpace(fmt.Sprint(value)); text != "" {
+				return text, true
+			}
+		}
+	}
+	return "", false
+}
+
+// convertAxisNotification converts an Axis HTTP notification to our standard event format
+func convertAxisNotification(fields map[string]interface{}, deviceID string, rawPayload string) Event {
+	eventName, _ := axisField(fields, axisEventFields.eventType)
+
+	if device, ok := axisField(fields, axisEventFields.device); ok {
+		deviceID = device
+	}
+
+	channel, _ := axisField(fields, axisEventFields.channel)
+
+	eventState := EventStateActive
+	if value, ok := axisField(fields, axisEventFields.state); ok {
+		eventState = axisState(value)
+	}
+
+	eventTime := time.Now()
+	if value, ok := axisField(fields, axisEventFields.time); ok {
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			eventTime = parsed
+		}
+	}
+
+	eventDetails := map[string]interface{}{
+		"source":       VendorAxis,
+		"originalType": eventName,
+	}
+	for key, value := range fields {
+		if _, exists := eventDetails[key]; !exists {
+			eventDetails[key] = value
+		}
+	}
+
+	return Event{
+		Vendor:       VendorAxis,
+		EventType:    mapAxisEventName(eventName),
+		EventTime:    eventTime,
+		ReceivedAt:   time.Now(),
+		DeviceID:     deviceID,
+		ChannelID:    onvifChannelID(channel),
+		State:        eventState,
+		EventDetails: eventDetails,
+		Raw:          rawPayload,
+	}
+}
+
+// axisState converts the state of a template to our event state. Action rules
+// report Start and Stop for conditions and Changed for one-off triggers.
+func axisState(value string) string {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "start", "started", "changed":
+		return EventStateActive
+	case "stop", "stopped":
+		return EventStateInactive
+	}
+	if onvifBool(value) {
+		return EventStateActive
+	}
+	return EventStateInactive
+}
+
+// axisChannelID builds our channel ID from a VAPIX source token. VAPIX numbers
+// video sources and ports from 0, our channels start at 1.
+func axisChannelID(token string) string {
+	if n, err := strconv.Atoi(token); err == nil && n >= 0 {
+		return fmt.Sprintf("Channel%d", n+1)
+	}
+	return onvifChannelID(token)
+}
+
+// mapAxisEventName converts a template event name or topic to our standardized types
+func mapAxisEventName(name string) string {
+	// Templates may carry the full topic, e.g. tns1:VideoSource/MotionAlarm
+	if strings.Contains(name, "/") {
+		return mapONVIFTopic(name)
+	}
+
+	if eventType, ok := axisEventNames[strings.ToLower(name)]; ok {
+		return eventType
+	}
+
+	// Accept names that are already standardized, e.g. MotionDetection
+	for _, eventType := range axisEventNames {
+		if strings.EqualFold(name, eventType) {
+			return eventType
+		}
+	}
+	return "UnknownEvent_" + strings.ToLower(name)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAxisParse(t *testing.T) {
+	type want struct {
+		eventType string
+		state     string
+		device    string
+		channel   string
+	}
+	tests := []struct {
+		name string
+		file string
+		want []want
+	}{
+		{
+			name: "action rule start",
+			file: "action_rule_start.txt",
+			want: []want{{eventType: "MotionDetection", state: EventStateActive, device: "ACCC8E000001", channel: "Channel1"}},
+		},
+		{
+			name: "action rule stop",
+			file: "action_rule_stop.txt",
+			want: []want{{eventType: "MotionDetection", state: EventStateInactive, device: "ACCC8E000001", channel: "Channel1"}},
+		},
+		{
+			name: "action rule changed",
+			file: "action_rule_changed.json",
+			want: []want{{eventType: "IntrusionDetection", state: EventStateActive, device: "ACCC8E000001", channel: "Channel2"}},
+		},
+		{
+			// VAPIX numbers sources from 0
+			name: "VAPIX motion",
+			file: "vapix_motion.xml",
+			want: []want{{eventType: "MotionDetection", state: EventStateActive, device: "AXIS_192.0.2.1", channel: "Channel1"}},
+		},
+		{
+			name: "VAPIX input port",
+			file: "vapix_io_port.xml",
+			want: []want{{eventType: "IOAlarm", state: EventStateInactive, device: "AXIS_192.0.2.1", channel: "Channel2"}},
+		},
+	}
+
+	adapter, err := newAxisAdapter(AdapterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "axis", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/axis/event", bytes.NewReader(body))
+			r.RemoteAddr = "192.0.2.1:51000"
+
+			events, err := adapter.Parse(r, body)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if len(events) != len(tt.want) {
+				t.Fatalf("got %d events, want %d", len(events), len(tt.want))
+			}
+			for i, w := range tt.want {
+				event := events[i]
+				if event.EventType != w.eventType || event.State != w.state || event.DeviceID != w.device || event.ChannelID != w.channel {
+					t.Errorf("event %d: got %s/%s device %s channel %s, want %s/%s device %s channel %s", i,
+						event.EventType, event.State, event.DeviceID, event.ChannelID, w.eventType, w.state, w.device, w.channel)
+				}
+			}
+		})
+	}
+}
+
+func TestAxisState(t *testing.T) {
+	tests := map[string]string{
+		"Start":   EventStateActive,
+		"Changed": EventStateActive,
+		"Stop":    EventStateInactive,
+		"1":       EventStateActive,
+		"0":       EventStateInactive,
+		"true":    EventStateActive,
+		"false":   EventStateInactive,
+	}
+	for value, want := range tests {
+		if got := axisState(value); got != want {
+			t.Errorf("axisState(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CooldownConfig limits how often alerts of one type are sent per device and channel.
+// Empty match fields match any value; the first matching entry applies.
+type CooldownConfig struct {
+	EventType string `json:"event_type,omitempty"`
+	DeviceID  string `json:"device_id,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+	// Window is the minimum time between two alerts, e.g. "2m"
+	Window string `json:"window"`
+}
+
+// cooldownRule is a parsed cooldown configuration entry
+type cooldownRule struct {
+	cfg    CooldownConfig
+	window time.Duration
+}
+
+// cooldownEntry is the suppression state of one vendor/device/channel/type
+type cooldownEntry struct {
+	Vendor     string    `json:"vendor"`
+	DeviceID   string    `json:"deviceId"`
+	ChannelID  string    `json:"channelId"`
+	EventType  string    `json:"eventType"`
+	Window     string    `json:"window"`
+	LastSent   time.Time `json:"lastSent"`
+	Until      time.Time `json:"until"`
+	Suppressed int       `json:"suppressed"`
+	// sentIncident is the incident whose start was sent, its end is sent as well
+	sentIncident string
+	// heldIncident is the incident whose start was held back, its repeats are counted once it ends
+	heldIncident string
+}
+
+// cooldowns holds the cooldown rules and the suppression state per key
+var cooldowns = struct {
+	sync.Mutex
+	rules   []cooldownRule
+	entries map[string]*cooldownEntry
+}{entries: map[string]*cooldownEntry{}}
+
+// initCooldowns parses the cooldown configuration
+func initCooldowns(configs []CooldownConfig) error {
+	var rules []cooldownRule
+	for i, cfg := range configs {
+		window, err := time.ParseDuration(cfg.Window)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("invalid window %q for cooldown %d", cfg.Window, i+1)
+		}
+		rules = append(rules, cooldownRule{cfg: cfg, window: window})
+	}
+
+	cooldowns.Lock()
+	defer cooldowns.Unlock()
+	cooldowns.rules = rules
+	return nil
+}
+
+// matchCooldown returns the first cooldown rule matching the event
+func matchCooldown(event *Event) *cooldownRule {
+	for i, rule := range cooldowns.rules {
+		if rule.cfg.EventType != "" && rule.cfg.EventType != event.EventType {
+			continue
+		}
+		if rule.cfg.DeviceID != "" && rule.cfg.DeviceID != event.DeviceID {
+			continue
+		}
+		if rule.cfg.ChannelID != "" && rule.cfg.ChannelID != event.ChannelID {
+			continue
+		}
+		return &cooldowns.rules[i]
+	}
+	return nil
+}
+
+// checkCooldown reports whether the event may be sent to the notifiers. Suppressed
+// events are counted and the count is reported with the next alert of the same key.
+func checkCooldown(event *Event) bool {
+	cooldowns.Lock()
+	defer cooldowns.Unlock()
+
+	rule := matchCooldown(event)
+	if rule == nil {
+		return true
+	}
+
+	key := cooldownKey(event)
+	entry, ok := cooldowns.entries[key]
+	if !ok {
+		entry = &cooldownEntry{
+			Vendor:    event.Vendor,
+			DeviceID:  event.DeviceID,
+			ChannelID: event.ChannelID,
+			EventType: event.EventType,
+		}
+		cooldowns.entries[key] = entry
+	}
+	entry.Window = rule.window.String()
+
+	// The end of an incident follows its start, it was counted with the start
+	if event.Incident != nil && event.Incident.Phase == IncidentEnded {
+		return entry.sentIncident == event.Incident.ID
+	}
+
+	now := time.Now()
+	if now.Before(entry.LastSent.Add(rule.window)) {
+		entry.Suppressed++
+		if event.Incident != nil {
+			entry.heldIncident = event.Incident.ID
+		}
+		return false
+	}
+
+	event.Suppressed = entry.Suppressed
+	entry.Suppressed = 0
+	entry.LastSent = now
+	entry.Until = now.Add(rule.window)
+	entry.sentIncident = ""
+	if event.Incident != nil {
+		entry.sentIncident = event.Incident.ID
+	}
+	return true
+}
+
+// countSuppressedRepeats adds the repeated active events of an ended incident whose
+// start the cooldown held back, so the suppressed count is one of events, not incidents
+func countSuppressedRepeats(event *Event) {
+	if event.Incident == nil {
+		return
+	}
+	cooldowns.Lock()
+	defer cooldowns.Unlock()
+	entry, ok := cooldowns.entries[cooldownKey(event)]
+	if !ok || entry.heldIncident != event.Incident.ID {
+		return
+	}
+	entry.heldIncident = ""
+	entry.Suppressed += event.Incident.EventCount - 1
+}
+
+// cooldownKey identifies the suppression state of an event
+func cooldownKey(event *Event) string {
+	return fmt.Sprintf("%s|%s|%s|%s", event.Vendor, event.DeviceID, event.ChannelID, event.EventType)
+}
+
+// handleListCooldowns lists the suppression state of every key with a cooldown
+func handleListCooldowns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+
+	cooldowns.Lock()
+	keys := make([]string, 0, len(cooldowns.entries))
+	for key := range cooldowns.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := make([]cooldownEntry, 0, len(keys))
+	now := time.Now()
+	active := 0
+	for _, key := range keys {
+		entry := *cooldowns.entries[key]
+		if now.Before(entry.Until) {
+			active++
+		}
+		entries = append(entries, entry)
+	}
+	cooldowns.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cooldowns": entries,
+		"active":    active,
+	})
+}
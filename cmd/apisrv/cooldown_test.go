@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useCooldowns configures the cooldowns for the test
+func useCooldowns(t *testing.T, configs []CooldownConfig) {
+	if err := initCooldowns(configs); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cooldowns.Lock()
+		cooldowns.rules = nil
+		cooldowns.entries = map[string]*cooldownEntry{}
+		cooldowns.Unlock()
+	})
+}
+
+func TestCooldownWindow(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useCooldowns(t, []CooldownConfig{{EventType: "MotionDetection", Window: "100ms"}})
+
+	for i := 0; i < 3; i++ {
+		processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1"})
+	}
+	// Other channels and event types have their own window or none
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel2"})
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "VideoLoss", DeviceID: "cam1", ChannelID: "Channel1"})
+	if events := notifier.received(); len(events) != 3 {
+		t.Fatalf("got %d events within the window, want 3", len(events))
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1"})
+	events := notifier.received()
+	if len(events) != 4 {
+		t.Fatalf("got %d events after the window, want 4", len(events))
+	}
+	if suppressed := events[3].Suppressed; suppressed != 2 {
+		t.Errorf("got %d suppressed, want 2", suppressed)
+	}
+}
+
+func TestCooldownSuppressedIncidentEvents(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useIncidents(t, IncidentConfig{Timeout: "1m"})
+	useCooldowns(t, []CooldownConfig{{Window: "100ms"}})
+
+	send := func(eventState string) {
+		processEvent(&Event{Vendor: VendorHikVision, EventType: "MotionDetection", DeviceID: "cam1",
+			ChannelID: "Channel1", State: eventState})
+	}
+	send(EventStateActive)
+	send(EventStateInactive)
+
+	// The next incident is held back, its start and repeats are counted as events
+	for i := 0; i < 3; i++ {
+		send(EventStateActive)
+	}
+	send(EventStateInactive)
+
+	time.Sleep(150 * time.Millisecond)
+	send(EventStateActive)
+	events := notifier.received()
+	if phases := incidentPhases(events); len(phases) != 3 || phases[2] != IncidentStarted {
+		t.Fatalf("got phases %v, want a start and end, then the next start", phases)
+	}
+	if suppressed := events[2].Suppressed; suppressed != 3 {
+		t.Errorf("got %d suppressed, want the 3 events of the held back incident", suppressed)
+	}
+
+	// The count starts over after it was reported
+	time.Sleep(150 * time.Millisecond)
+	send(EventStateInactive)
+	send(EventStateActive)
+	events = notifier.received()
+	if len(events) != 5 || events[4].Suppressed != 0 {
+		t.Errorf("got %d events, want 5 with nothing suppressed", len(events))
+	}
+}
+
+func TestListCooldowns(t *testing.T) {
+	useRecordingNotifier(t)
+	useCooldowns(t, []CooldownConfig{{DeviceID: "cam1", Window: "1m"}})
+
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1"})
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1"})
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam2", ChannelID: "Channel1"})
+
+	rec := httptest.NewRecorder()
+	handleListCooldowns(rec, httptest.NewRequest(http.MethodGet, "/api/cooldowns", nil))
+	var response struct {
+		Cooldowns []cooldownEntry `json:"cooldowns"`
+		Active    int             `json:"active"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Active != 1 || len(response.Cooldowns) != 1 {
+		t.Fatalf("got %d cooldowns, %d active, want one for cam1", len(response.Cooldowns), response.Active)
+	}
+	entry := response.Cooldowns[0]
+	if entry.DeviceID != "cam1" || entry.Window != "1m0s" || entry.Suppressed != 1 || !entry.Until.After(time.Now()) {
+		t.Errorf("got %+v", entry)
+	}
+
+	rec = httptest.NewRecorder()
+	handleListCooldowns(rec, httptest.NewRequest(http.MethodPost, "/api/cooldowns", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for POST, want 405", rec.Code)
+	}
+}
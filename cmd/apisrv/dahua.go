@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Vendor name for Dahua and Amcrest (Dahua OEM) devices
+const VendorDahua = "Dahua"
+
+// DahuaEvent represents a single Dahua event, as sent by the eventManager attach
+// stream (Code=VideoMotion;action=Start;index=0) or the JSON HTTP push
+type DahuaEvent struct {
+	Code   string                 `json:"Code"`
+	Action string                 `json:"Action"`
+	Index  int                    `json:"Index"`
+	Data   map[string]interface{} `json:"Data,omitempty"`
+}
+
+// dahuaEventTypes maps Dahua event codes to our standardized types
+var dahuaEventTypes = map[string]string{
+	"videomotion":            "MotionDetection",
+	"smartmotionhuman":       "MotionDetection",
+	"smartmotionvehicle":     "MotionDetection",
+	"videomotioninfo":        "MotionDetection",
+	"videoloss":              "VideoLoss",
+	"videoblind":             "TamperDetection",
+	"videoabnormaldetection": "TamperDetection",
+	"storagefailure":         "StorageFailure",
+	"storagenotexist":        "StorageFailure",
+	"storagelowspace":        "StorageFailure",
+	"storageaccessfailure":   "StorageFailure",
+	"crosslinedetection":     "LineCrossing",
+	"crossregiondetection":   "IntrusionDetection",
+	"leftdetection":          "IntrusionDetection",
+	"facedetection":          "FaceDetection",
+	"facerecognition":        "FaceDetection",
+	"alarmlocal":             "IOAlarm",
+	"alarmoutput":            "IOAlarm",
+	"netabort":               "DeviceConnection",
+}
+
+func init() {
+	registerAdapter("dahua", newDahuaAdapter)
+}
+
+// dahuaAdapter receives event pushes from Dahua and Amcrest devices
+type dahuaAdapter struct {
+	cfg AdapterConfig
+}
+
+// newDahuaAdapter creates the Dahua ingest adapter
+func newDahuaAdapter(cfg AdapterConfig) (IngestAdapter, error) {
+	return &dahuaAdapter{cfg: cfg}, nil
+}
+
+func (a *dahuaAdapter) Name() string { return VendorDahua }
+
+func (a *dahuaAdapter) Routes() []string {
+	return adapterRoutes(a.cfg, "/dahua/event")
+}
+
+func (a *dahuaAdapter) Methods() []string {
+	return []string{http.MethodPost, http.MethodPut}
+}
+
+func (a *dahuaAdapter) Authenticate(r *http.Request) bool {
+	return checkAdapterAuth(r, a.cfg.Username, a.cfg.Password)
+}
+
+// Parse decodes a Dahua event push. The device is identified by the "device"
+// query parameter, or by the remote address when it is missing.
+func (a *dahuaAdapter) Parse(r *http.Request, body []byte) ([]Event, error) {
+	dahuaEvents, err := parseDahuaPayload(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, err
+	}
+	if len(dahuaEvents) == 0 {
+		return nil, fmt.Errorf("no Dahua events found in payload")
+	}
+
+	deviceID := requestDeviceID(r, "DAHUA")
+
+	events := make([]Event, 0, len(dahuaEvents))
+	for _, dahuaEvent := range dahuaEvents {
+		events = append(events, convertDahuaEvent(dahuaEvent, deviceID, string(body)))
+	}
+	return events, nil
+}
+
+// parseDahuaPayload extracts all events from a JSON, multipart or plain text payload
+func parseDahuaPayload(contentType string, body []byte) ([]DahuaEvent, error) {
+	trimmed := bytes.TrimSpace(body)
+
+	// JSON push, either a single event or a list of events
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return parseDahuaJSON(trimmed)
+	}
+
+	// Multipart stream as produced by eventManager.cgi?action=attach
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	boundary := params["boundary"]
+	if boundary == "" && bytes.HasPrefix(trimmed, []byte("--")) {
+		// Captured streams are often posted without the original content type
+		firstLine, _, _ := bytes.Cut(trimmed, []byte("\n"))
+		boundary = strings.TrimPrefix(strings.TrimSpace(string(firstLine)), "--")
+	}
+	if strings.HasPrefix(mediaType, "multipart/") || boundary != "" {
+		return parseDahuaMultipart(body, boundary)
+	}
+
+	return parseDahuaText(body)
+}
+
+// parseDahuaJSON decodes the JSON variant of the Dahua HTTP push
+func parseDahuaJSON(body []byte) ([]DahuaEvent, error) {
+	if body[0] == '[' {
+		var dahuaEvents []DahuaEvent
+		if err := json.Unmarshal(body, &dahuaEvents); err != nil {
+			return nil, fmt.Errorf("error parsing Dahua JSON: %v", err)
+		}
+		return dahuaEvents, nil
+	}
+
+	var dahuaEvent DahuaEvent
+	if err := json.Unmarshal(body, &dahuaEvent); err != nil {
+		return nil, fmt.Errorf("error parsing Dahua JSON: %v", err)
+	}
+	return []DahuaEvent{dahuaEvent}, nil
+}
+
+// parseDahuaMultipart decodes every part of a multipart event stream
+func parseDahuaMultipart(body []byte, boundary string) ([]DahuaEvent, error) {
+	var dahuaEvents []DahuaEvent
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A truncated stream still yields the events parsed so far
+			if len(dahuaEvents) > 0 {
+				break
+			}
+			return nil, fmt.Errorf("error reading Dahua multipart stream: %v", err)
+		}
+
+		// A capture of the open stream ends without the closing boundary, the
+		// last part is complete nonetheless
+		partBody, err := io.ReadAll(part)
+		truncated := err == io.ErrUnexpectedEOF
+		if err != nil && !truncated {
+			return nil, fmt.Errorf("error reading Dahua multipart part: %v", err)
+		}
+
+		partEvents, err := parseDahuaText(partBody)
+		if err != nil {
+			if truncated && len(dahuaEvents) > 0 {
+				break
+			}
+			return nil, err
+		}
+		dahuaEvents = append(dahuaEvents, partEvents...)
+		if truncated {
+			break
+		}
+	}
+	return dahuaEvents, nil
+}
+
+// parseDahuaText decodes events in Code=...;action=...;index=... format. Each event
+// starts on a new line; its data JSON may continue over the following lines.
+func parseDahuaText(body []byte) ([]DahuaEvent, error) {
+	var records []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(line), "Code="):
+			records = append(records, strings.TrimSpace(line))
+		case len(records) > 0:
+			records[len(records)-1] += "\n" + line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading Dahua event text: %v", err)
+	}
+
+	dahuaEvents := make([]DahuaEvent, 0, len(records))
+	for _, record := range records {
+		dahuaEvent, err := parseDahuaLine(strings.TrimSpace(record))
+		if err != nil {
+			return nil, err
+		}
+		dahuaEvents = append(dahuaEvents, dahuaEvent)
+	}
+	return dahuaEvents, nil
+}
+
+// parseDahuaLine decodes a single Code=...;action=...;index=...;data={...} record
+func parseDahuaLine(line string) (DahuaEvent, error) {
+	var dahuaEvent DahuaEvent
+
+	// The data field is JSON and may itself contain ';', so it is split off first
+	fields := line
+	if i := strings.Index(line, ";data="); i >= 0 {
+		fields = line[:i]
+		data := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line[i+len(";data="):]), &data); err != nil {
+			return dahuaEvent, fmt.Errorf("error parsing Dahua event data: %v", err)
+		}
+		dahuaEvent.Data = data
+	}
+
+	for _, field := range strings.Split(fields, ";") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "code":
+			dahuaEvent.Code = value
+		case "action":
+			dahuaEvent.Action = value
+		case "index":
+			index, err := strconv.Atoi(value)
+			if err != nil {
+				return dahuaEvent, fmt.Errorf("invalid Dahua event index %q", value)
+			}
+			dahuaEvent.Index = index
+		}
+	}
+
+	if dahuaEvent.Code == "" {
+		return dahuaEvent, fmt.Errorf("missing Dahua event code in %q", line)
+	}
+	return dahuaEvent, nil
+}
+
+// convertDahuaEvent converts a Dahua event to our standard event format
+func convertDahuaEvent(dahuaEvent DahuaEvent, deviceID string, rawPayload string) Event {
+	// The data is copied first so its keys never replace ours
+	eventDetails := map[string]interface{}{}
+	for key, value := range dahuaEvent.Data {
+		eventDetails[key] = value
+	}
+	eventDetails["source"] = VendorDahua
+	eventDetails["originalType"] = dahuaEvent.Code
+	eventDetails["action"] = dahuaEvent.Action
+	eventDetails["index"] = dahuaEvent.Index
+
+	// Dahua reports Start, Stop or Pulse; only Stop ends an event
+	eventState := EventStateActive
+	if strings.EqualFold(dahuaEvent.Action, "Stop") {
+		eventState = EventStateInactive
+	}
+
+	// NetAbort starts when the device loses its network, i.e. it is disconnected
+	eventType := mapDahuaEventType(dahuaEvent.Code)
+	if strings.EqualFold(dahuaEvent.Code, "NetAbort") {
+		eventDetails["status"] = "disconnected"
+		if eventState == EventStateInactive {
+			eventDetails["status"] = "connected"
+			eventState = EventStateActive
+		} else {
+			eventState = EventStateInactive
+		}
+	}
+
+	// Dahua channel indexes are zero based
+	return Event{
+		Vendor:       VendorDahua,
+		EventType:    eventType,
+		EventTime:    time.Now(),
+		ReceivedAt:   time.Now(),
+		DeviceID:     deviceID,
+		ChannelID:    fmt.Sprintf("Channel%d", dahuaEvent.Index+1),
+		State:        eventState,
+		EventDetails: eventDetails,
+		Raw:          rawPayload,
+	}
+}
+
+// mapDahuaEventType converts Dahua event codes to our standardized types
+func mapDahuaEventType(code string) string {
+	if eventType, ok := dahuaEventTypes[strings.ToLower(code)]; ok {
+		return eventType
+	}
+	return "UnknownEvent_" + strings.ToLower(code)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDahuaPayload(t *testing.T) {
+	type want struct {
+		code      string
+		action    string
+		eventType string
+		state     string
+		channel   string
+		status    string
+	}
+	tests := []struct {
+		name        string
+		file        string
+		contentType string
+		want        []want
+	}{
+		{
+			name:        "multipart stream with content type",
+			file:        "attach_stream_motion.txt",
+			contentType: "multipart/x-mixed-replace; boundary=myboundary",
+			want: []want{
+				{code: "VideoMotion", action: "Start", eventType: "MotionDetection", state: EventStateActive, channel: "Channel1"},
+				{code: "VideoMotion", action: "Stop", eventType: "MotionDetection", state: EventStateInactive, channel: "Channel1"},
+				{code: "VideoLoss", action: "Start", eventType: "VideoLoss", state: EventStateActive, channel: "Channel3"},
+			},
+		},
+		{
+			// Captured streams are often posted without their content type
+			name:        "multipart stream with sniffed boundary",
+			file:        "attach_stream_motion.txt",
+			contentType: "text/plain",
+			want: []want{
+				{code: "VideoMotion", action: "Start", eventType: "MotionDetection", state: EventStateActive, channel: "Channel1"},
+				{code: "VideoMotion", action: "Stop", eventType: "MotionDetection", state: EventStateInactive, channel: "Channel1"},
+				{code: "VideoLoss", action: "Start", eventType: "VideoLoss", state: EventStateActive, channel: "Channel3"},
+			},
+		},
+		{
+			// eventManager.cgi?action=attach&codes=[All]&heartbeat=5, cut off while still open
+			name:        "attach stream with heartbeats and IVS data",
+			file:        "attach_stream_ivs.txt",
+			contentType: "multipart/x-mixed-replace; boundary=myboundary",
+			want: []want{
+				{code: "CrossRegionDetection", action: "Start", eventType: "IntrusionDetection", state: EventStateActive, channel: "Channel1"},
+				{code: "CrossRegionDetection", action: "Stop", eventType: "IntrusionDetection", state: EventStateInactive, channel: "Channel1"},
+			},
+		},
+		{
+			name: "data spanning lines",
+			file: "crossline_with_data.txt",
+			want: []want{
+				{code: "CrossLineDetection", action: "Start", eventType: "LineCrossing", state: EventStateActive, channel: "Channel2"},
+			},
+		},
+		{
+			name:        "JSON push",
+			file:        "http_push.json",
+			contentType: "application/json",
+			want: []want{
+				{code: "VideoBlind", action: "Start", eventType: "TamperDetection", state: EventStateActive, channel: "Channel4"},
+			},
+		},
+		{
+			name: "plain lines with NetAbort",
+			file: "plain_lines.txt",
+			want: []want{
+				{code: "AlarmLocal", action: "Start", eventType: "IOAlarm", state: EventStateActive, channel: "Channel1"},
+				{code: "NetAbort", action: "Start", eventType: "DeviceConnection", state: EventStateInactive, channel: "Channel1", status: "disconnected"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "dahua", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dahuaEvents, err := parseDahuaPayload(tt.contentType, body)
+			if err != nil {
+				t.Fatalf("parseDahuaPayload: %v", err)
+			}
+			if len(dahuaEvents) != len(tt.want) {
+				t.Fatalf("got %d events, want %d: %+v", len(dahuaEvents), len(tt.want), dahuaEvents)
+			}
+
+			for i, want := range tt.want {
+				dahuaEvent := dahuaEvents[i]
+				if dahuaEvent.Code != want.code || dahuaEvent.Action != want.action {
+					t.Errorf("event %d: got %s/%s, want %s/%s", i, dahuaEvent.Code, dahuaEvent.Action, want.code, want.action)
+				}
+				event := convertDahuaEvent(dahuaEvent, "DAHUA_test", string(body))
+				if event.EventType != want.eventType || event.State != want.state || event.ChannelID != want.channel {
+					t.Errorf("event %d: got %s/%s/%s, want %s/%s/%s", i, event.EventType, event.State, event.ChannelID,
+						want.eventType, want.state, want.channel)
+				}
+				if want.status != "" && event.EventDetails["status"] != want.status {
+					t.Errorf("event %d: got status %v, want %s", i, event.EventDetails["status"], want.status)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDahuaLineDataWithSemicolon(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "dahua", "crossline_with_data.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dahuaEvents, err := parseDahuaPayload("", body)
+	if err != nil {
+		t.Fatalf("parseDahuaPayload: %v", err)
+	}
+	if len(dahuaEvents) != 1 {
+		t.Fatalf("got %d events, want 1", len(dahuaEvents))
+	}
+
+	dahuaEvent := dahuaEvents[0]
+	if dahuaEvent.Index != 1 {
+		t.Errorf("got index %d, want 1", dahuaEvent.Index)
+	}
+	if name := dahuaEvent.Data["Name"]; name != "Gate;Line" {
+		t.Errorf("got data name %v, want Gate;Line", name)
+	}
+	event := convertDahuaEvent(dahuaEvent, "DAHUA_test", "")
+	if direction := event.EventDetails["Direction"]; direction != "LeftToRight" {
+		t.Errorf("got direction %v, want LeftToRight", direction)
+	}
+}
+
+func TestConvertDahuaNetAbort(t *testing.T) {
+	tests := []struct {
+		action string
+		state  string
+		status string
+	}{
+		// The device lost its network: it is disconnected
+		{action: "Start", state: EventStateInactive, status: "disconnected"},
+		// The network is back: it is connected again
+		{action: "Stop", state: EventStateActive, status: "connected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			event := convertDahuaEvent(DahuaEvent{Code: "NetAbort", Action: tt.action}, "DAHUA_test", "")
+			if event.EventType != "DeviceConnection" {
+				t.Errorf("got event type %s, want DeviceConnection", event.EventType)
+			}
+			if event.State != tt.state || event.EventDetails["status"] != tt.status {
+				t.Errorf("got %s/%v, want %s/%s", event.State, event.EventDetails["status"], tt.state, tt.status)
+			}
+		})
+	}
+}
+
+func TestConvertDahuaDataKeys(t *testing.T) {
+	dahuaEvent := DahuaEvent{Code: "AlarmLocal", Action: "Start", Index: 2, Data: map[string]interface{}{
+		"source": "Door", "action": "Open", "index": 7, "originalType": "Magnet", "SenseMethod": "DoorMagnetism",
+	}}
+	event := convertDahuaEvent(dahuaEvent, "DAHUA_test", "")
+
+	want := map[string]interface{}{
+		"source": VendorDahua, "action": "Start", "index": 2, "originalType": "AlarmLocal", "SenseMethod": "DoorMagnetism",
+	}
+	for key, value := range want {
+		if event.EventDetails[key] != value {
+			t.Errorf("got %s %v, want %v", key, event.EventDetails[key], value)
+		}
+	}
+}
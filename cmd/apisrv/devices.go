@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeviceConfig is an inventory entry describing a device and its channels.
+// Events are matched by device ID, MAC address or IP address.
+type DeviceConfig struct {
+	ID       string   `json:"id,omitempty"`
+	MAC      string   `json:"mac,omitempty"`
+	IP       string   `json:"ip,omitempty"`
+	Name     string   `json:"name"`
+	Site     string   `json:"site,omitempty"`
+	Location string   `json:"location,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// Channels describes the cameras of an NVR, keyed by channel number ("1") or channel ID ("Channel1")
+	Channels map[string]ChannelConfig `json:"channels,omitempty"`
+	// Probe actively checks the device for the watchdog
+	Probe *ProbeConfig `json:"probe,omitempty"`
+	// OfflineAfter overrides the watchdog threshold for this device, "0s" disables it
+	OfflineAfter string `json:"offline_after,omitempty"`
+}
+
+// ChannelConfig describes one camera of a device
+type ChannelConfig struct {
+	Name     string   `json:"name"`
+	Location string   `json:"location,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// DeviceInfo is the inventory data attached to an event
+type DeviceInfo struct {
+	Name     string   `json:"name"`
+	Site     string   `json:"site,omitempty"`
+	Location string   `json:"location,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// Camera is the name of the channel, or the device name for single channel devices
+	Camera string `json:"camera,omitempty"`
+}
+
+// deviceRegistry indexes the inventory by device ID, MAC and IP address
+type deviceRegistry struct {
+	byID  map[string]*DeviceConfig
+	byMAC map[string]*DeviceConfig
+	byIP  map[string]*DeviceConfig
+}
+
+// buildDeviceRegistry indexes the device inventory
+func buildDeviceRegistry(configs []DeviceConfig) (*deviceRegistry, error) {
+	registry := &deviceRegistry{
+		byID:  map[string]*DeviceConfig{},
+		byMAC: map[string]*DeviceConfig{},
+		byIP:  map[string]*DeviceConfig{},
+	}
+
+	for i := range configs {
+		device := &configs[i]
+		if device.ID == "" && device.MAC == "" && device.IP == "" {
+			return nil, fmt.Errorf("device %d (%s) needs an id, mac or ip", i+1, device.Name)
+		}
+		if device.ID != "" {
+			key := strings.ToLower(device.ID)
+			if _, ok := registry.byID[key]; ok {
+				return nil, fmt.Errorf("duplicate device id %q", device.ID)
+			}
+			registry.byID[key] = device
+		}
+		if device.MAC != "" {
+			registry.byMAC[normalizeMAC(device.MAC)] = device
+		}
+		if device.IP != "" {
+			registry.byIP[device.IP] = device
+		}
+	}
+	return registry, nil
+}
+
+// normalizeMAC strips separators so 00:11:22:33:44:55 and 001122334455 match
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+}
+
+// lookup finds the inventory entry of an event. Device IDs compare case-insensitively
+// since they are often derived from MAC addresses.
+func (r *deviceRegistry) lookup(event *Event) *DeviceConfig {
+	if device, ok := r.byID[strings.ToLower(event.DeviceID)]; ok {
+		return device
+	}
+	if mac, ok := event.EventDetails["macAddress"].(string); ok && mac != "" {
+		if device, ok := r.byMAC[normalizeMAC(mac)]; ok {
+			return device
+		}
+	}
+	if ip, ok := event.EventDetails["ipAddress"].(string); ok && ip != "" {
+		if device, ok := r.byIP[ip]; ok {
+			return device
+		}
+	}
+	return nil
+}
+
+// channel returns the configuration of the event's channel
+func (d *DeviceConfig) channel(channelID string) (ChannelConfig, bool) {
+	if channel, ok := d.Channels[channelID]; ok {
+		return channel, true
+	}
+	// Channel IDs such as "Channel1" are also found by their number
+	number := strings.TrimLeft(channelID, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_")
+	channel, ok := d.Channels[number]
+	return channel, ok
+}
+
+// enrichEvent attaches the inventory data of the device and channel to the event
+func enrichEvent(event *Event) {
+	if state.Devices == nil {
+		return
+	}
+	device := state.Devices.lookup(event)
+	if device == nil {
+		return
+	}
+
+	info := &DeviceInfo{
+		Name:     device.Name,
+		Site:     device.Site,
+		Location: device.Location,
+		Tags:     append([]string(nil), device.Tags...),
+	}
+	if channel, ok := device.channel(event.ChannelID); ok {
+		info.Camera = channel.Name
+		if channel.Location != "" {
+			info.Location = channel.Location
+		}
+		info.Tags = append(info.Tags, channel.Tags...)
+	} else if len(device.Channels) == 0 {
+		info.Camera = device.Name
+	}
+	event.Device = info
+}
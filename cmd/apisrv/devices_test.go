@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useDevices makes the inventory the registry for the test
+func useDevices(t *testing.T, configs []DeviceConfig) {
+	registry, err := buildDeviceRegistry(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := state.Devices
+	state.Devices = registry
+	t.Cleanup(func() { state.Devices = previous })
+}
+
+var testInventory = []DeviceConfig{
+	{ID: "HIK_001122334455", Name: "Office NVR", Site: "Headquarters", Location: "Server room", Tags: []string{"nvr"},
+		Channels: map[string]ChannelConfig{
+			"1":        {Name: "Front Gate", Location: "Main entrance", Tags: []string{"outdoor"}},
+			"Channel2": {Name: "Parking Lot"},
+		}},
+	{MAC: "AA-BB-CC-DD-EE-FF", Name: "Lobby Camera", Site: "Headquarters"},
+	{IP: "192.168.1.70", Name: "Warehouse Camera", Site: "Warehouse"},
+}
+
+func TestDeviceLookup(t *testing.T) {
+	useDevices(t, testInventory)
+
+	tests := []struct {
+		name     string
+		event    Event
+		device   string
+		camera   string
+		location string
+	}{
+		{"id of any case", Event{DeviceID: "hik_001122334455", ChannelID: "Channel1"}, "Office NVR", "Front Gate", "Main entrance"},
+		{"channel by id", Event{DeviceID: "HIK_001122334455", ChannelID: "Channel2"}, "Office NVR", "Parking Lot", "Server room"},
+		{"unknown channel", Event{DeviceID: "HIK_001122334455", ChannelID: "Channel9"}, "Office NVR", "", "Server room"},
+		{"mac", Event{DeviceID: "HIK_x", EventDetails: map[string]interface{}{"macAddress": "aa:bb:cc:dd:ee:ff"}},
+			"Lobby Camera", "Lobby Camera", ""},
+		{"ip", Event{DeviceID: "DAHUA_x", EventDetails: map[string]interface{}{"ipAddress": "192.168.1.70"}},
+			"Warehouse Camera", "Warehouse Camera", ""},
+		{"unknown", Event{DeviceID: "cam9", EventDetails: map[string]interface{}{"ipAddress": "192.168.1.99"}}, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := tt.event
+			enrichEvent(&event)
+			if tt.device == "" {
+				if event.Device != nil {
+					t.Errorf("got device %s, want none", event.Device.Name)
+				}
+				return
+			}
+			if event.Device == nil {
+				t.Fatal("got no device")
+			}
+			if event.Device.Name != tt.device || event.Device.Camera != tt.camera || event.Device.Location != tt.location {
+				t.Errorf("got %+v", event.Device)
+			}
+		})
+	}
+}
+
+func TestDeviceLookupBySender(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useDevices(t, testInventory)
+
+	adapters, err := buildAdapters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mountAdapters(mux, adapters)
+
+	// The payload carries no address, the device is found by the one it sends from
+	r := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(`{"eventType": "motion"}`))
+	r.RemoteAddr = "192.168.1.70:50123"
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	events := notifier.received()
+	if len(events) != 1 || events[0].Device == nil || events[0].Device.Name != "Warehouse Camera" {
+		t.Fatalf("got %d events, want the warehouse camera", len(events))
+	}
+	if ip := events[0].EventDetails["ipAddress"]; ip != "192.168.1.70" {
+		t.Errorf("got ipAddress %v", ip)
+	}
+}
+
+func TestBuildDeviceRegistryInvalid(t *testing.T) {
+	tests := map[string][]DeviceConfig{
+		"no key":       {{Name: "Nameless"}},
+		"duplicate id": {{ID: "cam1", Name: "A"}, {ID: "CAM1", Name: "B"}},
+	}
+	for name, configs := range tests {
+		if _, err := buildDeviceRegistry(configs); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
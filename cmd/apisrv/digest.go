@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// doDigestRequest sends the request and, when the server answers with a Digest
+// challenge, repeats it with an Authorization header (RFC 2617, MD5, qop=auth).
+// newRequest must return a fresh request for every attempt.
+func doDigestRequest(client *http.Client, newRequest func() (*http.Request, error), username, password string) (*http.Response, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || username == "" {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	// Some devices only accept basic auth
+	if !strings.HasPrefix(strings.ToLower(challenge), "digest ") {
+		req, err = newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(username, password)
+		return client.Do(req)
+	}
+
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	authorization, err := digestAuthorization(parseDigestChallenge(challenge), req.Method, req.URL.RequestURI(), username, password)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	return client.Do(req)
+}
+
+// parseDigestChallenge splits a WWW-Authenticate Digest header into its parameters
+func parseDigestChallenge(header string) map[string]string {
+	params := map[string]string{}
+	header = strings.TrimSpace(header[len("Digest "):])
+
+	for header != "" {
+		key, rest, ok := strings.Cut(header, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[key] = strings.TrimSpace(value)
+
+		header = strings.TrimLeft(strings.TrimSpace(rest), ",")
+		header = strings.TrimSpace(header)
+	}
+	return params
+}
+
+// digestAuthorization builds the Authorization header answering a Digest challenge
+func digestAuthorization(challenge map[string]string, method, uri, username, password string) (string, error) {
+	realm := challenge["realm"]
+	nonce := challenge["nonce"]
+	if nonce == "" {
+		return "", fmt.Errorf("digest challenge without nonce")
+	}
+
+	cnonceBytes := make([]byte, 8)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", fmt.Errorf("error generating cnonce: %v", err)
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := "00000001"
+
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", username, realm, password))
+	if strings.EqualFold(challenge["algorithm"], "MD5-sess") {
+		ha1 = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, nonce, cnonce))
+	}
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+
+	var response string
+	qop := ""
+	for _, option := range strings.Split(challenge["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = "auth"
+		}
+	}
+	if qop != "" {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, nonce, nc, cnonce, qop, ha2))
+	} else {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+	}
+
+	authorization := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		username, realm, nonce, uri, response)
+	if algorithm := challenge["algorithm"]; algorithm != "" {
+		authorization += fmt.Sprintf(`, algorithm=%s`, algorithm)
+	}
+	if opaque := challenge["opaque"]; opaque != "" {
+		authorization += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	if qop != "" {
+		authorization += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	return authorization, nil
+}
+
+// md5Hex returns the hex encoded MD5 hash of s
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]string
+	}{
+		{
+			name:   "HIKVision",
+			header: `Digest qop="auth", realm="IP Camera(C1234)", nonce="NjQ2ZTM5Mzc6YmQ=", stale="FALSE"`,
+			want:   map[string]string{"qop": "auth", "realm": "IP Camera(C1234)", "nonce": "NjQ2ZTM5Mzc6YmQ=", "stale": "FALSE"},
+		},
+		{
+			name:   "unquoted values and comma in quotes",
+			header: `Digest realm="Login to 5L0123, NVR",nonce="abc",algorithm=MD5,qop="auth,auth-int",opaque="xyz"`,
+			want: map[string]string{"realm": "Login to 5L0123, NVR", "nonce": "abc", "algorithm": "MD5",
+				"qop": "auth,auth-int", "opaque": "xyz"},
+		},
+		{
+			name:   "unterminated quote",
+			header: `Digest realm="cam", nonce="abc`,
+			want:   map[string]string{"realm": "cam", "nonce": "abc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDigestChallenge(tt.header)
+			if len(got) != len(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("%s: got %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	// The example of RFC 2617 section 3.5
+	challenge := map[string]string{
+		"realm":  "testrealm@host.com",
+		"nonce":  "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		"opaque": "5ccc069c403ebaf9f0171e9517f40e41",
+	}
+
+	t.Run("without qop", func(t *testing.T) {
+		authorization, err := digestAuthorization(challenge, http.MethodGet, "/dir/index.html", "Mufasa", "Circle Of Life")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := parseDigestChallenge(authorization)
+		if got["response"] != "670fd8c2df070c60b045671b8b24ff02" {
+			t.Errorf("got response %q", got["response"])
+		}
+		if got["opaque"] != challenge["opaque"] || got["qop"] != "" {
+			t.Errorf("got %v", got)
+		}
+	})
+
+	t.Run("qop auth", func(t *testing.T) {
+		withQop := map[string]string{"qop": "auth,auth-int"}
+		for key, value := range challenge {
+			withQop[key] = value
+		}
+		authorization, err := digestAuthorization(withQop, http.MethodGet, "/dir/index.html", "Mufasa", "Circle Of Life")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := parseDigestChallenge(authorization)
+		if got["qop"] != "auth" || got["nc"] != "00000001" || got["cnonce"] == "" {
+			t.Fatalf("got %v", got)
+		}
+		if want := expectedDigestResponse(got, http.MethodGet, "Circle Of Life"); got["response"] != want {
+			t.Errorf("got response %q, want %q", got["response"], want)
+		}
+	})
+
+	t.Run("without nonce", func(t *testing.T) {
+		if _, err := digestAuthorization(map[string]string{"realm": "cam"}, http.MethodGet, "/", "admin", "secret"); err == nil {
+			t.Error("got no error for a challenge without nonce")
+		}
+	})
+}
+
+// expectedDigestResponse computes the qop=auth response a server expects for the parsed Authorization
+func expectedDigestResponse(auth map[string]string, method, password string) string {
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", auth["username"], auth["realm"], password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, auth["uri"]))
+	return md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, auth["nonce"], auth["nc"], auth["cnonce"], auth["qop"], ha2))
+}
+
+func TestDoDigestRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			w.Header().Set("WWW-Authenticate", `Digest qop="auth", realm="IP Camera", nonce="n0nce"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		auth := parseDigestChallenge(header)
+		if auth["username"] != "admin" || auth["uri"] != r.URL.RequestURI() ||
+			auth["response"] != expectedDigestResponse(auth, r.Method, "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		password string
+		status   int
+	}{
+		{password: "secret", status: http.StatusOK},
+		{password: "wrong", status: http.StatusUnauthorized},
+	} {
+		resp, err := doDigestRequest(http.DefaultClient, func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, server.URL+"/ISAPI/System/deviceInfo?format=json", nil)
+		}, "admin", tt.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("password %s: got status %d, want %d", tt.password, resp.StatusCode, tt.status)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Overload policies used in QueueConfig.Overload
+const (
+	// OverloadBlock makes ingest wait until the queue has room
+	OverloadBlock = "block"
+	// OverloadDropOldest discards the oldest queued notification to make room
+	OverloadDropOldest = "drop_oldest"
+	// OverloadReject discards new notifications while the queue is full, ingest answers
+	// 503 once every queue rejects
+	OverloadReject = "reject"
+)
+
+// QueueConfig configures the dispatch queue of a notifier. Notifications are
+// queued per notifier so a slow output does not hold up ingest or the others.
+type QueueConfig struct {
+	// Size is the number of notifications that may wait, defaults to 100
+	Size int `json:"size,omitempty"`
+	// Workers is the number of concurrent deliveries, defaults to 1 which keeps the order
+	Workers int `json:"workers,omitempty"`
+	// Timeout limits one delivery, defaults to 30s
+	Timeout string `json:"timeout,omitempty"`
+	// Overload is "block" (default), "drop_oldest" or "reject"
+	Overload string `json:"overload,omitempty"`
+	// MaxAttempts is the number of deliveries tried before dead lettering, defaults to 5
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff is the wait before the first retry, doubled for every further retry, defaults to 10s
+	Backoff string `json:"backoff,omitempty"`
+	// MaxBackoff limits the wait between retries, defaults to 10m
+	MaxBackoff string `json:"max_backoff,omitempty"`
+	// Jitter randomizes each wait by up to this fraction, defaults to 0.2, 0 disables it
+	Jitter *float64 `json:"jitter,omitempty"`
+}
+
+// notifierQueue holds the notifications waiting for one notifier
+type notifierQueue struct {
+	notifier    Notifier
+	overload    string
+	timeout     time.Duration
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+	deliveries  chan *delivery
+
+	// retries holds the failed deliveries until their next attempt, at most as
+	// many as fit into the queue. retryWake tells retryLoop about new ones.
+	retryMu   sync.Mutex
+	retries   []*delivery
+	retryWake chan struct{}
+}
+
+// dispatchQueues maps notifier names to their queues, set up before the server starts
+var dispatchQueues = map[string]*notifierQueue{}
+
+func init() {
+	registerMetric(newGaugeVecFunc("nvr_queue_depth", "Notifications waiting in the dispatch queue, by notifier.",
+		"notifier", func() map[string]float64 {
+			depths := map[string]float64{}
+			for name, queue := range dispatchQueues {
+				depths[name] = float64(len(queue.deliveries))
+			}
+			return depths
+		}))
+}
+
+// Metrics of overloaded queues and failed deliveries
+var (
+	queueDropped = newCounterVec("nvr_queue_dropped_total",
+		"Notifications discarded because the dispatch queue was full, by notifier and policy.", "notifier", "policy")
+	ingestRejected = newCounterVec("nvr_ingest_rejected_total",
+		"Ingest requests answered with 503 because a dispatch queue was full, by endpoint.", "endpoint")
+	deliveryRetries = newCounterVec("nvr_notifier_retries_total",
+		"Failed notifications scheduled for another attempt, by notifier.", "notifier")
+	deadLettered = newCounterVec("nvr_dead_letters_total",
+		"Notifications moved to the dead letters after their last attempt failed, by notifier.", "notifier")
+	outboxFailures = newCounterVec("nvr_outbox_failures_total",
+		"Notifications that could not be saved to the outbox, by notifier.", "notifier")
+)
+
+// startDispatch creates the queue and workers of every notifier and resumes the
+// deliveries left in the outbox. The dispatch settings apply to all notifiers,
+// the queue settings of a notifier override them.
+func startDispatch(cfg Config, notifiers []Notifier) error {
+	if err := openOutbox(cfg.OutboxDir, cfg.DeadLetterMax); err != nil {
+		return fmt.Errorf("error opening outbox: %v", err)
+	}
+
+	overrides := map[string]*QueueConfig{}
+	for _, notifierCfg := range append(legacyNotifierConfigs(cfg), cfg.Notifiers...) {
+		name := notifierCfg.Name
+		if name == "" {
+			name = notifierCfg.Type
+		}
+		if notifierCfg.Enabled && notifierCfg.Queue != nil {
+			overrides[name] = notifierCfg.Queue
+		}
+	}
+
+	for _, notifier := range notifiers {
+		queueCfg := mergeQueueConfig(cfg.Dispatch, overrides[notifier.Name()])
+		queue, err := newNotifierQueue(notifier, queueCfg)
+		if err != nil {
+			return fmt.Errorf("notifier %q: %v", notifier.Name(), err)
+		}
+		dispatchQueues[notifier.Name()] = queue
+
+		workers := max(queueCfg.Workers, 1)
+		for i := 0; i < workers; i++ {
+			go queue.work()
+		}
+		go queue.retryLoop()
+		state.Logger.Info("Started dispatch queue", "notifier", notifier.Name(), "size", cap(queue.deliveries),
+			"workers", workers, "timeout", queue.timeout.String(), "overload", queue.overload,
+			"maxAttempts", queue.maxAttempts, "backoff", queue.backoff.String())
+	}
+	return resumeDeliveries()
+}
+
+// resumeDeliveries queues the deliveries that were pending when the service stopped
+func resumeDeliveries() error {
+	pending, err := loadPendingDeliveries()
+	if err != nil {
+		return fmt.Errorf("error reading outbox: %v", err)
+	}
+
+	resumed := map[string][]*delivery{}
+	for _, d := range pending {
+		if _, ok := dispatchQueues[d.Notifier]; !ok {
+			d.LastError = fmt.Sprintf("notifier %q is not configured", d.Notifier)
+			if err := deadLetter(d); err != nil {
+				return fmt.Errorf("error moving delivery %s to the dead letters: %v", d.ID, err)
+			}
+			deadLettered.inc(d.Notifier)
+			d.Event.logger().Warn("Moved delivery of unknown notifier to the dead letters",
+				"notifier", d.Notifier, "deliveryId", d.ID)
+			continue
+		}
+		resumed[d.Notifier] = append(resumed[d.Notifier], d)
+	}
+
+	for name, deliveries := range resumed {
+		queue := dispatchQueues[name]
+		state.Logger.Info("Resuming pending deliveries", "notifier", name, "count", len(deliveries))
+		// The queue may be smaller than the backlog, fill it while the workers drain it
+		go func() {
+			for _, d := range deliveries {
+				wait := time.Until(d.NextAttempt)
+				if wait > 0 && queue.scheduleRetry(d) {
+					continue
+				}
+				// Retries beyond the queue size wait here, one after the other
+				time.Sleep(wait)
+				queue.requeue(d)
+			}
+		}()
+	}
+	return nil
+}
+
+// mergeQueueConfig applies the fields set in override to base
+func mergeQueueConfig(base QueueConfig, override *QueueConfig) QueueConfig {
+	if override == nil {
+		return base
+	}
+	if override.Size != 0 {
+		base.Size = override.Size
+	}
+	if override.Workers != 0 {
+		base.Workers = override.Workers
+	}
+	if override.Timeout != "" {
+		base.Timeout = override.Timeout
+	}
+	if override.Overload != "" {
+		base.Overload = override.Overload
+	}
+	if override.MaxAttempts != 0 {
+		base.MaxAttempts = override.MaxAttempts
+	}
+	if override.Backoff != "" {
+		base.Backoff = override.Backoff
+	}
+	if override.MaxBackoff != "" {
+		base.MaxBackoff = override.MaxBackoff
+	}
+	if override.Jitter != nil {
+		base.Jitter = override.Jitter
+	}
+	return base
+}
+
+// newNotifierQueue validates the queue settings and creates the queue
+func newNotifierQueue(notifier Notifier, cfg QueueConfig) (*notifierQueue, error) {
+	timeout, err := parseDurationDefault(cfg.Timeout, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue timeout: %v", err)
+	}
+	backoff, err := parseDurationDefault(cfg.Backoff, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue backoff: %v", err)
+	}
+	maxBackoff, err := parseDurationDefault(cfg.MaxBackoff, 10*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue max_backoff: %v", err)
+	}
+	jitter := 0.2
+	if cfg.Jitter != nil {
+		jitter = *cfg.Jitter
+	}
+	if jitter < 0 || jitter > 1 {
+		return nil, fmt.Errorf("invalid queue jitter %v, expected a fraction between 0 and 1", jitter)
+	}
+	size := cfg.Size
+	if size <= 0 {
+		size = 100
+	}
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	overload := strings.ToLower(cfg.Overload)
+	switch overload {
+	case "":
+		overload = OverloadBlock
+	case OverloadBlock, OverloadDropOldest, OverloadReject:
+	default:
+		return nil, fmt.Errorf("unknown overload policy %q, expected block, drop_oldest or reject", cfg.Overload)
+	}
+
+	return &notifierQueue{
+		notifier:    notifier,
+		overload:    overload,
+		timeout:     timeout,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		maxBackoff:  max(maxBackoff, backoff),
+		jitter:      jitter,
+		deliveries:  make(chan *delivery, size),
+		retryWake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// queueNotification stores the event in the outbox and hands it to the queue of
+// the notifier, following its overload policy when the queue is full
+func queueNotification(notifier Notifier, event *Event) {
+	queue, ok := dispatchQueues[notifier.Name()]
+	if !ok {
+		// Notifiers without a queue are served directly
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		sendNotification(ctx, notifier, event)
+		return
+	}
+
+	d := newDelivery(notifier, event)
+	if err := saveDelivery(d); err != nil {
+		// Still deliver, the notification is only lost if the service stops first
+		outboxFailures.inc(notifier.Name())
+		event.logger().Error("Error saving delivery to the outbox", "notifier", notifier.Name(), "error", err)
+	}
+	queue.push(d)
+}
+
+// push adds a delivery to the queue. It reports false if the reject policy
+// discarded the delivery.
+func (q *notifierQueue) push(d *delivery) bool {
+	name := q.notifier.Name()
+	switch q.overload {
+	case OverloadDropOldest:
+		for {
+			select {
+			case q.deliveries <- d:
+				return true
+			default:
+			}
+			select {
+			case dropped := <-q.deliveries:
+				queueDropped.inc(name, q.overload)
+				q.discard(dropped)
+				dropped.Event.logger().Warn("Dispatch queue full, dropping oldest notification", "notifier", name)
+			default:
+			}
+		}
+
+	case OverloadReject:
+		select {
+		case q.deliveries <- d:
+		default:
+			queueDropped.inc(name, q.overload)
+			q.discard(d)
+			d.Event.logger().Warn("Dispatch queue full, rejecting notification", "notifier", name)
+			return false
+		}
+
+	default:
+		q.deliveries <- d
+	}
+	return true
+}
+
+// discard removes a delivery dropped by the overload policy from the outbox
+func (q *notifierQueue) discard(d *delivery) {
+	if err := removeDelivery(d); err != nil {
+		d.Event.logger().Error("Error removing delivery from the outbox", "notifier", q.notifier.Name(),
+			"deliveryId", d.ID, "error", err)
+	}
+}
+
+// work delivers queued notifications, each within the queue timeout
+func (q *notifierQueue) work() {
+	for d := range q.deliveries {
+		d.Attempts++
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		err := sendNotification(ctx, q.notifier, d.Event)
+		cancel()
+		if err != nil {
+			q.fail(d, err)
+			continue
+		}
+		if err := removeDelivery(d); err != nil {
+			d.Event.logger().Error("Error removing delivery from the outbox", "notifier", q.notifier.Name(),
+				"deliveryId", d.ID, "error", err)
+		}
+	}
+}
+
+// fail schedules another attempt of a failed delivery, or moves it to the dead
+// letters once it used up its attempts
+func (q *notifierQueue) fail(d *delivery, err error) {
+	name := q.notifier.Name()
+	d.LastError = err.Error()
+
+	if d.Attempts >= q.maxAttempts {
+		q.giveUp(d, "Giving up on notification, moved to the dead letters")
+		return
+	}
+
+	wait := q.retryDelay(d.Attempts)
+	d.NextAttempt = time.Now().Add(wait)
+	if err := saveDelivery(d); err != nil {
+		outboxFailures.inc(name)
+		d.Event.logger().Error("Error saving delivery to the outbox", "notifier", name, "error", err)
+	}
+	if !q.scheduleRetry(d) {
+		// Retries are bounded like the queue, a notifier failing for long fills them
+		q.giveUp(d, "Too many notifications waiting for a retry, moved to the dead letters")
+		return
+	}
+	deliveryRetries.inc(name)
+	d.Event.logger().Warn("Retrying notification", "notifier", name, "deliveryId", d.ID,
+		"attempt", d.Attempts, "maxAttempts", q.maxAttempts, "retryIn", wait.String())
+}
+
+// giveUp moves a failed delivery to the dead letters
+func (q *notifierQueue) giveUp(d *delivery, message string) {
+	name := q.notifier.Name()
+	deadLettered.inc(name)
+	d.Event.logger().Error(message, "notifier", name, "deliveryId", d.ID, "attempts", d.Attempts)
+	if err := deadLetter(d); err != nil {
+		d.Event.logger().Error("Error moving delivery to the dead letters", "notifier", name,
+			"deliveryId", d.ID, "error", err)
+	}
+}
+
+// retryDelay returns the wait after the given number of failed attempts: the
+// backoff doubled per attempt up to the max backoff, randomized by the jitter
+func (q *notifierQueue) retryDelay(attempts int) time.Duration {
+	wait := q.backoff
+	for i := 1; i < attempts && wait < q.maxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, q.maxBackoff)
+	// Spread retries so notifications that failed together do not retry together
+	return wait + time.Duration((rand.Float64()*2-1)*q.jitter*float64(wait))
+}
+
+// scheduleRetry keeps the delivery until its next attempt. It reports false when
+// as many deliveries as fit into the queue are already waiting.
+func (q *notifierQueue) scheduleRetry(d *delivery) bool {
+	q.retryMu.Lock()
+	if len(q.retries) >= cap(q.deliveries) {
+		q.retryMu.Unlock()
+		return false
+	}
+	q.retries = append(q.retries, d)
+	q.retryMu.Unlock()
+
+	select {
+	case q.retryWake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// retrying returns the number of deliveries waiting for their next attempt
+func (q *notifierQueue) retrying() int {
+	q.retryMu.Lock()
+	defer q.retryMu.Unlock()
+	return len(q.retries)
+}
+
+// retryLoop queues the waiting deliveries once their next attempt is due. They
+// are pushed with the overload policy of the queue, like new notifications.
+func (q *notifierQueue) retryLoop() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		now := time.Now()
+		var due []*delivery
+		var next time.Time
+		q.retryMu.Lock()
+		waiting := q.retries[:0]
+		for _, d := range q.retries {
+			if !d.NextAttempt.After(now) {
+				due = append(due, d)
+				continue
+			}
+			waiting = append(waiting, d)
+			if next.IsZero() || d.NextAttempt.Before(next) {
+				next = d.NextAttempt
+			}
+		}
+		clear(q.retries[len(waiting):])
+		q.retries = waiting
+		q.retryMu.Unlock()
+
+		for _, d := range due {
+			q.push(d)
+		}
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-q.retryWake:
+			timer.Stop()
+		}
+	}
+}
+
+// requeue queues a delivery resumed from the outbox, it waits for room in the
+// queue whatever the overload policy
+func (q *notifierQueue) requeue(d *delivery) {
+	q.deliveries <- d
+}
+
+// full reports whether the queue has no room left
+func (q *notifierQueue) full() bool {
+	return len(q.deliveries) >= cap(q.deliveries)
+}
+
+// dispatchOverloaded reports whether every queue uses the reject policy and is
+// full, in which case ingest answers 503 so devices retry later. As long as one
+// notifier can take the event it is accepted, and full queues reject their own
+// notification only.
+func dispatchOverloaded() bool {
+	if len(dispatchQueues) == 0 {
+		return false
+	}
+	for _, queue := range dispatchQueues {
+		if queue.overload != OverloadReject || !queue.full() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueJitter(t *testing.T) {
+	zero, half := 0.0, 0.5
+	tests := []struct {
+		name     string
+		base     *float64
+		override *float64
+		want     float64
+	}{
+		{"default", nil, nil, 0.2},
+		{"dispatch setting", &half, nil, 0.5},
+		{"disabled", &zero, nil, 0},
+		{"disabled for one notifier", &half, &zero, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mergeQueueConfig(QueueConfig{Jitter: tt.base}, &QueueConfig{Jitter: tt.override})
+			queue, err := newNotifierQueue(&recordingNotifier{}, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if queue.jitter != tt.want {
+				t.Errorf("got jitter %v, want %v", queue.jitter, tt.want)
+			}
+		})
+	}
+
+	invalid := 1.5
+	if _, err := newNotifierQueue(&recordingNotifier{}, QueueConfig{Jitter: &invalid}); err == nil {
+		t.Error("got no error for jitter 1.5")
+	}
+}
+
+// funcNotifier is a notifier delivering through a function
+type funcNotifier struct {
+	name   string
+	notify func(ctx context.Context, event *Event) error
+}
+
+func (n *funcNotifier) Name() string { return n.name }
+func (n *funcNotifier) Type() string { return "func" }
+
+func (n *funcNotifier) Notify(ctx context.Context, event *Event) error {
+	return n.notify(ctx, event)
+}
+
+// testQueue creates a queue without workers
+func testQueue(t *testing.T, overload string, size int) *notifierQueue {
+	queue, err := newNotifierQueue(&recordingNotifier{}, QueueConfig{Size: size, Overload: overload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+// testDelivery creates a delivery of an event of the device
+func testDelivery(deviceID string) *delivery {
+	return newDelivery(&recordingNotifier{}, &Event{Vendor: "Test", EventType: "MotionDetection", DeviceID: deviceID})
+}
+
+// queuedDevices drains the queue and returns the device IDs of its deliveries
+func queuedDevices(queue *notifierQueue) []string {
+	var devices []string
+	for len(queue.deliveries) > 0 {
+		devices = append(devices, (<-queue.deliveries).Event.DeviceID)
+	}
+	return devices
+}
+
+func TestQueueOverload(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		queue := testQueue(t, OverloadBlock, 2)
+		queue.push(testDelivery("cam1"))
+		queue.push(testDelivery("cam2"))
+
+		pushed := make(chan struct{})
+		go func() {
+			queue.push(testDelivery("cam3"))
+			close(pushed)
+		}()
+		select {
+		case <-pushed:
+			t.Fatal("got push into a full queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		<-queue.deliveries
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			t.Fatal("got push still blocked with room in the queue")
+		}
+		if got := queuedDevices(queue); strings.Join(got, ",") != "cam2,cam3" {
+			t.Errorf("got queue %v", got)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		queue := testQueue(t, OverloadDropOldest, 2)
+		for _, deviceID := range []string{"cam1", "cam2", "cam3"} {
+			queue.push(testDelivery(deviceID))
+		}
+		if got := queuedDevices(queue); strings.Join(got, ",") != "cam2,cam3" {
+			t.Errorf("got queue %v, want the oldest dropped", got)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		queue := testQueue(t, OverloadReject, 2)
+		for _, deviceID := range []string{"cam1", "cam2", "cam3"} {
+			queue.push(testDelivery(deviceID))
+		}
+		if got := queuedDevices(queue); strings.Join(got, ",") != "cam1,cam2" {
+			t.Errorf("got queue %v, want the newest rejected", got)
+		}
+	})
+}
+
+func TestDispatchOverloaded(t *testing.T) {
+	previous := dispatchQueues
+	t.Cleanup(func() { dispatchQueues = previous })
+
+	fullReject := testQueue(t, OverloadReject, 1)
+	fullReject.push(testDelivery("cam1"))
+	fullBlock := testQueue(t, OverloadBlock, 1)
+	fullBlock.push(testDelivery("cam1"))
+
+	tests := []struct {
+		name       string
+		queues     map[string]*notifierQueue
+		overloaded bool
+	}{
+		{"no queues", map[string]*notifierQueue{}, false},
+		{"full reject queue", map[string]*notifierQueue{"a": fullReject}, true},
+		{"reject queue with room", map[string]*notifierQueue{"a": testQueue(t, OverloadReject, 1)}, false},
+		// A healthy notifier still takes the event
+		{"other notifier with room", map[string]*notifierQueue{"a": fullReject, "b": testQueue(t, OverloadReject, 1)}, false},
+		{"full block queue", map[string]*notifierQueue{"a": fullReject, "b": fullBlock}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatchQueues = tt.queues
+			if got := dispatchOverloaded(); got != tt.overloaded {
+				t.Errorf("got %t, want %t", got, tt.overloaded)
+			}
+		})
+	}
+
+	// Ingest answers 503 so the device retries later
+	dispatchQueues = map[string]*notifierQueue{"a": fullReject}
+	adapters, err := buildAdapters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mountAdapters(mux, adapters)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(`{"eventType": "motion"}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", rec.Code)
+	}
+}
+
+func TestQueueWorkers(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	done := make(chan string, 4)
+	notifier := &funcNotifier{name: "slow", notify: func(ctx context.Context, event *Event) error {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		done <- event.DeviceID
+		return nil
+	}}
+
+	queue, err := newNotifierQueue(notifier, QueueConfig{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		go queue.work()
+	}
+	for _, deviceID := range []string{"cam1", "cam2", "cam3", "cam4"} {
+		queue.push(testDelivery(deviceID))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("got %d of 4 deliveries", i)
+		}
+	}
+	if maxRunning != 2 {
+		t.Errorf("got %d concurrent deliveries, want 2", maxRunning)
+	}
+}
+
+func TestQueueRetries(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	sent := make(chan string, 4)
+	// cam1 succeeds on its third attempt, cam2 never
+	notifier := &funcNotifier{name: "flaky", notify: func(ctx context.Context, event *Event) error {
+		mu.Lock()
+		attempts[event.DeviceID]++
+		n := attempts[event.DeviceID]
+		mu.Unlock()
+		if event.DeviceID == "cam1" && n == 3 {
+			sent <- event.DeviceID
+			return nil
+		}
+		return fmt.Errorf("attempt %d failed", n)
+	}}
+
+	zero := 0.0
+	queue, err := newNotifierQueue(notifier, QueueConfig{Size: 2, MaxAttempts: 3, Backoff: "10ms", Jitter: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go queue.work()
+	go queue.retryLoop()
+	queue.push(testDelivery("cam1"))
+	queue.push(testDelivery("cam2"))
+
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("got no successful retry")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		cam2 := attempts["cam2"]
+		mu.Unlock()
+		if cam2 == 3 && queue.retrying() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d attempts for cam2 and %d retrying, want 3 attempts and none left", cam2, queue.retrying())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The retries are bounded by the queue size
+	later := time.Now().Add(time.Hour)
+	for i, deviceID := range []string{"cam3", "cam4", "cam5"} {
+		d := testDelivery(deviceID)
+		d.NextAttempt = later
+		if scheduled := queue.scheduleRetry(d); scheduled != (i < 2) {
+			t.Errorf("%s: got scheduled %t", deviceID, scheduled)
+		}
+	}
+}
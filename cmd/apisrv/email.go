@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerNotifier("email", newEmailNotifier)
+}
+
+// emailNotifier sends events as plain text emails over SMTP, with attachments as MIME parts
+type emailNotifier struct {
+	cfg NotifierConfig
+}
+
+// newEmailNotifier creates an email notifier
+func newEmailNotifier(cfg NotifierConfig) (Notifier, error) {
+	if cfg.SMTPHost == "" || cfg.EmailFrom == "" || len(cfg.EmailTo) == 0 {
+		return nil, fmt.Errorf("email notifier requires smtp_host, email_from and email_to")
+	}
+	if cfg.SMTPPort == 0 {
+		cfg.SMTPPort = 587
+	}
+	return &emailNotifier{cfg: cfg}, nil
+}
+
+func (n *emailNotifier) Name() string { return n.cfg.Name }
+
+func (n *emailNotifier) Type() string { return "email" }
+
+// Notify sends the event to all configured recipients
+func (n *emailNotifier) Notify(ctx context.Context, event *Event) error {
+	var msg strings.Builder
+	msg.WriteString(fmt.Sprintf("From: %s\r\n", n.cfg.EmailFrom))
+	msg.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(n.cfg.EmailTo, ", ")))
+	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", emailSubject(event)))
+	msg.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	if len(event.Attachments) == 0 {
+		msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		msg.WriteString("\r\n")
+		msg.WriteString(emailBody(event))
+	} else {
+		writeMultipartEmail(&msg, event)
+	}
+
+	var auth smtp.Auth
+	if n.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", n.cfg.SMTPUsername, n.cfg.SMTPPassword, n.cfg.SMTPHost)
+	}
+
+	addr := fmt.Sprintf("%s:%d", n.cfg.SMTPHost, n.cfg.SMTPPort)
+	return sendMail(ctx, addr, auth, n.cfg.EmailFrom, n.cfg.EmailTo, []byte(msg.String()))
+}
+
+// emailSubject returns the encoded Subject header value for the event
+func emailSubject(event *Event) string {
+	subject := fmt.Sprintf("[%s] %s on %s/%s", event.Vendor, event.EventType, event.DeviceID, event.ChannelID)
+	if event.Device != nil && event.Device.Camera != "" {
+		subject = fmt.Sprintf("[%s] %s on %s", event.Vendor, event.EventType, event.Device.Camera)
+	}
+	if event.Incident != nil && event.Incident.Phase == IncidentEnded {
+		subject += " ended"
+	}
+
+	// Device IDs come from payloads, line breaks would inject headers
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	return mime.QEncoding.Encode("utf-8", subject)
+}
+
+// sendMail works like smtp.SendMail but gives up when ctx is done
+func sendMail(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server doesn't support AUTH")
+		}
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(msg); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// emailBody returns the rule template message, or the plain text description
+func emailBody(event *Event) string {
+	if event.Message != "" {
+		return event.Message
+	}
+	return formatPlainMessage(event)
+}
+
+// formatPlainMessage creates a plain text description of the event
+func formatPlainMessage(event *Event) string {
+	var msg strings.Builder
+	msg.WriteString(fmt.Sprintf("Vendor:   %s\r\n", event.Vendor))
+	msg.WriteString(fmt.Sprintf("Event:    %s\r\n", event.EventType))
+	msg.WriteString(fmt.Sprintf("State:    %s\r\n", event.State))
+	msg.WriteString(fmt.Sprintf("Severity: %s\r\n", event.Severity))
+	msg.WriteString(fmt.Sprintf("Time:     %s\r\n", event.EventTime.Format("2006-01-02 15:04:05")))
+	msg.WriteString(fmt.Sprintf("Device:   %s\r\n", event.DeviceID))
+	msg.WriteString(fmt.Sprintf("Channel:  %s\r\n", event.ChannelID))
+	if device := event.Device; device != nil {
+		msg.WriteString(fmt.Sprintf("Name:     %s\r\n", device.Name))
+		if device.Camera != "" {
+			msg.WriteString(fmt.Sprintf("Camera:   %s\r\n", device.Camera))
+		}
+		if device.Site != "" {
+			msg.WriteString(fmt.Sprintf("Site:     %s\r\n", device.Site))
+		}
+		if device.Location != "" {
+			msg.WriteString(fmt.Sprintf("Location: %s\r\n", device.Location))
+		}
+		if len(device.Tags) > 0 {
+			msg.WriteString(fmt.Sprintf("Tags:     %s\r\n", strings.Join(device.Tags, ", ")))
+		}
+	}
+	if event.Suppressed > 0 {
+		msg.WriteString(fmt.Sprintf("Note:     +%d similar events suppressed\r\n", event.Suppressed))
+	}
+	if event.Incident != nil {
+		msg.WriteString(fmt.Sprintf("Incident: %s %s", event.Incident.ID, event.Incident.Phase))
+		if event.Incident.Phase == IncidentEnded {
+			msg.WriteString(fmt.Sprintf(" after %s (%d events)", event.Incident.Duration, event.Incident.EventCount))
+		}
+		msg.WriteString("\r\n")
+	}
+
+	// Add the event details in a stable order
+	keys := make([]string, 0, len(event.EventDetails))
+	for key := range event.EventDetails {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		msg.WriteString("\r\nDetails:\r\n")
+		for _, key := range keys {
+			msg.WriteString(fmt.Sprintf("  %s: %v\r\n", key, event.EventDetails[key]))
+		}
+	}
+
+	return msg.String()
+}
+
+// writeMultipartEmail writes a multipart/mixed body with the text and all attachments
+func writeMultipartEmail(msg *strings.Builder, event *Event) {
+	writer := multipart.NewWriter(msg)
+	msg.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n", writer.Boundary()))
+	msg.WriteString("\r\n")
+
+	text, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=UTF-8"},
+	})
+	text.Write([]byte(emailBody(event)))
+
+	for i, attachment := range event.Attachments {
+		name := attachment.Name
+		if name == "" {
+			name = fmt.Sprintf("attachment%d", i+1)
+		}
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		})
+
+		// Wrap base64 lines at 76 characters as required by RFC 2045
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	writer.Close()
+}
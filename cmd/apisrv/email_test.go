@@ -0,0 +1,47 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestEmailSubject(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{
+			name:  "plain",
+			event: Event{Vendor: "Vivotek", EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1"},
+			want:  "[Vivotek] MotionDetection on cam1/Channel1",
+		},
+		{
+			name: "camera name",
+			event: Event{Vendor: "HIKVision", EventType: "VideoLoss", Device: &DeviceInfo{Camera: "Einfahrt Süd"},
+				Incident: &Incident{Phase: IncidentEnded}},
+			want: "[HIKVision] VideoLoss on Einfahrt Süd ended",
+		},
+		{
+			name:  "header injection",
+			event: Event{Vendor: "Vivotek", EventType: "MotionDetection", DeviceID: "cam1\r\nBcc: victim@example.com", ChannelID: "Channel1"},
+			want:  "[Vivotek] MotionDetection on cam1  Bcc: victim@example.com/Channel1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject := emailSubject(&tt.event)
+			if strings.ContainsAny(subject, "\r\n") {
+				t.Fatalf("got line break in %q", subject)
+			}
+			decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded != tt.want {
+				t.Errorf("got %q, want %q", decoded, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Vendor names used in Event.Vendor
+const (
+	VendorVivotek   = "Vivotek"
+	VendorHikVision = "HIKVision"
+)
+
+// Event states used in Event.State
+const (
+	EventStateActive   = "active"
+	EventStateInactive = "inactive"
+)
+
+// Event severities used in Event.Severity
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Event is the normalized event produced by every vendor handler.
+// Routing, forwarding and formatting only ever work with this type.
+type Event struct {
+	Vendor       string                 `json:"vendor"`
+	EventType    string                 `json:"eventType"`
+	EventTime    time.Time              `json:"eventTime"`
+	ReceivedAt   time.Time              `json:"receivedAt"`
+	DeviceID     string                 `json:"deviceId"`
+	ChannelID    string                 `json:"channelId"`
+	State        string                 `json:"state"`
+	Severity     string                 `json:"severity"`
+	EventDetails map[string]interface{} `json:"eventDetails"`
+	// Device holds the inventory data of the device and channel, if registered
+	Device *DeviceInfo `json:"device,omitempty"`
+	// Attachments holds images sent along with the event, e.g. detection snapshots
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Incident is set when the event starts or ends an incident
+	Incident *Incident `json:"incident,omitempty"`
+	// Suppressed counts the similar events held back by the cooldown since the last alert
+	Suppressed int `json:"suppressed,omitempty"`
+	// Message is the text rendered by the template of the routing rule, if any
+	Message string `json:"message,omitempty"`
+	// SilencedBy lists the IDs of the silences that muted the event
+	SilencedBy []string `json:"silencedBy,omitempty"`
+	// CorrelationID is set at ingest and identifies the event in every log line
+	CorrelationID string `json:"correlationId,omitempty"`
+	// Raw payload as received from the device, kept for debugging/logging
+	Raw string `json:"-"`
+}
+
+// Attachment is a file, usually a JPEG snapshot, carried with an event.
+// The data itself is not serialized; notifiers decide how to deliver it.
+type Attachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	Data        []byte `json:"-"`
+}
+
+// images returns the attachments with an image content type
+func (e *Event) images() []Attachment {
+	var images []Attachment
+	for _, attachment := range e.Attachments {
+		if strings.HasPrefix(attachment.ContentType, "image/") {
+			images = append(images, attachment)
+		}
+	}
+	return images
+}
+
+// eventSeverity returns the default severity for a standardized event type
+func eventSeverity(eventType string) string {
+	switch eventType {
+	case "VideoLoss", "TamperDetection", "StorageFailure", "IntrusionDetection", "IllegalAccess", "NetworkFailure":
+		return SeverityCritical
+	case "MotionDetection", "LineCrossing", "FaceDetection", "IOAlarm", "DeviceConnection":
+		return SeverityWarning
+	default:
+		return SeverityInfo
+	}
+}
+
+// normalizeEvent fills in defaults for fields a vendor handler left empty
+func normalizeEvent(event *Event) {
+	if event.ReceivedAt.IsZero() {
+		event.ReceivedAt = time.Now()
+	}
+	if event.EventTime.IsZero() {
+		event.EventTime = event.ReceivedAt
+	}
+	if event.State == "" {
+		event.State = EventStateActive
+	}
+	if event.Severity == "" {
+		event.Severity = eventSeverity(event.EventType)
+	}
+	if event.EventDetails == nil {
+		event.EventDetails = map[string]interface{}{}
+	}
+}
+
+// logger returns a logger carrying the correlation ID and the identity of the event
+func (e *Event) logger() *slog.Logger {
+	return state.Logger.With("correlationId", e.CorrelationID, "vendor", e.Vendor,
+		"eventType", e.EventType, "deviceId", e.DeviceID, "channelId", e.ChannelID)
+}
+
+// newCorrelationID returns a random UUID identifying one event
+func newCorrelationID() string {
+	id, err := newUUID()
+	if err != nil {
+		// Still unique enough to trace the event within this process
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return id
+}
+
+// processEvent handles different event types
+func processEvent(event *Event) {
+	normalizeEvent(event)
+	enrichEvent(event)
+	recordSeen(event)
+
+	// Repeated actives and unmatched inactives are not passed on
+	if trackIncident(event) {
+		incidentNotified(event, dispatchEvent(event))
+	}
+
+	// Every event is recorded, including those not passed on or silenced
+	storeEvent(event)
+}
+
+// dispatchEvent runs the handler for the event type and queues the event for the
+// notifiers. It reports whether silences, arming and cooldowns let the event through.
+func dispatchEvent(event *Event) bool {
+	// Process based on event type
+	switch event.EventType {
+	case "MotionDetection":
+		handleMotionEvent(event)
+	case "VideoLoss":
+		handleVideoLossEvent(event)
+	case "LineCrossing", "IntrusionDetection", "LicensePlateRecognition":
+		handleSmartEvent(event)
+	case "IOAlarm":
+		handleIOAlarmEvent(event)
+	case "DeviceConnection":
+		handleConnectionEvent(event)
+	default:
+		event.logger().Info("Unhandled event type")
+	}
+
+	// Silenced events are recorded with the silence IDs but not sent
+	if checkSilences(event) {
+		eventsSilenced.inc(event.EventType)
+		event.logger().Info("Not notifying: silenced", "silencedBy", event.SilencedBy)
+		return false
+	}
+
+	// Events of disarmed sites are only logged
+	if armed, reason := isArmed(event); !armed {
+		eventsDisarmed.inc(event.EventType)
+		event.logger().Info("Not notifying: disarmed", "reason", reason)
+		return false
+	}
+
+	// Route to the notifiers unless the cooldown holds it back
+	if !checkCooldown(event) {
+		eventsSuppressed.inc(event.EventType)
+		return false
+	}
+	routeEvent(event)
+	return true
+}
+
+// handleMotionEvent processes motion detection events
+func handleMotionEvent(event *Event) {
+	event.logger().Info("Motion detected")
+	// Add custom processing for motion events
+}
+
+// handleVideoLossEvent processes video loss events
+func handleVideoLossEvent(event *Event) {
+	event.logger().Info("Video lost")
+	// Add custom processing for video loss events
+}
+
+// handleSmartEvent processes smart events (line crossing, intrusion, plate recognition)
+func handleSmartEvent(event *Event) {
+	event.logger().Info("Smart event")
+	// Add custom processing for smart events
+}
+
+// handleIOAlarmEvent processes IO alarm events
+func handleIOAlarmEvent(event *Event) {
+	event.logger().Info("IO alarm")
+	// Add custom processing for IO events
+}
+
+// handleConnectionEvent processes device connection/disconnection events
+func handleConnectionEvent(event *Event) {
+	event.logger().Info("Connection event")
+	// Add custom processing for connection events
+}
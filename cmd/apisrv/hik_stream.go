@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HikDeviceConfig configures one HIKVision device read through the ISAPI alertStream
+type HikDeviceConfig struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// URL is the device base URL, e.g. http://192.168.1.64
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// DeviceID used for events, defaults to HIK_<mac> from deviceInfo
+	DeviceID string `json:"device_id,omitempty"`
+	// IdleTimeout drops the stream when nothing, not even a heartbeat, arrives; defaults to 60s
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+}
+
+// hikDeviceInfo is the subset of /ISAPI/System/deviceInfo we use
+type hikDeviceInfo struct {
+	XMLName      xml.Name `xml:"DeviceInfo"`
+	DeviceName   string   `xml:"deviceName"`
+	DeviceID     string   `xml:"deviceID"`
+	Model        string   `xml:"model"`
+	SerialNumber string   `xml:"serialNumber"`
+	MacAddress   string   `xml:"macAddress"`
+}
+
+// hikStreamClient keeps an alertStream connection open and feeds its alerts into the event pipeline
+type hikStreamClient struct {
+	cfg         HikDeviceConfig
+	baseURL     *url.URL
+	deviceID    string
+	httpClient  *http.Client
+	idleTimeout time.Duration
+	// backoff is the first wait before reconnecting, doubled up to 2 minutes
+	backoff time.Duration
+	// resolved is set once deviceID comes from the configuration, deviceInfo or an alert
+	// rather than the host fallback
+	resolved bool
+	// connected is set once the stream was open, a device never reached is not reported offline
+	connected bool
+	// offlineReported is set once a drop was reported, until the stream reconnects
+	offlineReported bool
+}
+
+// startHikStreamClients starts a background alertStream client for every enabled device
+func startHikStreamClients(ctx context.Context, configs []HikDeviceConfig) error {
+	for _, cfg := range configs {
+		if !cfg.Enabled {
+			continue
+		}
+
+		client, err := newHikStreamClient(cfg)
+		if err != nil {
+			return fmt.Errorf("error creating HIKVision stream client %q: %v", cfg.Name, err)
+		}
+
+		state.Logger.Info("Starting HIKVision alertStream client", "client", cfg.Name, "url", cfg.URL)
+		go client.run(ctx)
+	}
+	return nil
+}
+
+// newHikStreamClient validates the device configuration and creates its client
+func newHikStreamClient(cfg HikDeviceConfig) (*hikStreamClient, error) {
+	baseURL, err := url.Parse(strings.TrimRight(cfg.URL, "/"))
+	if err != nil || baseURL.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", cfg.URL)
+	}
+
+	idleTimeout, err := parseDurationDefault(cfg.IdleTimeout, 60*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid idle_timeout: %v", err)
+	}
+
+	// No overall timeout, the stream stays open; idleTimeout detects dead streams
+	transport := &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		ResponseHeaderTimeout: 15 * time.Second,
+	}
+
+	return &hikStreamClient{
+		cfg:         cfg,
+		baseURL:     baseURL,
+		deviceID:    cfg.DeviceID,
+		httpClient:  &http.Client{Transport: transport},
+		idleTimeout: idleTimeout,
+		backoff:     time.Second,
+		resolved:    cfg.DeviceID != "",
+	}, nil
+}
+
+// run connects and reads until the context ends, reconnecting with backoff when the stream drops
+func (c *hikStreamClient) run(ctx context.Context) {
+	backoff := c.backoff
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := c.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.reportOffline(err)
+
+		// A stream that stayed up for a while was healthy, start over with a short backoff
+		if time.Since(started) > time.Minute {
+			backoff = c.backoff
+		}
+		state.Logger.Warn("HIKVision alertStream failed, reconnecting", "client", c.cfg.Name, "error", err,
+			"backoff", backoff.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > 2*time.Minute {
+			backoff = 2 * time.Minute
+		}
+	}
+}
+
+// stream opens the alertStream and processes alerts until it drops
+func (c *hikStreamClient) stream(ctx context.Context) error {
+	// Retried on every connect until the device answers with its MAC address
+	if !c.resolved {
+		c.resolveDeviceID(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := c.get(ctx, "/ISAPI/Event/notification/alertStream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("alertStream returned status %d", resp.StatusCode)
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return fmt.Errorf("alertStream is not a multipart stream: %q", resp.Header.Get("Content-Type"))
+	}
+
+	c.reportOnline()
+
+	// Cancel the request when the device stops sending, including heartbeats
+	var idleExpired atomic.Bool
+	idle := time.AfterFunc(c.idleTimeout, func() {
+		idleExpired.Store(true)
+		cancel()
+	})
+	defer idle.Stop()
+
+	// streamError explains why reading stopped
+	streamError := func(err error) error {
+		if idleExpired.Load() {
+			return fmt.Errorf("no data for %s", c.idleTimeout)
+		}
+		if err == io.EOF {
+			return fmt.Errorf("stream closed by device")
+		}
+		return err
+	}
+
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return streamError(err)
+		}
+
+		body, err := io.ReadAll(part)
+		if err != nil {
+			return streamError(err)
+		}
+		idle.Reset(c.idleTimeout)
+
+		c.handlePart(part.Header.Get("Content-Type"), body)
+	}
+}
+
+// handlePart converts one alertStream document into an event
+func (c *hikStreamClient) handlePart(contentType string, body []byte) {
+	if !isHikAlertPart(contentType, body) {
+		return
+	}
+
+	hikAlarm, err := parseHikAlert(contentType, body)
+	if err != nil {
+		parseFailures.inc(c.cfg.Name)
+		state.Logger.Error("Error parsing HIKVision alertStream alert", "client", c.cfg.Name, "error", err,
+			"payload", truncatePayload(body))
+		return
+	}
+
+	event := convertHikVisionAlarm(hikAlarm, string(body))
+	if !c.resolved && hikAlarm.MacAddress != "" {
+		// The alert carries the MAC address deviceInfo did not give
+		c.deviceID = event.DeviceID
+		c.resolved = true
+	}
+	if c.deviceID != "" {
+		event.DeviceID = c.deviceID
+	}
+	setEventIP(&event, c.baseURL.Hostname())
+
+	// The device sends an inactive videoloss alert every few seconds as heartbeat,
+	// it only tells the watchdog that the device is alive
+	if strings.EqualFold(hikAlarm.EventType, "videoloss") && strings.EqualFold(hikAlarm.EventState, EventStateInactive) {
+		recordHeartbeat(&event)
+		return
+	}
+	ingestEvent(VendorHikVision, &event)
+}
+
+// get sends a digest authenticated GET request to the device
+func (c *hikStreamClient) get(ctx context.Context, path string) (*http.Response, error) {
+	target := c.baseURL.String() + path
+	return doDigestRequest(c.httpClient, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	}, c.cfg.Username, c.cfg.Password)
+}
+
+// resolveDeviceID derives the device ID from deviceInfo, matching convertHikVisionAlarm
+func (c *hikStreamClient) resolveDeviceID(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	info, err := c.deviceInfo(ctx)
+	if err != nil || info.MacAddress == "" {
+		if c.deviceID == "" {
+			c.deviceID = fmt.Sprintf("HIK_%s", c.baseURL.Hostname())
+		}
+		if err != nil {
+			state.Logger.Warn("HIKVision alertStream deviceInfo failed", "client", c.cfg.Name, "deviceId", c.deviceID,
+				"error", err)
+		}
+		return
+	}
+	c.deviceID = fmt.Sprintf("HIK_%s", strings.ReplaceAll(info.MacAddress, ":", ""))
+	c.resolved = true
+}
+
+// deviceInfo reads /ISAPI/System/deviceInfo
+func (c *hikStreamClient) deviceInfo(ctx context.Context) (hikDeviceInfo, error) {
+	var info hikDeviceInfo
+
+	resp, err := c.get(ctx, "/ISAPI/System/deviceInfo")
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("deviceInfo returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return info, err
+	}
+	if err := xml.Unmarshal(body, &info); err != nil {
+		return info, fmt.Errorf("error parsing deviceInfo XML: %v", err)
+	}
+	return info, nil
+}
+
+// reportOnline emits a connected event when the device comes back after being reported offline
+func (c *hikStreamClient) reportOnline() {
+	state.Logger.Info("HIKVision alertStream connected", "client", c.cfg.Name, "deviceId", c.deviceID)
+	c.connected = true
+	if !c.offlineReported {
+		return
+	}
+	c.offlineReported = false
+	c.reportConnection(EventStateActive, "connected", "alertStream reconnected")
+}
+
+// reportOffline emits a disconnected event once per outage of a device that was online
+func (c *hikStreamClient) reportOffline(err error) {
+	if !c.connected || c.offlineReported {
+		return
+	}
+	c.offlineReported = true
+	c.reportConnection(EventStateInactive, "disconnected", err.Error())
+}
+
+// reportConnection sends a synthetic DeviceConnection event through the pipeline
+func (c *hikStreamClient) reportConnection(eventState, status, reason string) {
+	deviceID := c.deviceID
+	if deviceID == "" {
+		deviceID = fmt.Sprintf("HIK_%s", c.baseURL.Hostname())
+	}
+
+	event := Event{
+		Vendor:    VendorHikVision,
+		EventType: "DeviceConnection",
+		DeviceID:  deviceID,
+		State:     eventState,
+		EventDetails: map[string]interface{}{
+			"source":      VendorHikVision,
+			"status":      status,
+			"description": reason,
+			"ipAddress":   c.baseURL.Hostname(),
+			"name":        c.cfg.Name,
+		},
+	}
+	ingestEvent(VendorHikVision, &event)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const hikHeartbeatXML = `<?xml version="1.0" encoding="UTF-8"?>
+<EventNotificationAlert version="2.0" xmlns="http://www.hikvision.com/ver20/XMLSchema">
+<ipAddress>192.168.1.64</ipAddress>
+<macAddress>00:11:22:33:44:55</macAddress>
+<channelID>1</channelID>
+<dateTime>2026-03-01T08:00:00+01:00</dateTime>
+<activePostCount>0</activePostCount>
+<eventType>videoloss</eventType>
+<eventState>inactive</eventState>
+<eventDescription>videoloss alarm</eventDescription>
+</EventNotificationAlert>`
+
+const hikDeviceInfoXML = `<?xml version="1.0" encoding="UTF-8"?>
+<DeviceInfo version="2.0" xmlns="http://www.hikvision.com/ver20/XMLSchema">
+<deviceName>Gate</deviceName>
+<deviceID>48a0f2c3-1234</deviceID>
+<model>DS-2CD2143G2-I</model>
+<serialNumber>DS-2CD2143G2-I20260101AAWRJ00000000</serialNumber>
+<macAddress>aa:bb:cc:dd:ee:ff</macAddress>
+</DeviceInfo>`
+
+// hikStreamDevice is a HIKVision stand-in answering deviceInfo and alertStream.
+// Every alertStream connection takes the next entry of streams, nil fails the connection.
+type hikStreamDevice struct {
+	mu          sync.Mutex
+	deviceInfo  []bool
+	streams     [][]string
+	connections int
+}
+
+func (d *hikStreamDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/ISAPI/System/deviceInfo":
+		ok := len(d.deviceInfo) > 0 && d.deviceInfo[0]
+		if len(d.deviceInfo) > 1 {
+			d.deviceInfo = d.deviceInfo[1:]
+		}
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(hikDeviceInfoXML))
+
+	case "/ISAPI/Event/notification/alertStream":
+		d.connections++
+		if len(d.streams) == 0 || d.streams[0] == nil {
+			if len(d.streams) > 0 {
+				d.streams = d.streams[1:]
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		parts := d.streams[0]
+		d.streams = d.streams[1:]
+
+		writer := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+		for _, body := range parts {
+			contentType := "application/xml; charset=\"UTF-8\""
+			if !strings.HasPrefix(body, "<") {
+				contentType = "image/jpeg"
+			}
+			part, err := writer.CreatePart(map[string][]string{"Content-Type": {contentType}})
+			if err != nil {
+				return
+			}
+			part.Write([]byte(body))
+		}
+		// Closing the response without the final boundary, as a dropped stream does.
+		// The last part is cut off with it.
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// alertStreamConnections returns the number of alertStream requests served
+func (d *hikStreamDevice) alertStreamConnections() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.connections
+}
+
+// newTestHikStreamClient creates a client of the stand-in with a short reconnect backoff
+func newTestHikStreamClient(t *testing.T, device *hikStreamDevice, deviceID string) *hikStreamClient {
+	server := httptest.NewServer(device)
+	t.Cleanup(server.Close)
+	client, err := newHikStreamClient(HikDeviceConfig{Name: "gate", Enabled: true, URL: server.URL, DeviceID: deviceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.backoff = 10 * time.Millisecond
+	return client
+}
+
+func TestHikStreamParts(t *testing.T) {
+	tests := []struct {
+		name       string
+		deviceInfo bool
+		deviceID   string
+		want       string
+	}{
+		{"device ID from deviceInfo", true, "", "HIK_aabbccddeeff"},
+		{"device ID from the alert", false, "", "HIK_001122334455"},
+		{"configured device ID", true, "gate", "gate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := useRecordingNotifier(t)
+			device := &hikStreamDevice{
+				deviceInfo: []bool{tt.deviceInfo},
+				streams:    [][]string{{hikHeartbeatXML, hikMotionXML, "\xff\xd8jpeg", "not an alert"}},
+			}
+			client := newTestHikStreamClient(t, device, tt.deviceID)
+
+			err := client.stream(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "closed") && !strings.Contains(err.Error(), "EOF") {
+				t.Errorf("got error %v, want the stream dropped", err)
+			}
+
+			// The heartbeat only reaches the watchdog, the image and text parts are skipped
+			events := notifier.received()
+			if len(events) != 1 || events[0].EventType != "MotionDetection" {
+				t.Fatalf("got %d events, want the motion event only", len(events))
+			}
+			if events[0].DeviceID != tt.want || events[0].ChannelID != "Channel1" {
+				t.Errorf("got device %s channel %s, want %s", events[0].DeviceID, events[0].ChannelID, tt.want)
+			}
+		})
+	}
+}
+
+func TestHikStreamReconnect(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	// The first connect fails, deviceInfo fails until the third connect
+	heartbeat := strings.ReplaceAll(hikHeartbeatXML, "<macAddress>00:11:22:33:44:55</macAddress>\n", "")
+	device := &hikStreamDevice{
+		deviceInfo: []bool{false, false, true},
+		streams:    [][]string{nil, {heartbeat, heartbeat}, {hikMotionXML, heartbeat}},
+	}
+	client := newTestHikStreamClient(t, device, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for device.alertStreamConnections() < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	var got []string
+	for _, event := range notifier.received() {
+		got = append(got, fmt.Sprintf("%s:%s:%s", event.EventType, event.State, event.DeviceID))
+	}
+	// No offline event for the failed first connect, the device was never online.
+	// The events use the deviceInfo ID as soon as deviceInfo answers.
+	want := []string{
+		"DeviceConnection:inactive:HIK_127.0.0.1",
+		"DeviceConnection:active:HIK_aabbccddeeff",
+		"MotionDetection:active:HIK_aabbccddeeff",
+		"DeviceConnection:inactive:HIK_aabbccddeeff",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HIKVisionAlarm represents a HIKVision alarm event, sent as XML or, by newer
+// ISAPI firmware, as JSON
+type HIKVisionAlarm struct {
+	XMLName      xml.Name `xml:"EventNotificationAlert" json:"-"`
+	IPAddress    string   `xml:"ipAddress" json:"ipAddress"`
+	PortNo       int      `xml:"portNo" json:"portNo"`
+	ProtocolType string   `xml:"protocolType" json:"protocolType,omitempty"`
+	// Protocol replaces protocolType in ISAPI 2.0 alerts
+	Protocol         string `xml:"protocol" json:"protocol,omitempty"`
+	MacAddress       string `xml:"macAddress" json:"macAddress"`
+	ChannelID        int    `xml:"channelID" json:"channelID"`
+	ChannelName      string `xml:"channelName,omitempty" json:"channelName,omitempty"`
+	DateTime         string `xml:"dateTime" json:"dateTime"`
+	ActivePostCount  int    `xml:"activePostCount" json:"activePostCount"`
+	EventType        string `xml:"eventType" json:"eventType"`
+	EventState       string `xml:"eventState" json:"eventState"`
+	EventDescription string `xml:"eventDescription" json:"eventDescription"`
+	// Optional fields that may be present in some events
+	DetectionRegionID int `xml:"detectionRegionID,omitempty" json:"detectionRegionID,omitempty"`
+	// TargetType is set by smart and AcuSense events, e.g. "human" or "vehicle"
+	TargetType          string               `xml:"targetType,omitempty" json:"targetType,omitempty"`
+	TargetRect          *HIKTargetRect       `xml:"TargetRect,omitempty" json:"TargetRect,omitempty"`
+	DetectionRegionList []HIKDetectionRegion `xml:"DetectionRegionList>DetectionRegionEntry,omitempty" json:"DetectionRegionList,omitempty"`
+	Extensions          *HIKExtensions       `xml:"Extensions,omitempty" json:"Extensions,omitempty"`
+}
+
+// HIKTargetRect is the bounding box of the detected target, normalized to the image size
+type HIKTargetRect struct {
+	X      float64 `xml:"X" json:"X"`
+	Y      float64 `xml:"Y" json:"Y"`
+	Width  float64 `xml:"width" json:"width"`
+	Height float64 `xml:"height" json:"height"`
+}
+
+// HIKCoordinate is one point of a detection region or line
+type HIKCoordinate struct {
+	PositionX float64 `xml:"positionX" json:"positionX"`
+	PositionY float64 `xml:"positionY" json:"positionY"`
+}
+
+// HIKDetectionRegion is one region or line of a smart event that triggered the alarm
+type HIKDetectionRegion struct {
+	// RegionID is a number or a numeric string depending on the firmware
+	RegionID         json.Number `xml:"regionID" json:"regionID"`
+	SensitivityLevel int         `xml:"sensitivityLevel,omitempty" json:"sensitivityLevel,omitempty"`
+	// RegionCoordinatesList holds the polygon of a region, or the two end points of a line
+	RegionCoordinatesList []HIKCoordinate `xml:"RegionCoordinatesList>RegionCoordinates,omitempty" json:"RegionCoordinatesList,omitempty"`
+	TargetType            string          `xml:"targetType,omitempty" json:"targetType,omitempty"`
+	// DetectionTarget is the name older firmware uses for targetType
+	DetectionTarget string         `xml:"detectionTarget,omitempty" json:"detectionTarget,omitempty"`
+	TargetRect      *HIKTargetRect `xml:"TargetRect,omitempty" json:"TargetRect,omitempty"`
+	// Direction of a crossing line, e.g. "left-right" or "any"
+	Direction string `xml:"direction,omitempty" json:"direction,omitempty"`
+}
+
+// HIKExtensions holds the vendor extensions of an alert
+type HIKExtensions struct {
+	SerialNo  int    `xml:"serialNo,omitempty" json:"serialNo,omitempty"`
+	EventPush string `xml:"eventPush,omitempty" json:"eventPush,omitempty"`
+}
+
+func init() {
+	registerAdapter("hikvision", newHikVisionAdapter)
+}
+
+// hikVisionAdapter receives alarm server notifications from HIKVision devices
+type hikVisionAdapter struct {
+	cfg AdapterConfig
+}
+
+// newHikVisionAdapter creates the HIKVision ingest adapter
+func newHikVisionAdapter(cfg AdapterConfig) (IngestAdapter, error) {
+	// Fall back to the legacy HIK credentials from the top level config
+	if cfg.Username == "" && state.Config.HikEnabled {
+		cfg.Username = state.Config.HikUsername
+		cfg.Password = state.Config.HikPassword
+	}
+	return &hikVisionAdapter{cfg: cfg}, nil
+}
+
+func (a *hikVisionAdapter) Name() string { return VendorHikVision }
+
+func (a *hikVisionAdapter) Routes() []string {
+	return adapterRoutes(a.cfg, "/hikvision/alarm")
+}
+
+func (a *hikVisionAdapter) Methods() []string {
+	return []string{http.MethodPost, http.MethodGet}
+}
+
+func (a *hikVisionAdapter) Authenticate(r *http.Request) bool {
+	return checkAdapterAuth(r, a.cfg.Username, a.cfg.Password)
+}
+
+// Parse decodes a HIKVision EventNotificationAlert XML or JSON document, or a
+// multipart/form-data post carrying the alert and its snapshots
+func (a *hikVisionAdapter) Parse(r *http.Request, body []byte) ([]Event, error) {
+	contentType := r.Header.Get("Content-Type")
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		event, err := parseHikMultipart(body, params["boundary"])
+		if err != nil {
+			return nil, err
+		}
+		return []Event{event}, nil
+	}
+
+	hikAlarm, err := parseHikAlert(contentType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Event{convertHikVisionAlarm(hikAlarm, string(body))}, nil
+}
+
+// isHikJSON reports whether an alert document is JSON rather than XML
+func isHikJSON(contentType string, body []byte) bool {
+	if strings.Contains(contentType, "json") {
+		return true
+	}
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// parseHikAlert decodes a single EventNotificationAlert document in XML or JSON
+func parseHikAlert(contentType string, body []byte) (HIKVisionAlarm, error) {
+	var hikAlarm HIKVisionAlarm
+	if !isHikJSON(contentType, body) {
+		if err := xml.Unmarshal(body, &hikAlarm); err != nil {
+			return hikAlarm, fmt.Errorf("error parsing HIKVision XML: %v", err)
+		}
+		return hikAlarm, nil
+	}
+
+	if err := json.Unmarshal(body, &hikAlarm); err != nil {
+		return hikAlarm, fmt.Errorf("error parsing HIKVision JSON: %v", err)
+	}
+
+	// Some firmware wraps the alert in an EventNotificationAlert object
+	if hikAlarm.EventType == "" {
+		var wrapped struct {
+			EventNotificationAlert HIKVisionAlarm `json:"EventNotificationAlert"`
+		}
+		if err := json.Unmarshal(body, &wrapped); err == nil && wrapped.EventNotificationAlert.EventType != "" {
+			hikAlarm = wrapped.EventNotificationAlert
+		}
+	}
+	return hikAlarm, nil
+}
+
+// isHikAlertPart reports whether a multipart part holds the alert document
+func isHikAlertPart(contentType string, body []byte) bool {
+	if strings.Contains(contentType, "xml") || strings.Contains(contentType, "json") {
+		return true
+	}
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && (trimmed[0] == '<' || trimmed[0] == '{')
+}
+
+// parseHikMultipart extracts the alert and the attached images of a multipart post.
+// Newer firmware sends the alert in one part and snapshots such as detectionPicture
+// in the others.
+func parseHikMultipart(body []byte, boundary string) (Event, error) {
+	if boundary == "" {
+		return Event{}, fmt.Errorf("multipart HIKVision post without boundary")
+	}
+
+	var alertBody []byte
+	var alertType string
+	var attachments []Attachment
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Event{}, fmt.Errorf("error reading HIKVision multipart post: %v", err)
+		}
+
+		partBody, err := io.ReadAll(part)
+		if err != nil {
+			return Event{}, fmt.Errorf("error reading HIKVision multipart part: %v", err)
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if strings.HasPrefix(contentType, "image/") {
+			name := part.FileName()
+			if name == "" {
+				name = part.FormName()
+			}
+			attachments = append(attachments, Attachment{
+				Name:        name,
+				ContentType: contentType,
+				Size:        len(partBody),
+				Data:        partBody,
+			})
+			continue
+		}
+
+		if alertBody == nil && isHikAlertPart(contentType, partBody) {
+			alertBody = partBody
+			alertType = contentType
+		}
+	}
+
+	if alertBody == nil {
+		return Event{}, fmt.Errorf("multipart HIKVision post without alert document")
+	}
+
+	hikAlarm, err := parseHikAlert(alertType, alertBody)
+	if err != nil {
+		return Event{}, err
+	}
+
+	event := convertHikVisionAlarm(hikAlarm, string(alertBody))
+	event.Attachments = attachments
+	return event, nil
+}
+
+// convertHikVisionAlarm converts HIKVision alarm format to our standard event format
+func convertHikVisionAlarm(hikAlarm HIKVisionAlarm, rawXML string) Event {
+	// Parse the datetime from HIKVision format
+	eventTime, err := time.Parse("2006-01-02T15:04:05-07:00", hikAlarm.DateTime)
+	if err != nil {
+		// If standard format fails, try alternative formats
+		eventTime, err = time.Parse("2006-01-02T15:04:05Z", hikAlarm.DateTime)
+		if err != nil {
+			// If all parsing fails, use current time
+			eventTime = time.Now()
+		}
+	}
+
+	// Map HIKVision event types to standardized types
+	eventType := mapHikEventType(hikAlarm.EventType)
+
+	// Create device ID from IP if available
+	deviceID := fmt.Sprintf("HIK_%s", hikAlarm.IPAddress)
+	if hikAlarm.MacAddress != "" {
+		deviceID = fmt.Sprintf("HIK_%s", strings.ReplaceAll(hikAlarm.MacAddress, ":", ""))
+	}
+
+	// Create channel ID
+	channelID := fmt.Sprintf("Channel%d", hikAlarm.ChannelID)
+
+	// Create event details map
+	eventDetails := map[string]interface{}{
+		"source":       "HIKVision",
+		"ipAddress":    hikAlarm.IPAddress,
+		"description":  hikAlarm.EventDescription,
+		"state":        hikAlarm.EventState,
+		"macAddress":   hikAlarm.MacAddress,
+		"originalType": hikAlarm.EventType,
+	}
+
+	// Add optional fields if present
+	if hikAlarm.DetectionRegionID > 0 {
+		eventDetails["regionId"] = hikAlarm.DetectionRegionID
+	}
+	if hikAlarm.ChannelName != "" {
+		eventDetails["channelName"] = hikAlarm.ChannelName
+	}
+	if protocol := hikAlarm.Protocol; protocol != "" || hikAlarm.ProtocolType != "" {
+		if protocol == "" {
+			protocol = hikAlarm.ProtocolType
+		}
+		eventDetails["protocol"] = protocol
+	}
+	if hikAlarm.ActivePostCount > 0 {
+		eventDetails["activePostCount"] = hikAlarm.ActivePostCount
+	}
+	if ext := hikAlarm.Extensions; ext != nil {
+		if ext.SerialNo > 0 {
+			eventDetails["serialNo"] = ext.SerialNo
+		}
+		if ext.EventPush != "" {
+			eventDetails["eventPush"] = ext.EventPush
+		}
+	}
+	addHikTargetDetails(eventDetails, hikAlarm)
+
+	// HIKVision reports "active" or "inactive", anything else is treated as active
+	eventState := EventStateActive
+	if strings.EqualFold(hikAlarm.EventState, EventStateInactive) {
+		eventState = EventStateInactive
+	}
+
+	return Event{
+		Vendor:       VendorHikVision,
+		EventType:    eventType,
+		EventTime:    eventTime,
+		ReceivedAt:   time.Now(),
+		DeviceID:     deviceID,
+		ChannelID:    channelID,
+		State:        eventState,
+		EventDetails: eventDetails,
+		Raw:          rawXML,
+	}
+}
+
+// addHikTargetDetails adds the target type, target rectangle and detection regions
+// of smart events so they can be used for filtering
+func addHikTargetDetails(eventDetails map[string]interface{}, hikAlarm HIKVisionAlarm) {
+	targetType := hikAlarm.TargetType
+	targetRect := hikAlarm.TargetRect
+	isLine := strings.EqualFold(hikAlarm.EventType, "linedetection")
+
+	if len(hikAlarm.DetectionRegionList) > 0 {
+		regions := make([]map[string]interface{}, 0, len(hikAlarm.DetectionRegionList))
+		for _, region := range hikAlarm.DetectionRegionList {
+			regionTarget := region.TargetType
+			if regionTarget == "" {
+				regionTarget = region.DetectionTarget
+			}
+
+			entry := map[string]interface{}{
+				"regionId": hikRegionID(region.RegionID),
+			}
+			if region.SensitivityLevel > 0 {
+				entry["sensitivityLevel"] = region.SensitivityLevel
+			}
+			if regionTarget != "" {
+				entry["targetType"] = regionTarget
+			}
+			if region.TargetRect != nil {
+				entry["targetRect"] = hikRectDetails(region.TargetRect)
+			}
+			if len(region.RegionCoordinatesList) > 0 {
+				entry["coordinates"] = hikCoordinateDetails(region.RegionCoordinatesList)
+			}
+			if region.Direction != "" {
+				entry["direction"] = region.Direction
+			}
+			regions = append(regions, entry)
+
+			// AcuSense devices only report the target per region
+			if targetType == "" {
+				targetType = regionTarget
+			}
+			if targetRect == nil {
+				targetRect = region.TargetRect
+			}
+		}
+		eventDetails["regions"] = regions
+
+		// Name the triggering region, the first entry is the one that fired
+		first := hikAlarm.DetectionRegionList[0]
+		if _, ok := eventDetails["regionId"]; !ok && first.RegionID != "" {
+			eventDetails["regionId"] = hikRegionID(first.RegionID)
+		}
+
+		// A crossing line is given by its two end points
+		if isLine && len(first.RegionCoordinatesList) == 2 {
+			line := map[string]interface{}{
+				"start": hikCoordinateDetails(first.RegionCoordinatesList[:1])[0],
+				"end":   hikCoordinateDetails(first.RegionCoordinatesList[1:])[0],
+			}
+			if first.Direction != "" {
+				line["direction"] = first.Direction
+			}
+			eventDetails["line"] = line
+		}
+	}
+
+	if targetType != "" {
+		eventDetails["targetType"] = strings.ToLower(targetType)
+	}
+	if targetRect != nil {
+		eventDetails["targetRect"] = hikRectDetails(targetRect)
+	}
+}
+
+// hikRegionID returns numeric region IDs as int, like detectionRegionID, and others as string
+func hikRegionID(id json.Number) interface{} {
+	if n, err := id.Int64(); err == nil {
+		return int(n)
+	}
+	return id.String()
+}
+
+// hikCoordinateDetails converts region coordinates to a list of points
+func hikCoordinateDetails(coordinates []HIKCoordinate) []map[string]interface{} {
+	points := make([]map[string]interface{}, 0, len(coordinates))
+	for _, coordinate := range coordinates {
+		points = append(points, map[string]interface{}{
+			"x": coordinate.PositionX,
+			"y": coordinate.PositionY,
+		})
+	}
+	return points
+}
+
+// hikRectDetails converts a target rectangle to an event details map
+func hikRectDetails(rect *HIKTargetRect) map[string]interface{} {
+	return map[string]interface{}{
+		"x":      rect.X,
+		"y":      rect.Y,
+		"width":  rect.Width,
+		"height": rect.Height,
+	}
+}
+
+// hikEventTypes maps documented ISAPI event types (lower case) to standardized types
+var hikEventTypes = map[string]string{
+	// Motion
+	"vmd":             "MotionDetection",
+	"motion":          "MotionDetection",
+	"motiondetection": "MotionDetection",
+	"pir":             "MotionDetection",
+	"pira":            "MotionDetection",
+	// Motion detection 2.0 reports a detected person
+	"humanrecognition": "IntrusionDetection",
+	// Video input
+	"videoloss":     "VideoLoss",
+	"videomismatch": "VideoLoss",
+	"badvideo":      "VideoLoss",
+	// Tampering
+	"shelteralarm":         "TamperDetection",
+	"tamperdetection":      "TamperDetection",
+	"scenechangedetection": "TamperDetection",
+	"defocus":              "TamperDetection",
+	// Storage
+	"diskfull":        "StorageFailure",
+	"diskerror":       "StorageFailure",
+	"hdfull":          "StorageFailure",
+	"hderror":         "StorageFailure",
+	"nohdd":           "StorageFailure",
+	"diskunformatted": "StorageFailure",
+	"recordexception": "StorageFailure",
+	// Smart events
+	"linedetection":     "LineCrossing",
+	"fielddetection":    "IntrusionDetection",
+	"regionentrance":    "IntrusionDetection",
+	"regionexiting":     "IntrusionDetection",
+	"loitering":         "IntrusionDetection",
+	"group":             "IntrusionDetection",
+	"parking":           "IntrusionDetection",
+	"unattendedbaggage": "IntrusionDetection",
+	"attendedbaggage":   "IntrusionDetection",
+	"facedetection":     "FaceDetection",
+	"facesnap":          "FaceDetection",
+	"facecapture":       "FaceDetection",
+	"anpr":              "LicensePlateRecognition",
+	"vehicledetection":  "LicensePlateRecognition",
+	// Alarm inputs
+	"io":         "IOAlarm",
+	"alarminput": "IOAlarm",
+	// System exceptions
+	"illaccess":  "IllegalAccess",
+	"ipconflict": "NetworkFailure",
+	"nicbroken":  "NetworkFailure",
+	"netbroken":  "NetworkFailure",
+}
+
+// hikEventTypeOverrides holds the hik_event_types config with lower case keys
+var hikEventTypeOverrides = map[string]string{}
+
+// initHikEventTypes applies the hik_event_types config
+func initHikEventTypes(overrides map[string]string) {
+	hikEventTypeOverrides = make(map[string]string, len(overrides))
+	for hikType, eventType := range overrides {
+		hikEventTypeOverrides[strings.ToLower(hikType)] = eventType
+	}
+}
+
+// mapHikEventType converts HIKVision event types to our standardized types.
+// The hik_event_types config overrides the built-in table for unusual firmware.
+func mapHikEventType(hikType string) string {
+	hikType = strings.ToLower(hikType)
+
+	if eventType, ok := hikEventTypeOverrides[hikType]; ok {
+		return eventType
+	}
+	if eventType, ok := hikEventTypes[hikType]; ok {
+		return eventType
+	}
+	return "UnknownEvent_" + hikType
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"testing"
+)
+
+const hikMotionXML = `<?xml version="1.0" encoding="UTF-8"?>
+<EventNotificationAlert version="1.0" xmlns="http://www.hikvision.com/ver20/XMLSchema">
+<ipAddress>192.168.1.64</ipAddress>
+<portNo>80</portNo>
+<protocolType>HTTP</protocolType>
+<macAddress>00:11:22:33:44:55</macAddress>
+<channelID>1</channelID>
+<dateTime>2026-03-01T08:00:00+01:00</dateTime>
+<activePostCount>1</activePostCount>
+<eventType>VMD</eventType>
+<eventState>active</eventState>
+<eventDescription>Motion alarm</eventDescription>
+</EventNotificationAlert>`
+
+const hikMotionJSON = `{
+  "ipAddress": "192.168.1.64",
+  "portNo": 80,
+  "protocol": "HTTP",
+  "macAddress": "00:11:22:33:44:55",
+  "channelID": 2,
+  "dateTime": "2026-03-01T08:00:00+01:00",
+  "activePostCount": 3,
+  "eventType": "VMD",
+  "eventState": "inactive",
+  "eventDescription": "Motion alarm"
+}`
+
+const hikWrappedJSON = `{"EventNotificationAlert": {
+  "ipAddress": "10.0.0.7",
+  "channelID": 1,
+  "dateTime": "2026-03-01T07:00:00Z",
+  "eventType": "shelteralarm",
+  "eventState": "active",
+  "eventDescription": "Tamper"
+}}`
+
+func TestParseHikAlert(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		eventType   string
+		state       string
+		deviceID    string
+		channel     string
+		protocol    string
+	}{
+		{
+			name:        "XML",
+			contentType: "application/xml",
+			body:        hikMotionXML,
+			eventType:   "MotionDetection",
+			state:       EventStateActive,
+			deviceID:    "HIK_001122334455",
+			channel:     "Channel1",
+			protocol:    "HTTP",
+		},
+		{
+			name:        "JSON",
+			contentType: "application/json",
+			body:        hikMotionJSON,
+			eventType:   "MotionDetection",
+			state:       EventStateInactive,
+			deviceID:    "HIK_001122334455",
+			channel:     "Channel2",
+			protocol:    "HTTP",
+		},
+		{
+			// Detected by its first character when the content type is missing
+			name:      "JSON without content type",
+			body:      hikMotionJSON,
+			eventType: "MotionDetection",
+			state:     EventStateInactive,
+			deviceID:  "HIK_001122334455",
+			channel:   "Channel2",
+			protocol:  "HTTP",
+		},
+		{
+			name:        "wrapped JSON",
+			contentType: "application/json",
+			body:        hikWrappedJSON,
+			eventType:   "TamperDetection",
+			state:       EventStateActive,
+			deviceID:    "HIK_10.0.0.7",
+			channel:     "Channel1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hikAlarm, err := parseHikAlert(tt.contentType, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("parseHikAlert: %v", err)
+			}
+			event := convertHikVisionAlarm(hikAlarm, tt.body)
+			if event.EventType != tt.eventType || event.State != tt.state || event.DeviceID != tt.deviceID ||
+				event.ChannelID != tt.channel {
+				t.Errorf("got %s/%s/%s/%s, want %s/%s/%s/%s", event.EventType, event.State, event.DeviceID,
+					event.ChannelID, tt.eventType, tt.state, tt.deviceID, tt.channel)
+			}
+			if tt.protocol != "" && event.EventDetails["protocol"] != tt.protocol {
+				t.Errorf("got protocol %v, want %s", event.EventDetails["protocol"], tt.protocol)
+			}
+			if event.EventTime.IsZero() || event.EventTime.Year() != 2026 {
+				t.Errorf("got event time %v, want the device time", event.EventTime)
+			}
+		})
+	}
+}
+
+func TestParseHikAlertInvalid(t *testing.T) {
+	for _, tt := range []struct{ contentType, body string }{
+		{"application/xml", "<EventNotificationAlert><eventType>VMD"},
+		{"application/json", `{"eventType": `},
+	} {
+		if _, err := parseHikAlert(tt.contentType, []byte(tt.body)); err == nil {
+			t.Errorf("%s: got no error for %q", tt.contentType, tt.body)
+		}
+	}
+}
+
+const hikLineCrossingXML = `<EventNotificationAlert version="2.0" xmlns="http://www.isapi.org/ver20/XMLSchema">
+<ipAddress>192.168.1.64</ipAddress>
+<macAddress>00:11:22:33:44:55</macAddress>
+<channelID>1</channelID>
+<channelName>Gate</channelName>
+<dateTime>2026-03-01T08:00:00+01:00</dateTime>
+<eventType>linedetection</eventType>
+<eventState>active</eventState>
+<eventDescription>linedetection alarm</eventDescription>
+<DetectionRegionList>
+<DetectionRegionEntry>
+<regionID>1</regionID>
+<sensitivityLevel>50</sensitivityLevel>
+<RegionCoordinatesList>
+<RegionCoordinates><positionX>100</positionX><positionY>200</positionY></RegionCoordinates>
+<RegionCoordinates><positionX>500</positionX><positionY>200</positionY></RegionCoordinates>
+</RegionCoordinatesList>
+<detectionTarget>human</detectionTarget>
+<direction>left-right</direction>
+</DetectionRegionEntry>
+</DetectionRegionList>
+</EventNotificationAlert>`
+
+const hikIntrusionJSON = `{
+  "ipAddress": "192.168.1.64",
+  "macAddress": "00:11:22:33:44:55",
+  "channelID": 3,
+  "dateTime": "2026-03-01T08:00:00+01:00",
+  "eventType": "fielddetection",
+  "eventState": "active",
+  "eventDescription": "fielddetection alarm",
+  "DetectionRegionList": [
+    {
+      "regionID": "2",
+      "targetType": "Vehicle",
+      "TargetRect": {"X": 0.1, "Y": 0.2, "width": 0.3, "height": 0.4}
+    }
+  ]
+}`
+
+func TestParseHikSmartEvents(t *testing.T) {
+	t.Run("line crossing", func(t *testing.T) {
+		hikAlarm, err := parseHikAlert("application/xml", []byte(hikLineCrossingXML))
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := convertHikVisionAlarm(hikAlarm, hikLineCrossingXML)
+		if event.EventType != "LineCrossing" {
+			t.Errorf("got event type %s, want LineCrossing", event.EventType)
+		}
+		details := event.EventDetails
+		if details["targetType"] != "human" || details["regionId"] != 1 || details["channelName"] != "Gate" {
+			t.Errorf("got target %v, region %v, channel name %v", details["targetType"], details["regionId"], details["channelName"])
+		}
+		line, ok := details["line"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("got no line in %v", details)
+		}
+		start := line["start"].(map[string]interface{})
+		end := line["end"].(map[string]interface{})
+		if start["x"] != 100.0 || end["x"] != 500.0 || line["direction"] != "left-right" {
+			t.Errorf("got line %v", line)
+		}
+	})
+
+	t.Run("AcuSense intrusion", func(t *testing.T) {
+		hikAlarm, err := parseHikAlert("application/json", []byte(hikIntrusionJSON))
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := convertHikVisionAlarm(hikAlarm, hikIntrusionJSON)
+		if event.EventType != "IntrusionDetection" || event.ChannelID != "Channel3" {
+			t.Errorf("got %s/%s", event.EventType, event.ChannelID)
+		}
+		details := event.EventDetails
+		// The target of the region is reported for the whole event
+		if details["targetType"] != "vehicle" || details["regionId"] != 2 {
+			t.Errorf("got target %v, region %v", details["targetType"], details["regionId"])
+		}
+		rect, ok := details["targetRect"].(map[string]interface{})
+		if !ok || rect["width"] != 0.3 {
+			t.Errorf("got target rect %v", details["targetRect"])
+		}
+		if _, ok := details["line"]; ok {
+			t.Error("got a line for a region event")
+		}
+	})
+}
+
+func TestParseHikMultipart(t *testing.T) {
+	body := "--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"linedetection\"\r\n" +
+		"Content-Type: application/xml\r\n\r\n" +
+		hikLineCrossingXML + "\r\n" +
+		"--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"detectionPicture\"; filename=\"detectionPicture.jpg\"\r\n" +
+		"Content-Type: image/jpeg\r\n\r\n" +
+		"\xff\xd8\xff\xe0jpeg\r\n" +
+		"--boundary--\r\n"
+
+	event, err := parseHikMultipart([]byte(body), "boundary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.EventType != "LineCrossing" {
+		t.Errorf("got event type %s, want LineCrossing", event.EventType)
+	}
+	if len(event.Attachments) != 1 {
+		t.Fatalf("got %d attachments, want 1", len(event.Attachments))
+	}
+	attachment := event.Attachments[0]
+	if attachment.Name != "detectionPicture.jpg" || attachment.ContentType != "image/jpeg" || attachment.Size != 8 {
+		t.Errorf("got attachment %s/%s/%d", attachment.Name, attachment.ContentType, attachment.Size)
+	}
+}
+
+func TestMapHikEventType(t *testing.T) {
+	initHikEventTypes(map[string]string{"customVMD": "MotionDetection", "VMD": "IntrusionDetection"})
+	t.Cleanup(func() { initHikEventTypes(nil) })
+
+	tests := map[string]string{
+		// The overrides match case-insensitively and replace the built-in table
+		"CUSTOMvmd": "MotionDetection",
+		"vmd":       "IntrusionDetection",
+		"videoloss": "VideoLoss",
+		// A detected person is more than motion
+		"humanRecognition": "IntrusionDetection",
+		"thermometry":      "UnknownEvent_thermometry",
+	}
+	for hikType, want := range tests {
+		if got := mapHikEventType(hikType); got != want {
+			t.Errorf("mapHikEventType(%q) = %s, want %s", hikType, got, want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Incident phases used in Incident.Phase
+const (
+	IncidentStarted = "started"
+	IncidentEnded   = "ended"
+)
+
+// IncidentConfig configures how active/inactive events are paired into incidents
+type IncidentConfig struct {
+	// Disabled passes every event to the notifiers as received
+	Disabled bool `json:"disabled"`
+	// Timeout ends an incident when no further active event arrives, defaults to 30s
+	Timeout string `json:"timeout,omitempty"`
+	// DisabledVendors pass their events on as received, e.g. for devices sending single pulses
+	DisabledVendors []string `json:"disabled_vendors,omitempty"`
+}
+
+// Incident describes the incident transition an event represents.
+// Notifiers only receive the started and ended transitions.
+type Incident struct {
+	ID         string     `json:"id"`
+	Phase      string     `json:"phase"`
+	StartedAt  time.Time  `json:"startedAt"`
+	EndedAt    *time.Time `json:"endedAt,omitempty"`
+	Duration   string     `json:"duration,omitempty"`
+	EventCount int        `json:"eventCount"`
+	// EndReason is "inactive" when the device ended it, "timeout" otherwise
+	EndReason string `json:"endReason,omitempty"`
+}
+
+// openIncident is an incident that has not ended yet
+type openIncident struct {
+	id         string
+	startedAt  time.Time
+	firstSeen  time.Time
+	lastSeen   time.Time
+	eventCount int
+	lastEvent  Event
+	timer      *time.Timer
+	// notified is set once the start was sent, the end is only sent after it
+	notified bool
+}
+
+// incidentTracker keeps the open incidents per vendor/device/channel/type
+var incidentTracker = struct {
+	sync.Mutex
+	enabled         bool
+	timeout         time.Duration
+	disabledVendors map[string]bool
+	nextID          int
+	open            map[string]*openIncident
+}{open: map[string]*openIncident{}}
+
+// initIncidents applies the incident configuration
+func initIncidents(cfg IncidentConfig) error {
+	timeout, err := parseDurationDefault(cfg.Timeout, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("invalid incidents timeout: %v", err)
+	}
+
+	incidentTracker.Lock()
+	defer incidentTracker.Unlock()
+	incidentTracker.enabled = !cfg.Disabled
+	incidentTracker.timeout = timeout
+	incidentTracker.disabledVendors = map[string]bool{}
+	for _, vendor := range cfg.DisabledVendors {
+		incidentTracker.disabledVendors[strings.ToLower(vendor)] = true
+	}
+	return nil
+}
+
+// incidentKey identifies the incident an event belongs to
+func incidentKey(event *Event) string {
+	return fmt.Sprintf("%s|%s|%s|%s", event.Vendor, event.DeviceID, event.ChannelID, event.EventType)
+}
+
+// trackIncident opens, extends or closes the incident of the event. It reports
+// whether the event is an incident transition that should be passed on.
+func trackIncident(event *Event) bool {
+	// Connection events already are transitions of the device state
+	if event.EventType == "DeviceConnection" {
+		return true
+	}
+
+	incidentTracker.Lock()
+	defer incidentTracker.Unlock()
+
+	if !incidentTracker.enabled || incidentTracker.disabledVendors[strings.ToLower(event.Vendor)] {
+		return true
+	}
+
+	key := incidentKey(event)
+	incident, open := incidentTracker.open[key]
+
+	if event.State != EventStateInactive {
+		// Repeated actives only extend the open incident
+		if open {
+			incident.lastSeen = event.ReceivedAt
+			incident.eventCount++
+			incident.lastEvent = *event
+			incident.timer.Reset(incidentTracker.timeout)
+			return false
+		}
+
+		incidentTracker.nextID++
+		incident = &openIncident{
+			id:         fmt.Sprintf("%d", incidentTracker.nextID),
+			startedAt:  event.EventTime,
+			firstSeen:  event.ReceivedAt,
+			lastSeen:   event.ReceivedAt,
+			eventCount: 1,
+			lastEvent:  *event,
+		}
+		incident.timer = time.AfterFunc(incidentTracker.timeout, func() {
+			expireIncident(key, incident)
+		})
+		incidentTracker.open[key] = incident
+
+		event.Incident = &Incident{
+			ID:         incident.id,
+			Phase:      IncidentStarted,
+			StartedAt:  incident.startedAt,
+			EventCount: 1,
+		}
+		return true
+	}
+
+	if !open {
+		event.logger().Info("Ignoring inactive event without open incident")
+		return false
+	}
+
+	incident.timer.Stop()
+	delete(incidentTracker.open, key)
+	event.Incident = incident.ended(event.EventTime, event.ReceivedAt, "inactive")
+	if !incident.notified {
+		event.logger().Info("Not notifying: start of the incident was not sent", "incident", incident.id)
+		countSuppressedRepeats(event)
+		return false
+	}
+	return true
+}
+
+// incidentNotified records whether the start of the event's incident was sent
+func incidentNotified(event *Event, notified bool) {
+	if event.Incident == nil || event.Incident.Phase != IncidentStarted {
+		return
+	}
+	incidentTracker.Lock()
+	defer incidentTracker.Unlock()
+	if incident, ok := incidentTracker.open[incidentKey(event)]; ok && incident.id == event.Incident.ID {
+		incident.notified = notified
+	}
+}
+
+// expireIncident ends an incident that saw no active event within the timeout
+func expireIncident(key string, incident *openIncident) {
+	incidentTracker.Lock()
+	if incidentTracker.open[key] != incident {
+		// Already ended or replaced by a newer incident
+		incidentTracker.Unlock()
+		return
+	}
+	delete(incidentTracker.open, key)
+
+	// Report the end based on the last event seen, without its snapshots
+	event := incident.lastEvent
+	event.State = EventStateInactive
+	event.EventTime = incident.startedAt.Add(incident.lastSeen.Sub(incident.firstSeen))
+	event.ReceivedAt = time.Now()
+	event.Attachments = nil
+	event.Raw = ""
+	event.CorrelationID = newCorrelationID()
+	event.Incident = incident.ended(event.EventTime, incident.lastSeen, "timeout")
+	notified := incident.notified
+	incidentTracker.Unlock()
+
+	event.logger().Info("Incident timed out", "incident", incident.id, "duration", event.Incident.Duration)
+	if notified {
+		dispatchEvent(&event)
+	} else {
+		event.logger().Info("Not notifying: start of the incident was not sent", "incident", incident.id)
+		countSuppressedRepeats(&event)
+	}
+	storeEvent(&event)
+}
+
+// ended returns the ended transition of the incident. The duration is measured
+// with the receive times, device clocks are not trusted.
+func (i *openIncident) ended(endedAt, lastReceived time.Time, reason string) *Incident {
+	return &Incident{
+		ID:         i.id,
+		Phase:      IncidentEnded,
+		StartedAt:  i.startedAt,
+		EndedAt:    &endedAt,
+		Duration:   lastReceived.Sub(i.firstSeen).Round(time.Second).String(),
+		EventCount: i.eventCount,
+		EndReason:  reason,
+	}
+}
+
+// handleListIncidents lists the open incidents
+func handleListIncidents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+
+	incidentTracker.Lock()
+	incidents := make([]map[string]interface{}, 0, len(incidentTracker.open))
+	for _, incident := range incidentTracker.open {
+		incidents = append(incidents, map[string]interface{}{
+			"id":         incident.id,
+			"vendor":     incident.lastEvent.Vendor,
+			"eventType":  incident.lastEvent.EventType,
+			"deviceId":   incident.lastEvent.DeviceID,
+			"channelId":  incident.lastEvent.ChannelID,
+			"startedAt":  incident.startedAt,
+			"lastSeen":   incident.lastSeen,
+			"eventCount": incident.eventCount,
+		})
+	}
+	incidentTracker.Unlock()
+
+	sort.Slice(incidents, func(i, j int) bool {
+		return incidents[i]["startedAt"].(time.Time).Before(incidents[j]["startedAt"].(time.Time))
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"incidents": incidents})
+}
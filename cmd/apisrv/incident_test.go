@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useIncidents configures incident tracking for the test
+func useIncidents(t *testing.T, cfg IncidentConfig) {
+	if err := initIncidents(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		incidentTracker.Lock()
+		for key, incident := range incidentTracker.open {
+			incident.timer.Stop()
+			delete(incidentTracker.open, key)
+		}
+		incidentTracker.enabled = false
+		incidentTracker.Unlock()
+	})
+}
+
+// waitForEvents waits until the notifier received n events
+func waitForEvents(t *testing.T, notifier *recordingNotifier, n int) []Event {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		events := notifier.received()
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// incidentPhases returns the incident phase of every event, "-" for events without incident
+func incidentPhases(events []Event) []string {
+	phases := make([]string, 0, len(events))
+	for _, event := range events {
+		phase := "-"
+		if event.Incident != nil {
+			phase = event.Incident.Phase
+		}
+		phases = append(phases, phase)
+	}
+	return phases
+}
+
+func TestIncidentEndedByInactive(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useIncidents(t, IncidentConfig{Timeout: "1m"})
+
+	for _, eventState := range []string{EventStateActive, EventStateActive, EventStateActive, EventStateInactive} {
+		processEvent(&Event{Vendor: VendorHikVision, EventType: "MotionDetection", DeviceID: "cam1",
+			ChannelID: "Channel1", State: eventState})
+	}
+
+	events := notifier.received()
+	if phases := incidentPhases(events); len(phases) != 2 || phases[0] != IncidentStarted || phases[1] != IncidentEnded {
+		t.Fatalf("got phases %v, want started and ended", phases)
+	}
+	ended := events[1].Incident
+	if ended.ID != events[0].Incident.ID || ended.EventCount != 3 || ended.EndReason != "inactive" {
+		t.Errorf("got end %+v, want 3 events ended by inactive", ended)
+	}
+}
+
+func TestIncidentEndedByTimeout(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useIncidents(t, IncidentConfig{Timeout: "50ms"})
+
+	processEvent(&Event{Vendor: VendorHikVision, EventType: "LineCrossing", DeviceID: "cam1", ChannelID: "Channel1"})
+	processEvent(&Event{Vendor: VendorHikVision, EventType: "LineCrossing", DeviceID: "cam1", ChannelID: "Channel1"})
+
+	events := waitForEvents(t, notifier, 2)
+	if phases := incidentPhases(events); len(phases) != 2 || phases[0] != IncidentStarted || phases[1] != IncidentEnded {
+		t.Fatalf("got phases %v, want started and ended", phases)
+	}
+	ended := events[1]
+	if ended.State != EventStateInactive || ended.Incident.EventCount != 2 || ended.Incident.EndReason != "timeout" {
+		t.Errorf("got end %s/%+v, want an inactive timeout after 2 events", ended.State, ended.Incident)
+	}
+	if ended.CorrelationID == "" || ended.CorrelationID == events[0].CorrelationID {
+		t.Errorf("got correlation ID %q for the end, want a new one", ended.CorrelationID)
+	}
+}
+
+func TestIncidentSinglePulse(t *testing.T) {
+	t.Run("ended by timeout", func(t *testing.T) {
+		notifier := useRecordingNotifier(t)
+		useIncidents(t, IncidentConfig{Timeout: "50ms"})
+
+		processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "nvr1", ChannelID: "Channel1"})
+
+		events := waitForEvents(t, notifier, 2)
+		if phases := incidentPhases(events); len(phases) != 2 || phases[1] != IncidentEnded {
+			t.Fatalf("got phases %v, want started and ended", phases)
+		}
+		if count := events[1].Incident.EventCount; count != 1 {
+			t.Errorf("got %d events, want 1", count)
+		}
+	})
+
+	t.Run("vendor disabled", func(t *testing.T) {
+		notifier := useRecordingNotifier(t)
+		useIncidents(t, IncidentConfig{Timeout: "50ms", DisabledVendors: []string{"vivotek"}})
+
+		processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "nvr1", ChannelID: "Channel1"})
+		processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "nvr1", ChannelID: "Channel1"})
+
+		time.Sleep(100 * time.Millisecond)
+		if phases := incidentPhases(notifier.received()); len(phases) != 2 || phases[0] != "-" || phases[1] != "-" {
+			t.Errorf("got phases %v, want both events as received", phases)
+		}
+	})
+}
+
+func TestIncidentEndNotSentWithoutStart(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useIncidents(t, IncidentConfig{Timeout: "50ms"})
+
+	silence := &Silence{ID: "maintenance", Matchers: []SilenceMatcher{{Name: "deviceId", Value: "cam1"}},
+		StartsAt: time.Now().Add(-time.Minute), EndsAt: time.Now().Add(time.Hour)}
+	if err := silence.compile(); err != nil {
+		t.Fatal(err)
+	}
+	silences.Lock()
+	silences.byID[silence.ID] = silence
+	silences.Unlock()
+	t.Cleanup(func() {
+		silences.Lock()
+		delete(silences.byID, silence.ID)
+		silences.Unlock()
+	})
+
+	processEvent(&Event{Vendor: VendorHikVision, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1"})
+	// The silence ends before the incident does
+	silences.Lock()
+	delete(silences.byID, silence.ID)
+	silences.Unlock()
+	processEvent(&Event{Vendor: VendorHikVision, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1",
+		State: EventStateInactive})
+	processEvent(&Event{Vendor: VendorHikVision, EventType: "VideoLoss", DeviceID: "cam2", ChannelID: "Channel1"})
+
+	// Only the unrelated incident is sent, with its end after the timeout
+	events := waitForEvents(t, notifier, 2)
+	if len(events) != 2 || events[0].DeviceID != "cam2" || events[1].DeviceID != "cam2" {
+		t.Errorf("got %d events %v, want only the start and end of cam2", len(events), incidentPhases(events))
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdapterConfig configures one ingest adapter instance
+type AdapterConfig struct {
+	// Type selects the registered adapter, e.g. "vivotek" or "hikvision"
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+	// Routes overrides the adapter's default HTTP routes
+	Routes []string `json:"routes,omitempty"`
+	// Username and Password enable vendor-specific basic auth
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Options holds adapter specific settings
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+// IngestAdapter receives vendor payloads over HTTP and converts them to normalized events
+type IngestAdapter interface {
+	// Name returns the vendor name used in logs and responses
+	Name() string
+	// Routes returns the HTTP paths the adapter is mounted on
+	Routes() []string
+	// Methods returns the HTTP methods the adapter accepts
+	Methods() []string
+	// Authenticate checks vendor-specific credentials on the request
+	Authenticate(r *http.Request) bool
+	// Parse converts the request body into zero or more normalized events
+	Parse(r *http.Request, body []byte) ([]Event, error)
+}
+
+// IngestResponder is implemented by adapters whose devices expect a vendor specific
+// response instead of the default JSON acknowledgement
+type IngestResponder interface {
+	Respond(w http.ResponseWriter, events []Event, eventNumber int)
+}
+
+// IngestSelfAuthenticator is implemented by adapters whose devices cannot send the
+// API credentials; their routes skip basic auth and rely on Authenticate alone
+type IngestSelfAuthenticator interface {
+	AuthenticatesItself() bool
+}
+
+// AdapterFactory creates an adapter from its configuration
+type AdapterFactory func(cfg AdapterConfig) (IngestAdapter, error)
+
+// adapterRegistry maps adapter types to their factories
+var adapterRegistry = map[string]AdapterFactory{}
+
+// registerAdapter makes an adapter type available to the configuration
+func registerAdapter(adapterType string, factory AdapterFactory) {
+	adapterRegistry[strings.ToLower(adapterType)] = factory
+}
+
+// registeredAdapterTypes returns the sorted list of known adapter types
+func registeredAdapterTypes() []string {
+	types := make([]string, 0, len(adapterRegistry))
+	for adapterType := range adapterRegistry {
+		types = append(types, adapterType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// defaultAdapterConfigs returns the adapters mounted when the config has none
+func defaultAdapterConfigs() []AdapterConfig {
+	return []AdapterConfig{
+		{Type: "vivotek", Enabled: true},
+		{Type: "hikvision", Enabled: true},
+	}
+}
+
+// buildAdapters creates all enabled adapters from the configuration
+func buildAdapters(configs []AdapterConfig) ([]IngestAdapter, error) {
+	if len(configs) == 0 {
+		configs = defaultAdapterConfigs()
+	}
+
+	var adapters []IngestAdapter
+	for _, cfg := range configs {
+		if !cfg.Enabled {
+			continue
+		}
+
+		factory, ok := adapterRegistry[strings.ToLower(cfg.Type)]
+		if !ok {
+			return nil, fmt.Errorf("unknown adapter type %q (known: %s)",
+				cfg.Type, strings.Join(registeredAdapterTypes(), ", "))
+		}
+
+		adapter, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s adapter: %v", cfg.Type, err)
+		}
+		adapters = append(adapters, adapter)
+	}
+
+	return adapters, nil
+}
+
+// mountAdapters registers the HTTP routes of every adapter on the mux
+func mountAdapters(mux *http.ServeMux, adapters []IngestAdapter) {
+	for _, adapter := range adapters {
+		handler := ingestHandler(adapter)
+		if selfAuth, ok := adapter.(IngestSelfAuthenticator); !ok || !selfAuth.AuthenticatesItself() {
+			handler = basicAuth(handler)
+		}
+		for _, route := range adapter.Routes() {
+			mux.HandleFunc(route, handler)
+			state.Logger.Info("Mounted adapter", "adapter", adapter.Name(), "route", route)
+		}
+	}
+}
+
+// adapterRoutes returns the configured routes, falling back to the adapter defaults
+func adapterRoutes(cfg AdapterConfig, defaults ...string) []string {
+	if len(cfg.Routes) > 0 {
+		return cfg.Routes
+	}
+	return defaults
+}
+
+// checkAdapterAuth validates basic auth against adapter credentials, if configured
+func checkAdapterAuth(r *http.Request, username, password string) bool {
+	if username == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && user == username && pass == password
+}
+
+// requestDeviceID returns the "device" query parameter, or a device ID derived from
+// the remote address for vendors whose payload does not identify the device
+func requestDeviceID(r *http.Request, prefix string) string {
+	if deviceID := r.URL.Query().Get("device"); deviceID != "" {
+		return deviceID
+	}
+	return fmt.Sprintf("%s_%s", prefix, requestHost(r))
+}
+
+// requestHost returns the address the request was sent from
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// setEventIP sets the ipAddress detail of events whose payload does not carry one,
+// so the inventory also finds devices by the address they send from
+func setEventIP(event *Event, ip string) {
+	if existing, ok := event.EventDetails["ipAddress"].(string); ok && existing != "" {
+		return
+	}
+	if event.EventDetails == nil {
+		event.EventDetails = map[string]interface{}{}
+	}
+	event.EventDetails["ipAddress"] = ip
+}
+
+// ingestHandler wraps an adapter into an HTTP handler that drives the event pipeline
+func ingestHandler(adapter IngestAdapter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := false
+		for _, method := range adapter.Methods() {
+			if r.Method == method {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			methods := adapter.Methods()
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			if len(methods) == 1 {
+				w.Write([]byte(fmt.Sprintf("Only %s method is supported", methods[0])))
+			} else {
+				w.Write([]byte(fmt.Sprintf("Only %s methods are supported", strings.Join(methods, " and "))))
+			}
+			return
+		}
+
+		// Check for adapter specific authentication
+		if !adapter.Authenticate(r) {
+			authFailures.inc(r.URL.Path)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(fmt.Sprintf("Unauthorized for %s integration", adapter.Name())))
+			return
+		}
+
+		// Ask devices to retry later while a queue with the reject policy is full
+		if dispatchOverloaded() {
+			ingestRejected.inc(r.URL.Path)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Notification queue is full, retry later"))
+			return
+		}
+
+		// Read the request body
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			state.Logger.Error("Error reading request body", "adapter", adapter.Name(), "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Convert to our standard event format
+		events, err := adapter.Parse(r, body)
+		if err != nil {
+			parseFailures.inc(r.URL.Path)
+			state.Logger.Error("Error parsing payload", "adapter", adapter.Name(), "error", err,
+				"payload", truncatePayload(body))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		eventNumber := 0
+		correlationIDs := make([]string, 0, len(events))
+		for i := range events {
+			setEventIP(&events[i], requestHost(r))
+			eventNumber = ingestEvent(adapter.Name(), &events[i])
+			correlationIDs = append(correlationIDs, events[i].CorrelationID)
+		}
+
+		if responder, ok := adapter.(IngestResponder); ok {
+			responder.Respond(w, events, eventNumber)
+			return
+		}
+
+		// Respond with success
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		response := map[string]interface{}{
+			"status":  "success",
+			"message": fmt.Sprintf("%s event processed successfully", adapter.Name()),
+			"eventId": eventNumber,
+			// Correlation IDs of the events, as found in the log
+			"correlationIds": correlationIDs,
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// ingestEvent counts, logs and processes an event from any ingest path and
+// returns its sequence number
+func ingestEvent(source string, event *Event) int {
+	state.mu.Lock()
+	state.EventCount++
+	eventNumber := state.EventCount
+	state.mu.Unlock()
+
+	// Every log line about the event carries its correlation ID
+	if event.CorrelationID == "" {
+		event.CorrelationID = newCorrelationID()
+	}
+	event.logger().Info("Received event", "source", source, "eventNumber", eventNumber)
+	eventsReceived.inc(event.Vendor, event.EventType)
+	if event.Raw != "" {
+		event.logger().Debug("Raw payload", "payload", truncatePayload([]byte(event.Raw)))
+	}
+
+	// Process the event based on type
+	processEvent(event)
+	return eventNumber
+}
+
+// maxLoggedPayload limits how much of a payload is written to the log
+const maxLoggedPayload = 4096
+
+// truncatePayload shortens large payloads, e.g. posts with images, for logging
+func truncatePayload(body []byte) string {
+	if len(body) <= maxLoggedPayload {
+		return string(body)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", body[:maxLoggedPayload], len(body))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects JSON log records written from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the log records written so far
+func (b *logBuffer) records(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// useLogBuffer logs to a buffer for the test
+func useLogBuffer(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	previous := state.Logger
+	state.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+	t.Cleanup(func() { state.Logger = previous })
+	return logs
+}
+
+func TestCorrelationID(t *testing.T) {
+	useOutbox(t, 0)
+	recorder := useRecordingNotifier(t)
+	failing := &funcNotifier{name: "failing", notify: func(ctx context.Context, event *Event) error {
+		return fmt.Errorf("connection refused")
+	}}
+	state.Notifiers = append(state.Notifiers, failing)
+
+	queue, err := newNotifierQueue(failing, QueueConfig{MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := dispatchQueues
+	dispatchQueues = map[string]*notifierQueue{failing.Name(): queue}
+	t.Cleanup(func() { dispatchQueues = previous })
+	go queue.work()
+	t.Cleanup(func() { close(queue.deliveries) })
+
+	adapters, err := buildAdapters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mountAdapters(mux, adapters)
+	logs := useLogBuffer(t)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/event",
+		strings.NewReader(`{"eventType": "motion", "deviceId": "cam1"}`)))
+	var response struct {
+		CorrelationIDs []string `json:"correlationIds"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.CorrelationIDs) != 1 || response.CorrelationIDs[0] == "" {
+		t.Fatalf("got correlation IDs %v, want one assigned at ingest", response.CorrelationIDs)
+	}
+	id := response.CorrelationIDs[0]
+
+	// Sent directly
+	if events := recorder.received(); len(events) != 1 || events[0].CorrelationID != id {
+		t.Errorf("got %d events, want one with correlation ID %s", len(recorder.received()), id)
+	}
+
+	// Queued, persisted in the outbox and moved to the dead letters
+	var dead []*delivery
+	deadline := time.Now().Add(2 * time.Second)
+	for len(dead) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		if dead, err = selectDeadLetters("", failing.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dead) != 1 || dead[0].Event.CorrelationID != id {
+		t.Fatalf("got %d dead letters, want one with correlation ID %s", len(dead), id)
+	}
+
+	// Every log record about the event carries the ID
+	messages := map[string]bool{}
+	for _, record := range logs.records(t) {
+		if record["deviceId"] != "cam1" {
+			continue
+		}
+		messages[record["msg"].(string)] = true
+		if record["correlationId"] != id {
+			t.Errorf("got %q logged with correlation ID %v, want %s", record["msg"], record["correlationId"], id)
+		}
+	}
+	for _, message := range []string{"Received event", "Notification sent", "Error sending notification",
+		"Giving up on notification, moved to the dead letters"} {
+		if !messages[message] {
+			t.Errorf("got no %q log record", message)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LogRotationConfig configures the rotation of log_file
+type LogRotationConfig struct {
+	// MaxSizeMB rotates the log once it would grow beyond this size
+	MaxSizeMB int `json:"max_size_mb,omitempty"`
+	// Interval rotates the log once it has been written to for this long, e.g. "24h"
+	Interval string `json:"interval,omitempty"`
+	// MaxBackups is the number of rotated files kept, all when 0
+	MaxBackups int `json:"max_backups,omitempty"`
+	// MaxAge deletes rotated files older than this, e.g. "14d"
+	MaxAge string `json:"max_age,omitempty"`
+	// Compress gzips rotated files
+	Compress bool `json:"compress,omitempty"`
+}
+
+// backupTimeLayout is the timestamp in the name of rotated files, e.g. nvr_events-2026-03-01T08-00-00.000.log
+const backupTimeLayout = "2006-01-02T15-04-05.000"
+
+// rotatingFile is a log file that rotates itself by size and age and can be
+// reopened after an external tool such as logrotate moved it
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	compress   bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// cleanupMu runs one cleanup at a time, cleanups tracks those still running
+	cleanupMu sync.Mutex
+	cleanups  sync.WaitGroup
+}
+
+// openLogFile opens the log file for appending with the given rotation
+func openLogFile(path string, cfg LogRotationConfig) (*rotatingFile, error) {
+	interval, err := parseDurationDefault(cfg.Interval, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log rotation interval: %v", err)
+	}
+	maxAge, err := parseRetentionAge(cfg.MaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log rotation max_age: %v", err)
+	}
+
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(cfg.MaxSizeMB) << 20,
+		interval:   interval,
+		maxBackups: cfg.MaxBackups,
+		maxAge:     maxAge,
+		compress:   cfg.Compress,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the log file, continuing an existing one. The caller must hold f.mu.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// Write appends to the log file, rotating it first when it is too large or too old
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooLarge := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.interval > 0 && time.Since(f.openedAt) >= f.interval
+	if tooLarge || tooOld {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing the line
+			fmt.Fprintf(os.Stderr, "Error rotating log file %s: %v\n", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file to a timestamped backup and starts a new one.
+// The caller must hold f.mu.
+func (f *rotatingFile) rotate() error {
+	backup := f.backupName(time.Now())
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	current := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	current.Close()
+
+	// Compressing a large file takes a while, do not block logging meanwhile
+	f.cleanups.Add(1)
+	go f.cleanup(backup)
+	return nil
+}
+
+// Reopen closes and reopens the log file, for use after logrotate moved it
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return current.Close()
+}
+
+// backupName returns the name of a rotated file, the time goes between name and extension
+func (f *rotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-" + t.Format(backupTimeLayout) + ext
+}
+
+// cleanup compresses the new backup and deletes backups beyond max_backups and max_age.
+// Cleanups of quick successive rotations run one after the other, so one never
+// deletes a backup another one is compressing.
+func (f *rotatingFile) cleanup(backup string) {
+	defer f.cleanups.Done()
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	if f.compress {
+		if err := gzipFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "Error compressing log file %s: %v\n", backup, err)
+		}
+	}
+	if f.maxBackups == 0 && f.maxAge == 0 {
+		return
+	}
+
+	backups, err := f.listBackups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing rotated log files: %v\n", err)
+		return
+	}
+	cutoff := time.Now().Add(-f.maxAge)
+	for i, backup := range backups {
+		expired := f.maxAge > 0 && backup.rotatedAt.Before(cutoff)
+		if (f.maxBackups > 0 && i >= f.maxBackups) || expired {
+			os.Remove(backup.path)
+		}
+	}
+}
+
+// logBackup is a rotated log file
+type logBackup struct {
+	path      string
+	rotatedAt time.Time
+}
+
+// listBackups returns the rotated files, newest first
+func (f *rotatingFile) listBackups() ([]logBackup, error) {
+	ext := filepath.Ext(f.path)
+	prefix := filepath.Base(strings.TrimSuffix(f.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+		rotatedAt, err := time.ParseInLocation(backupTimeLayout, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, logBackup{path: filepath.Join(filepath.Dir(f.path), name), rotatedAt: rotatedAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotatedAt.After(backups[j].rotatedAt) })
+	return backups, nil
+}
+
+// gzipFile replaces a file with its gzip compressed version
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// reopenOnSIGHUP reopens the log file whenever the process receives SIGHUP
+func reopenOnSIGHUP(f *rotatingFile) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := f.Reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reopening log file %s: %v\n", f.path, err)
+				continue
+			}
+			state.Logger.Info("Reopened log file on SIGHUP", "file", f.path)
+		}
+	}()
+}
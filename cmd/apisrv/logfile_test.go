@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestLogFile opens a log file in a temporary directory and closes it after the test
+func openTestLogFile(t *testing.T, cfg LogRotationConfig) *rotatingFile {
+	f, err := openLogFile(filepath.Join(t.TempDir(), "nvr_events.log"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.cleanups.Wait()
+		f.file.Close()
+	})
+	return f
+}
+
+// writeLog writes one line to the log file
+func writeLog(t *testing.T, f *rotatingFile, line string) {
+	if _, err := f.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLog returns the content of a log file, decompressing gzipped backups
+func readLog(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = zr
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLogFileRotation(t *testing.T) {
+	f := openTestLogFile(t, LogRotationConfig{MaxSizeMB: 1})
+	// Shrink the limit below a megabyte to keep the test small
+	f.maxSize = 20
+
+	writeLog(t, f, "first line")
+	writeLog(t, f, "second line")
+	f.cleanups.Wait()
+
+	backups, err := f.listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(backups))
+	}
+	if got := readLog(t, backups[0].path); got != "first line\n" {
+		t.Errorf("got backup %q", got)
+	}
+	if got := readLog(t, f.path); got != "second line\n" {
+		t.Errorf("got log %q", got)
+	}
+}
+
+func TestLogFileBackups(t *testing.T) {
+	f := openTestLogFile(t, LogRotationConfig{MaxSizeMB: 1, MaxBackups: 2, Compress: true})
+	f.maxSize = 10
+
+	for _, line := range []string{"line one", "line two", "line three", "line four"} {
+		writeLog(t, f, line)
+		// Backups are named by the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+	f.cleanups.Wait()
+
+	backups, err := f.listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("got %d backups, want the newest 2", len(backups))
+	}
+	for i, want := range []string{"line three\n", "line two\n"} {
+		if !strings.HasSuffix(backups[i].path, ".log.gz") {
+			t.Errorf("got backup %s, want it compressed", filepath.Base(backups[i].path))
+			continue
+		}
+		if got := readLog(t, backups[i].path); got != want {
+			t.Errorf("got backup %d %q, want %q", i, got, want)
+		}
+	}
+
+	// A backup older than max_age is deleted on the next rotation
+	f.maxAge = time.Hour
+	old := f.backupName(time.Now().Add(-2 * time.Hour))
+	if err := os.WriteFile(old, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.maxBackups = 0
+	writeLog(t, f, "line five")
+	f.cleanups.Wait()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("got the expired backup kept, %v", err)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	f := openTestLogFile(t, LogRotationConfig{})
+	writeLog(t, f, "before")
+
+	// logrotate moves the file and signals the service
+	moved := f.path + ".1"
+	if err := os.Rename(f.path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	writeLog(t, f, "after")
+
+	if got := readLog(t, moved); got != "before\n" {
+		t.Errorf("got moved log %q", got)
+	}
+	if got := readLog(t, f.path); got != "after\n" {
+		t.Errorf("got reopened log %q", got)
+	}
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,51 +27,56 @@ type Config struct {
 	HikEnabled      bool   `json:"hik_enabled"`
 	HikUsername     string `json:"hik_username"`
 	HikPassword     string `json:"hik_password"`
-}
-
-// VivotekEvent represents the event data structure from Vivotek NVR
-type VivotekEvent struct {
-	EventType    string                 `json:"eventType"`
-	EventTime    time.Time              `json:"eventTime"`
-	DeviceID     string                 `json:"deviceId"`
-	ChannelID    string                 `json:"channelId"`
-	EventDetails map[string]interface{} `json:"eventDetails"`
-	// Add more fields as needed based on Vivotek's event structure
-}
-
-// HikVisionEvent represents the alarm data structure from HIKVision
-type HikVisionEvent struct {
-	EventType    string                 `json:"eventType"`
-	EventTime    time.Time              `json:"eventTime"`
-	DeviceID     string                 `json:"deviceId"`
-	ChannelID    string                 `json:"channelId"`
-	EventDetails map[string]interface{} `json:"eventDetails"`
-	// Raw XML data for debugging/logging
-	RawXML string `json:"-"`
-}
-
-// HIKVisionAlarm represents the XML structure of a HIKVision alarm event
-type HIKVisionAlarm struct {
-	XMLName          xml.Name `xml:"EventNotificationAlert"`
-	IPAddress        string   `xml:"ipAddress"`
-	PortNo           int      `xml:"portNo"`
-	ProtocolType     string   `xml:"protocolType"`
-	MacAddress       string   `xml:"macAddress"`
-	ChannelID        int      `xml:"channelID"`
-	DateTime         string   `xml:"dateTime"`
-	ActivePostCount  int      `xml:"activePostCount"`
-	EventType        string   `xml:"eventType"`
-	EventState       string   `xml:"eventState"`
-	EventDescription string   `xml:"eventDescription"`
-	// Optional fields that may be present in some events
-	DetectionRegionID int `xml:"detectionRegionID,omitempty"`
+	// LogRotation rotates log_file by size and age
+	LogRotation LogRotationConfig `json:"log_rotation"`
+	// LogFormat is "text" (default) or "json"
+	LogFormat string `json:"log_format"`
+	// LogLevel is debug, info (default), warn or error
+	LogLevel string `json:"log_level"`
+	// HikEventTypes maps additional or differently named HIKVision event types to standardized types
+	HikEventTypes map[string]string `json:"hik_event_types"`
+	// Adapters lists the ingest adapters to mount, defaults to Vivotek and HIKVision
+	Adapters []AdapterConfig `json:"adapters"`
+	// Notifiers lists named outputs in addition to notify_url and telegram_*
+	Notifiers []NotifierConfig `json:"notifiers"`
+	// Dispatch configures the notification queue of every notifier
+	Dispatch QueueConfig `json:"dispatch"`
+	// OutboxDir keeps pending notifications and dead letters across restarts, in memory only when empty
+	OutboxDir string `json:"outbox_dir"`
+	// DeadLetterMax limits the number of dead letters kept, the oldest are deleted first, 0 keeps all
+	DeadLetterMax int `json:"dead_letter_max"`
+	// ONVIFCameras lists cameras subscribed through the ONVIF event service
+	ONVIFCameras []ONVIFCameraConfig `json:"onvif_cameras"`
+	// HikDevices lists HIKVision devices read through the ISAPI alertStream
+	HikDevices []HikDeviceConfig `json:"hik_devices"`
+	// Incidents configures pairing of active and inactive events into incidents
+	Incidents IncidentConfig `json:"incidents"`
+	// Cooldowns limits how often alerts are sent per event type, device and channel
+	Cooldowns []CooldownConfig `json:"cooldowns"`
+	// Rules routes events to notifiers, every notifier receives every event without rules
+	Rules []RuleConfig `json:"rules"`
+	// Schedules arm and disarm sites on a weekly schedule
+	Schedules []ScheduleConfig `json:"schedules"`
+	// Devices is the inventory mapping device IDs, MACs and IPs to names and sites
+	Devices []DeviceConfig `json:"devices"`
+	// Watchdog reports devices that went silent
+	Watchdog WatchdogConfig `json:"watchdog"`
+	// SilencesFile is where silences created through the API are stored
+	SilencesFile string `json:"silences_file"`
+	// EventStore records every event for the history API
+	EventStore EventStoreConfig `json:"event_store"`
 }
 
 // GlobalState maintains the application state
 type GlobalState struct {
 	Config     Config
 	EventCount int
-	Logger     *log.Logger
+	Logger     *slog.Logger
+	Notifiers  []Notifier
+	Rules      []*eventRule
+	Schedules  []*armSchedule
+	Devices    *deviceRegistry
+	mu         sync.Mutex
 }
 
 var state GlobalState
@@ -81,8 +86,11 @@ var startTime time.Time
 func initConfig() error {
 	// Default configuration
 	state.Config = Config{
-		ServerPort: "8080",
-		LogFile:    "nvr_events.log",
+		ServerPort:    "8080",
+		LogFile:       "nvr_events.log",
+		SilencesFile:  "silences.json",
+		OutboxDir:     "outbox",
+		DeadLetterMax: 1000,
 	}
 
 	// Try to load from config file if it exists
@@ -98,17 +106,40 @@ func initConfig() error {
 
 	// Initialize logger
 	var logOutput io.Writer
+	var logFile *rotatingFile
 	if state.Config.LogFile == "stdout" {
 		logOutput = os.Stdout
 	} else {
-		file, err := os.OpenFile(state.Config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		logFile, err = openLogFile(state.Config.LogFile, state.Config.LogRotation)
 		if err != nil {
 			return fmt.Errorf("failed to open log file: %v", err)
 		}
-		logOutput = file
+		logOutput = logFile
+	}
+
+	var level slog.Level
+	if state.Config.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(state.Config.LogLevel)); err != nil {
+			return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", state.Config.LogLevel)
+		}
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(state.Config.LogFormat) {
+	case "", "text":
+		handler = slog.NewTextHandler(logOutput, options)
+	case "json":
+		handler = slog.NewJSONHandler(logOutput, options)
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", state.Config.LogFormat)
 	}
+	state.Logger = slog.New(handler)
 
-	state.Logger = log.New(logOutput, "NVR-API: ", log.LstdFlags)
+	// The reopen is logged, so only listen once the logger exists
+	if logFile != nil {
+		reopenOnSIGHUP(logFile)
+	}
 	return nil
 }
 
@@ -123,6 +154,7 @@ func basicAuth(next http.HandlerFunc) http.HandlerFunc {
 
 		username, password, ok := r.BasicAuth()
 		if !ok || username != state.Config.AuthUsername || password != state.Config.AuthPassword {
+			authFailures.inc(r.URL.Path)
 			w.Header().Set("WWW-Authenticate", `Basic realm="NVR API"`)
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorized"))
@@ -133,500 +165,129 @@ func basicAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// handleEvent processes events from Vivotek NVR
-func handleEvent(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("Only POST method is supported"))
-		return
-	}
-
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		state.Logger.Printf("Error reading request body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	// Parse the event
-	var event VivotekEvent
-	if err := json.Unmarshal(body, &event); err != nil {
-		state.Logger.Printf("Error parsing event JSON: %v", err)
-		state.Logger.Printf("Raw payload: %s", string(body))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	// Log the event
-	state.EventCount++
-	state.Logger.Printf("Received event #%d: Type=%s, Device=%s, Channel=%s",
-		state.EventCount, event.EventType, event.DeviceID, event.ChannelID)
-
-	// Process the event based on type
-	processEvent(&event)
-
-	// Respond with success
-	w.WriteHeader(http.StatusOK)
-	response := map[string]interface{}{
-		"status":  "success",
-		"message": "Event processed successfully",
-		"eventId": state.EventCount,
-	}
-
-	json.NewEncoder(w).Encode(response)
-}
-
-// handleHikVisionAlarm processes alarm events from HIKVision devices
-func handleHikVisionAlarm(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost && r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("Only POST and GET methods are supported"))
-		return
-	}
-
-	// Check for specific HIK authentication if enabled
-	if state.Config.HikEnabled && state.Config.HikUsername != "" {
-		username, password, ok := r.BasicAuth()
-		if !ok || username != state.Config.HikUsername || password != state.Config.HikPassword {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Unauthorized for HIKVision integration"))
-			return
+// adminAuth protects endpoints that change the state of the service. Unlike
+// basicAuth it refuses changes when no credentials are configured, reading stays open.
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if state.Config.AuthUsername == "" || state.Config.AuthPassword == "" {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				authFailures.inc(r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("Changes require auth_username and auth_password to be configured"))
+				return
+			}
 		}
+		basicAuth(next)(w, r)
 	}
+}
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		state.Logger.Printf("Error reading HIKVision request body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	// Parse the XML alarm data
-	var hikAlarm HIKVisionAlarm
-	err = xml.Unmarshal(body, &hikAlarm)
-	if err != nil {
-		state.Logger.Printf("Error parsing HIKVision XML: %v", err)
-		state.Logger.Printf("Raw payload: %s", string(body))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	// Convert to our standard event format
-	event := convertHikVisionAlarm(hikAlarm, string(body))
-
-	// Log the event
-	state.EventCount++
-	state.Logger.Printf("Received HIKVision alarm #%d: Type=%s, Device=%s, Channel=%s",
-		state.EventCount, event.EventType, event.DeviceID, event.ChannelID)
-
-	// Process the event based on type
-	processEvent(&event)
+// healthCheck provides a simple endpoint to verify the service is running
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	eventCount := state.EventCount
+	state.mu.Unlock()
 
-	// Respond with success
-	w.WriteHeader(http.StatusOK)
 	response := map[string]interface{}{
-		"status":  "success",
-		"message": "HIKVision alarm processed successfully",
-		"eventId": state.EventCount,
+		"status":     "ok",
+		"eventCount": eventCount,
+		"uptime":     time.Since(startTime).String(),
 	}
 
-	// HIKVision may expect XML response, but most implementations work fine with JSON
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// convertHikVisionAlarm converts HIKVision alarm format to our standard event format
-func convertHikVisionAlarm(hikAlarm HIKVisionAlarm, rawXML string) HikVisionEvent {
-	// Parse the datetime from HIKVision format
-	eventTime, err := time.Parse("2006-01-02T15:04:05-07:00", hikAlarm.DateTime)
-	if err != nil {
-		// If standard format fails, try alternative formats
-		eventTime, err = time.Parse("2006-01-02T15:04:05Z", hikAlarm.DateTime)
-		if err != nil {
-			// If all parsing fails, use current time
-			eventTime = time.Now()
-		}
-	}
-
-	// Map HIKVision event types to standardized types
-	eventType := mapHikEventType(hikAlarm.EventType)
-
-	// Create device ID from IP if available
-	deviceID := fmt.Sprintf("HIK_%s", hikAlarm.IPAddress)
-	if hikAlarm.MacAddress != "" {
-		deviceID = fmt.Sprintf("HIK_%s", strings.ReplaceAll(hikAlarm.MacAddress, ":", ""))
-	}
-
-	// Create channel ID
-	channelID := fmt.Sprintf("Channel%d", hikAlarm.ChannelID)
-
-	// Create event details map
-	eventDetails := map[string]interface{}{
-		"source":       "HIKVision",
-		"ipAddress":    hikAlarm.IPAddress,
-		"description":  hikAlarm.EventDescription,
-		"state":        hikAlarm.EventState,
-		"macAddress":   hikAlarm.MacAddress,
-		"originalType": hikAlarm.EventType,
-	}
-
-	// Add optional fields if present
-	if hikAlarm.DetectionRegionID > 0 {
-		eventDetails["regionId"] = hikAlarm.DetectionRegionID
-	}
-
-	return HikVisionEvent{
-		EventType:    eventType,
-		EventTime:    eventTime,
-		DeviceID:     deviceID,
-		ChannelID:    channelID,
-		EventDetails: eventDetails,
-		RawXML:       rawXML,
+func main() {
+	startTime = time.Now()
+	fmt.Print("Starting NVR API...\n")
+	// Initialize configuration
+	if err := initConfig(); err != nil {
+		log.Fatalf("Failed to initialize configuration: %v", err)
 	}
-}
-
-// mapHikEventType converts HIKVision event types to our standardized types
-func mapHikEventType(hikType string) string {
-	// Map HIKVision event types to standardized types
-	// HIKVision has many event types, this is a simplified mapping
-	hikType = strings.ToLower(hikType)
 
-	switch {
-	case strings.Contains(hikType, "motion"):
-		return "MotionDetection"
-	case strings.Contains(hikType, "videoloss"):
-		return "VideoLoss"
-	case strings.Contains(hikType, "tamper") || strings.Contains(hikType, "shelteralarm"):
-		return "TamperDetection"
-	case strings.Contains(hikType, "disk"):
-		return "StorageFailure"
-	case strings.Contains(hikType, "line") || strings.Contains(hikType, "crossing"):
-		return "LineCrossing"
-	case strings.Contains(hikType, "intrusion"):
-		return "IntrusionDetection"
-	case strings.Contains(hikType, "face"):
-		return "FaceDetection"
-	case strings.Contains(hikType, "io") || strings.Contains(hikType, "alarm"):
-		return "IOAlarm"
-	case strings.Contains(hikType, "connection"):
-		return "DeviceConnection"
-	default:
-		return "UnknownEvent_" + hikType
+	// Build the ingest adapters from configuration
+	adapters, err := buildAdapters(state.Config.Adapters)
+	if err != nil {
+		log.Fatalf("Failed to initialize adapters: %v", err)
 	}
-}
-
-// processEvent handles different event types
-func processEvent(event interface{}) {
-	// Process based on event type
-	switch e := event.(type) {
-	case *VivotekEvent:
-		switch e.EventType {
-		case "MotionDetection":
-			handleMotionEvent(e)
-		case "VideoLoss":
-			handleVideoLossEvent(e)
-		case "DeviceConnection":
-			handleConnectionEvent(e)
-		default:
-			state.Logger.Printf("Unhandled Vivotek event type: %s", e.EventType)
-		}
 
-		// Forward to notification URL if configured
-		if state.Config.NotifyURL != "" {
-			forwardEvent(e)
-		}
-
-	case *HikVisionEvent:
-		switch e.EventType {
-		case "MotionDetection":
-			handleHikMotionEvent(e)
-		case "VideoLoss":
-			handleHikVideoLossEvent(e)
-		case "LineCrossing", "IntrusionDetection":
-			handleHikSmartEvent(e)
-		case "IOAlarm":
-			handleHikIOAlarmEvent(e)
-		case "DeviceConnection":
-			handleHikConnectionEvent(e)
-		default:
-			state.Logger.Printf("Unhandled HIKVision event type: %s", e.EventType)
-		}
-
-		// Forward to notification URL if configured
-		if state.Config.NotifyURL != "" {
-			forwardHikEvent(e)
-		}
+	// Build the notifiers from configuration
+	state.Notifiers, err = buildNotifiers(state.Config)
+	if err != nil {
+		log.Fatalf("Failed to initialize notifiers: %v", err)
 	}
-
-	// Send to Telegram if enabled
-	if state.Config.TelegramEnabled && state.Config.TelegramToken != "" && state.Config.TelegramChatID != "" {
-		sendTelegramNotification(event)
+	if err := startDispatch(state.Config, state.Notifiers); err != nil {
+		log.Fatalf("Failed to initialize dispatch queues: %v", err)
 	}
-}
-
-// handleMotionEvent processes motion detection events
-func handleMotionEvent(event *VivotekEvent) {
-	state.Logger.Printf("Motion detected on device %s, channel %s", event.DeviceID, event.ChannelID)
-	// Add custom processing for motion events
-}
-
-// handleVideoLossEvent processes video loss events
-func handleVideoLossEvent(event *VivotekEvent) {
-	state.Logger.Printf("Video lost on device %s, channel %s", event.DeviceID, event.ChannelID)
-	// Add custom processing for video loss events
-}
-
-// handleConnectionEvent processes device connection/disconnection events
-func handleConnectionEvent(event *VivotekEvent) {
-	state.Logger.Printf("Connection event for device %s", event.DeviceID)
-	// Add custom processing for connection events
-}
-
-// handleHikMotionEvent processes HIKVision motion detection events
-func handleHikMotionEvent(event *HikVisionEvent) {
-	state.Logger.Printf("HIKVision motion detected on device %s, channel %s", event.DeviceID, event.ChannelID)
-	// Add custom processing for HIKVision motion events
-}
-
-// handleHikVideoLossEvent processes HIKVision video loss events
-func handleHikVideoLossEvent(event *HikVisionEvent) {
-	state.Logger.Printf("HIKVision video lost on device %s, channel %s", event.DeviceID, event.ChannelID)
-	// Add custom processing for HIKVision video loss events
-}
-
-// handleHikSmartEvent processes HIKVision smart events (line crossing, intrusion)
-func handleHikSmartEvent(event *HikVisionEvent) {
-	state.Logger.Printf("HIKVision smart event %s on device %s, channel %s",
-		event.EventType, event.DeviceID, event.ChannelID)
-	// Add custom processing for HIKVision smart events
-}
 
-// handleHikIOAlarmEvent processes HIKVision IO alarm events
-func handleHikIOAlarmEvent(event *HikVisionEvent) {
-	state.Logger.Printf("HIKVision IO alarm on device %s, channel %s", event.DeviceID, event.ChannelID)
-	// Add custom processing for HIKVision IO events
-}
-
-// handleHikConnectionEvent processes HIKVision device connection events
-func handleHikConnectionEvent(event *HikVisionEvent) {
-	state.Logger.Printf("HIKVision connection event for device %s", event.DeviceID)
-	// Add custom processing for HIKVision connection events
-}
-
-// forwardEvent sends the event to a configured notification URL
-func forwardEvent(event *VivotekEvent) {
-	eventJSON, err := json.Marshal(event)
+	// Build the device inventory
+	state.Devices, err = buildDeviceRegistry(state.Config.Devices)
 	if err != nil {
-		state.Logger.Printf("Error serializing event for forwarding: %v", err)
-		return
+		log.Fatalf("Failed to initialize devices: %v", err)
 	}
 
-	resp, err := http.Post(state.Config.NotifyURL, "application/json", bytes.NewBuffer(eventJSON))
+	// Build the routing rules
+	state.Rules, err = buildRules(state.Config.Rules, state.Notifiers)
 	if err != nil {
-		state.Logger.Printf("Error forwarding event: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		state.Logger.Printf("Error response from notification URL: %d", resp.StatusCode)
+		log.Fatalf("Failed to initialize rules: %v", err)
 	}
-}
 
-// forwardHikEvent forwards HIKVision events to notification URL
-func forwardHikEvent(event *HikVisionEvent) {
-	eventJSON, err := json.Marshal(event)
+	// Build the arm schedules
+	state.Schedules, err = buildSchedules(state.Config.Schedules)
 	if err != nil {
-		state.Logger.Printf("Error serializing HIKVision event for forwarding: %v", err)
-		return
+		log.Fatalf("Failed to initialize schedules: %v", err)
 	}
 
-	resp, err := http.Post(state.Config.NotifyURL, "application/json", bytes.NewBuffer(eventJSON))
-	if err != nil {
-		state.Logger.Printf("Error forwarding HIKVision event: %v", err)
-		return
+	initHikEventTypes(state.Config.HikEventTypes)
+	if err := initIncidents(state.Config.Incidents); err != nil {
+		log.Fatalf("Failed to initialize incident tracking: %v", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		state.Logger.Printf("Error response from notification URL for HIKVision event: %d", resp.StatusCode)
+	if err := initCooldowns(state.Config.Cooldowns); err != nil {
+		log.Fatalf("Failed to initialize cooldowns: %v", err)
 	}
-}
-
-// sendTelegramNotification sends event information to a Telegram chat/bot
-func sendTelegramNotification(event interface{}) {
-	// Format the message based on event type
-	message := formatTelegramMessage(event)
-
-	// Construct the Telegram Bot API URL
-	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", state.Config.TelegramToken)
-
-	// Prepare the request data
-	data := url.Values{}
-	data.Set("chat_id", state.Config.TelegramChatID)
-	data.Set("text", message)
-	data.Set("parse_mode", "HTML") // Enable HTML formatting
-
-	// Send the request
-	resp, err := http.PostForm(apiURL, data)
-	if err != nil {
-		state.Logger.Printf("Error sending Telegram notification: %v", err)
-		return
+	if err := loadSilences(state.Config.SilencesFile); err != nil {
+		log.Fatalf("Failed to load silences: %v", err)
 	}
-	defer resp.Body.Close()
-
-	// Check for error response
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		state.Logger.Printf("Telegram API error: status=%d, response=%s", resp.StatusCode, string(body))
-	} else {
-		// Log success based on event type
-		switch e := event.(type) {
-		case *VivotekEvent:
-			state.Logger.Printf("Telegram notification sent successfully for Vivotek event type %s", e.EventType)
-		case *HikVisionEvent:
-			state.Logger.Printf("Telegram notification sent successfully for HIKVision event type %s", e.EventType)
-		default:
-			state.Logger.Printf("Telegram notification sent successfully for unknown event type")
-		}
+	if err := openEventStore(context.Background(), state.Config.EventStore); err != nil {
+		log.Fatalf("Failed to open event store: %v", err)
 	}
-}
-
-// formatTelegramMessage creates a human-readable message for Telegram
-func formatTelegramMessage(event interface{}) string {
-	var message string
-
-	switch e := event.(type) {
-	case *VivotekEvent:
-		// Basic message with event details
-		message = fmt.Sprintf("<b>🚨 NVR Alert</b>\n\n"+
-			"<b>Event:</b> %s\n"+
-			"<b>Time:</b> %s\n"+
-			"<b>Device:</b> %s\n"+
-			"<b>Channel:</b> %s\n",
-			e.EventType,
-			e.EventTime.Format("2006-01-02 15:04:05"),
-			e.DeviceID,
-			e.ChannelID)
-
-		// Add custom message based on event type
-		switch e.EventType {
-		case "MotionDetection":
-			message += "📹 <b>Motion detected!</b>"
-
-			// Add zone info if available
-			if zone, ok := e.EventDetails["zoneId"].(string); ok {
-				message += fmt.Sprintf(" (Zone: %s)", zone)
-			}
-
-		case "VideoLoss":
-			message += "⚠️ <b>Video signal lost!</b> Please check camera connection."
 
-		case "DeviceConnection":
-			if status, ok := e.EventDetails["status"].(string); ok && status == "disconnected" {
-				message += "❌ <b>Device disconnected!</b> Network issue possible."
-			} else {
-				message += "✅ <b>Device connected</b> and operating normally."
-			}
-
-		default:
-			// Add any available details for unknown event types
-			detailsJSON, _ := json.Marshal(e.EventDetails)
-			if len(detailsJSON) > 0 {
-				message += fmt.Sprintf("\n<pre>%s</pre>", string(detailsJSON))
-			}
-		}
-
-	case *HikVisionEvent:
-		// HIKVision specific formatting
-		message = fmt.Sprintf("<b>🔔 HIKVision Alarm</b>\n\n"+
-			"<b>Event:</b> %s\n"+
-			"<b>Time:</b> %s\n"+
-			"<b>Device:</b> %s\n"+
-			"<b>Channel:</b> %s\n",
-			e.EventType,
-			e.EventTime.Format("2006-01-02 15:04:05"),
-			e.DeviceID,
-			e.ChannelID)
-
-		// Add description if available
-		if desc, ok := e.EventDetails["description"].(string); ok && desc != "" {
-			message += fmt.Sprintf("<b>Description:</b> %s\n", desc)
-		}
-
-		// Add custom message based on event type
-		switch e.EventType {
-		case "MotionDetection":
-			message += "📹 <b>Motion detected!</b>"
-
-		case "LineCrossing":
-			message += "🚷 <b>Line crossing detected!</b>"
-
-		case "IntrusionDetection":
-			message += "🚨 <b>Intrusion detected!</b>"
-
-		case "FaceDetection":
-			message += "👤 <b>Face detected!</b>"
-
-		case "IOAlarm":
-			message += "🔌 <b>I/O Alarm triggered!</b>"
-
-		case "TamperDetection":
-			message += "⚠️ <b>Camera tampering detected!</b>"
-
-		case "VideoLoss":
-			message += "⚠️ <b>Video signal lost!</b>"
-
-		case "StorageFailure":
-			message += "💾 <b>Storage failure!</b> Check NVR hard drive."
-
-		default:
-			// For unknown events, include available details
-			if state, ok := e.EventDetails["state"].(string); ok {
-				message += fmt.Sprintf("\n<b>State:</b> %s", state)
-			}
-		}
+	// Start the pull-based ingest clients
+	if err := startONVIFClients(context.Background(), state.Config.ONVIFCameras); err != nil {
+		log.Fatalf("Failed to initialize ONVIF cameras: %v", err)
 	}
-
-	return message
-}
-
-// healthCheck provides a simple endpoint to verify the service is running
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	response := map[string]interface{}{
-		"status":     "ok",
-		"eventCount": state.EventCount,
-		"uptime":     time.Since(startTime).String(),
+	if err := startHikStreamClients(context.Background(), state.Config.HikDevices); err != nil {
+		log.Fatalf("Failed to initialize HIKVision devices: %v", err)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-func main() {
-	startTime = time.Now()
-	fmt.Print("Starting NVR API...\n")
-	// Initialize configuration
-	if err := initConfig(); err != nil {
-		log.Fatalf("Failed to initialize configuration: %v", err)
+	if err := startWatchdog(context.Background(), state.Config.Watchdog, state.Config.Devices); err != nil {
+		log.Fatalf("Failed to initialize watchdog: %v", err)
 	}
 
 	// Set up HTTP routes
-	http.HandleFunc("/health", healthCheck)
-	http.HandleFunc("/event", basicAuth(handleEvent))
-	http.HandleFunc("/events", basicAuth(handleEvent)) // Alternative endpoint
-
-	// Add HIKVision alarm server endpoint
-
-	http.HandleFunc("/hikvision/alarm", basicAuth(handleHikVisionAlarm))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthCheck)
+	mux.HandleFunc("/metrics", basicAuth(handleMetrics))
+	mux.HandleFunc("/api/notifiers", basicAuth(handleListNotifiers))
+	mux.HandleFunc("/api/notifiers/test", adminAuth(handleTestNotifier))
+	mux.HandleFunc("/api/onvif/subscriptions", basicAuth(handleONVIFSubscriptions))
+	mux.HandleFunc("/api/incidents", basicAuth(handleListIncidents))
+	mux.HandleFunc("/api/cooldowns", basicAuth(handleListCooldowns))
+	mux.HandleFunc("/api/rules", basicAuth(handleListRules))
+	mux.HandleFunc("/api/arm", adminAuth(handleArm(true)))
+	mux.HandleFunc("/api/disarm", adminAuth(handleArm(false)))
+	mux.HandleFunc("/api/silences", adminAuth(handleSilences))
+	mux.HandleFunc("/api/devices", basicAuth(handleListDevices))
+	mux.HandleFunc("/api/events", basicAuth(handleListEvents))
+	mux.HandleFunc("/api/admin/storage", adminAuth(handleStorage))
+	mux.HandleFunc("/api/admin/deadletters", adminAuth(handleDeadLetters))
+	mountAdapters(mux, adapters)
 
 	// Start the HTTP server
 	serverAddr := fmt.Sprintf(":%s", state.Config.ServerPort)
-	state.Logger.Printf("Starting NVR Event Handler API on %s", serverAddr)
+	state.Logger.Info("Starting NVR Event Handler API", "address", serverAddr)
 	fmt.Printf("Starting NVR Event Handler API on %s\n", serverAddr)
-	if err := http.ListenAndServe(serverAddr, nil); err != nil {
-		state.Logger.Fatalf("Failed to start server: %v", err)
+	if err := http.ListenAndServe(serverAddr, mux); err != nil {
+		state.Logger.Error("Failed to start server", "error", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	state.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// recordingNotifier is a notifier that keeps the events it was sent
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (n *recordingNotifier) Name() string { return "recorder" }
+func (n *recordingNotifier) Type() string { return "recorder" }
+
+func (n *recordingNotifier) Notify(ctx context.Context, event *Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, *event)
+	return nil
+}
+
+// received returns the events sent so far
+func (n *recordingNotifier) received() []Event {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Event(nil), n.events...)
+}
+
+// useRecordingNotifier makes a recording notifier the only notifier for the test
+func useRecordingNotifier(t *testing.T) *recordingNotifier {
+	notifier := &recordingNotifier{}
+	previous := state.Notifiers
+	state.Notifiers = []Notifier{notifier}
+	t.Cleanup(func() { state.Notifiers = previous })
+	return notifier
+}
+
+func TestAdminAuth(t *testing.T) {
+	previous := state.Config
+	t.Cleanup(func() { state.Config = previous })
+	handler := adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name        string
+		configured  bool
+		method      string
+		credentials bool
+		status      int
+	}{
+		{"read without credentials configured", false, http.MethodGet, false, http.StatusOK},
+		{"change without credentials configured", false, http.MethodPost, false, http.StatusForbidden},
+		{"delete without credentials configured", false, http.MethodDelete, true, http.StatusForbidden},
+		{"change without credentials", true, http.MethodPost, false, http.StatusUnauthorized},
+		{"change with credentials", true, http.MethodPost, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state.Config.AuthUsername, state.Config.AuthPassword = "", ""
+			if tt.configured {
+				state.Config.AuthUsername, state.Config.AuthPassword = "admin", "secret"
+			}
+			req := httptest.NewRequest(tt.method, "/api/arm", nil)
+			if tt.credentials {
+				req.SetBasicAuth("admin", "secret")
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
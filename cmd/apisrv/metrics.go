@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricFamily is one metric with all its label combinations, written in the
+// Prometheus text exposition format
+type metricFamily interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+// metricRegistry holds every metric exposed on /metrics
+var metricRegistry struct {
+	sync.Mutex
+	families []metricFamily
+}
+
+// registerMetric adds a metric to /metrics
+func registerMetric(family metricFamily) {
+	metricRegistry.Lock()
+	defer metricRegistry.Unlock()
+	metricRegistry.families = append(metricRegistry.families, family)
+}
+
+// Metrics updated along the event pipeline
+var (
+	// Devices are not a label, their number is not bounded
+	eventsReceived = newCounterVec("nvr_events_received_total",
+		"Events received by vendor and event type.", "vendor", "event_type")
+	parseFailures = newCounterVec("nvr_parse_failures_total",
+		"Payloads that could not be parsed, by endpoint or alertStream client.", "endpoint")
+	authFailures = newCounterVec("nvr_auth_failures_total",
+		"Requests rejected for missing or wrong credentials, by endpoint.", "endpoint")
+	notifierSends = newCounterVec("nvr_notifier_sends_total",
+		"Notifications sent successfully, by notifier.", "notifier", "type")
+	notifierFailures = newCounterVec("nvr_notifier_failures_total",
+		"Notifications that failed, by notifier.", "notifier", "type")
+	notifierDuration = newHistogramVec("nvr_notifier_duration_seconds",
+		"Time taken to send a notification, by notifier.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "notifier", "type")
+	eventsSuppressed = newCounterVec("nvr_events_suppressed_total",
+		"Events held back by a cooldown, by event type.", "event_type")
+	eventsSilenced = newCounterVec("nvr_events_silenced_total",
+		"Events not sent because of a silence, by event type.", "event_type")
+	eventsDisarmed = newCounterVec("nvr_events_disarmed_total",
+		"Events not sent because their site was disarmed, by event type.", "event_type")
+)
+
+func init() {
+	registerMetric(newGaugeFunc("nvr_uptime_seconds", "Time since the service started.", func() float64 {
+		return time.Since(startTime).Seconds()
+	}))
+	registerMetric(newGaugeFunc("nvr_open_incidents", "Incidents currently open.", func() float64 {
+		incidentTracker.Lock()
+		defer incidentTracker.Unlock()
+		return float64(len(incidentTracker.open))
+	}))
+	registerMetric(newGaugeFunc("nvr_devices_offline", "Watched devices currently reported offline.", func() float64 {
+		watchdog.Lock()
+		defer watchdog.Unlock()
+		offline := 0
+		for _, watched := range watchdog.devices {
+			if !watched.Online {
+				offline++
+			}
+		}
+		return float64(offline)
+	}))
+	registerMetric(newGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	}))
+	registerMetric(newGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", func() float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return float64(stats.Alloc)
+	}))
+}
+
+// counterVec is a counter partitioned by labels
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+// counterValue is the counter of one label combination
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// newCounterVec creates and registers a counter
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+	registerMetric(c)
+	return c
+}
+
+// inc increments the counter of the given label values
+func (c *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		c.values[key] = value
+	}
+	value.value++
+}
+
+func (c *counterVec) metricName() string { return c.name }
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		value := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, value.labelValues), formatFloat(value.value))
+	}
+}
+
+// histogramVec is a histogram partitioned by labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+// histogramValue is the histogram of one label combination; counts are per bucket, not cumulative
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// newHistogramVec creates and registers a histogram with the given upper bucket bounds
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+	registerMetric(h)
+	return h
+}
+
+// observe records one value for the given label values
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+			break
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+func (h *histogramVec) metricName() string { return h.name }
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		value := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += value.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(labels, append(append([]string(nil), value.labelValues...), formatFloat(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(labels, append(append([]string(nil), value.labelValues...), "+Inf")), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, value.labelValues), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, value.labelValues), value.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when scraped
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+// newGaugeFunc creates a gauge, register it with registerMetric
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, value: value}
+}
+
+func (g *gaugeFunc) metricName() string { return g.name }
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value()))
+}
+
+// gaugeVecFunc is a gauge partitioned by one label whose values are read when scraped
+type gaugeVecFunc struct {
+	name, help, label string
+	values            func() map[string]float64
+}
+
+// newGaugeVecFunc creates a labeled gauge, register it with registerMetric
+func newGaugeVecFunc(name, help, label string, values func() map[string]float64) *gaugeVecFunc {
+	return &gaugeVecFunc{name: name, help: help, label: label, values: values}
+}
+
+func (g *gaugeVecFunc) metricName() string { return g.name }
+
+func (g *gaugeVecFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.values()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels([]string{g.label}, []string{key}), formatFloat(values[key]))
+	}
+}
+
+// sortedKeys returns the keys of a map in order, for stable output
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelEscaper escapes label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders {name="value",...}, or nothing without labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// formatFloat renders a sample value
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// handleMetrics writes all metrics in the Prometheus text exposition format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+
+	metricRegistry.Lock()
+	families := append([]metricFamily(nil), metricRegistry.families...)
+	metricRegistry.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].metricName() < families[j].metricName() })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	for _, family := range families {
+		family.write(out)
+	}
+	out.Flush()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics returns the output of /metrics
+func scrapeMetrics(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", contentType)
+	}
+	return rec.Body.String()
+}
+
+// writeFamily returns the exposition of one metric
+func writeFamily(family metricFamily) string {
+	var b strings.Builder
+	family.write(&b)
+	return b.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	useRecordingNotifier(t)
+	ingestEvent(VendorVivotek, &Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam1"})
+	output := scrapeMetrics(t)
+
+	sample := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*"(,[a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*")*\})? \S+$`)
+	comment := regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) .+$`)
+	var families []string
+	helped := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if match := comment.FindStringSubmatch(line); match != nil {
+			if match[1] == "HELP" {
+				families = append(families, match[2])
+				helped[match[2]] = true
+			} else if !helped[match[2]] {
+				t.Errorf("got TYPE of %s before its HELP", match[2])
+			}
+			continue
+		}
+		if !sample.MatchString(line) {
+			t.Errorf("got invalid sample line %q", line)
+		}
+	}
+	if !sort.StringsAreSorted(families) {
+		t.Errorf("got families out of order: %v", families)
+	}
+
+	// Devices are no label of the received events
+	if !strings.Contains(output, `nvr_events_received_total{vendor="Vivotek",event_type="MotionDetection"} `) {
+		t.Error("got no received events by vendor and event type")
+	}
+	if strings.Contains(output, `device="cam1"`) {
+		t.Error("got a device label")
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for POST, want 405", rec.Code)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	counter := &counterVec{name: "test_total", help: "Test counter.", labels: []string{"endpoint"},
+		values: map[string]*counterValue{}}
+	counter.inc("/a\"b\\c\nd")
+	counter.inc("/a\"b\\c\nd")
+
+	want := "# HELP test_total Test counter.\n# TYPE test_total counter\n" +
+		`test_total{endpoint="/a\"b\\c\nd"} 2` + "\n"
+	if got := writeFamily(counter); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMetricsHistogramBuckets(t *testing.T) {
+	histogram := &histogramVec{name: "test_seconds", help: "Test histogram.", labels: []string{"notifier"},
+		buckets: []float64{0.5, 1, 5}, values: map[string]*histogramValue{}}
+	for _, v := range []float64{0.1, 0.5, 3, 4, 12} {
+		histogram.observe(v, "telegram")
+	}
+
+	// Every bucket counts the observations up to its bound, +Inf counts all
+	want := strings.Join([]string{
+		"# HELP test_seconds Test histogram.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{notifier="telegram",le="0.5"} 2`,
+		`test_seconds_bucket{notifier="telegram",le="1"} 2`,
+		`test_seconds_bucket{notifier="telegram",le="5"} 4`,
+		`test_seconds_bucket{notifier="telegram",le="+Inf"} 5`,
+		`test_seconds_sum{notifier="telegram"} 19.6`,
+		`test_seconds_count{notifier="telegram"} 5`,
+	}, "\n") + "\n"
+	if got := writeFamily(histogram); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NotifierConfig configures one named notifier instance
+type NotifierConfig struct {
+	Name string `json:"name"`
+	// Type selects the registered notifier, e.g. "webhook", "telegram" or "email"
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+	// Webhook settings
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// IncludeAttachments embeds attachment data as base64 in the webhook payload
+	IncludeAttachments bool `json:"include_attachments,omitempty"`
+	// Telegram settings
+	TelegramToken  string `json:"telegram_token,omitempty"`
+	TelegramChatID string `json:"telegram_chat_id,omitempty"`
+	// Email settings
+	SMTPHost     string   `json:"smtp_host,omitempty"`
+	SMTPPort     int      `json:"smtp_port,omitempty"`
+	SMTPUsername string   `json:"smtp_username,omitempty"`
+	SMTPPassword string   `json:"smtp_password,omitempty"`
+	EmailFrom    string   `json:"email_from,omitempty"`
+	EmailTo      []string `json:"email_to,omitempty"`
+	// Options holds notifier specific settings
+	Options map[string]interface{} `json:"options,omitempty"`
+	// Queue overrides the dispatch queue settings for this notifier
+	Queue *QueueConfig `json:"queue,omitempty"`
+}
+
+// Notifier delivers normalized events to an output
+type Notifier interface {
+	// Name returns the configured instance name
+	Name() string
+	// Type returns the notifier type, e.g. "webhook"
+	Type() string
+	// Notify delivers the event and reports any delivery failure. It gives up
+	// when ctx is done.
+	Notify(ctx context.Context, event *Event) error
+}
+
+// HTMLNotifier is implemented by notifiers that send messages as HTML. Rule
+// templates are rendered for them with html/template, escaping the event fields.
+type HTMLNotifier interface {
+	SendsHTML() bool
+}
+
+// NotifierFactory creates a notifier from its configuration
+type NotifierFactory func(cfg NotifierConfig) (Notifier, error)
+
+// notifierRegistry maps notifier types to their factories
+var notifierRegistry = map[string]NotifierFactory{}
+
+// registerNotifier makes a notifier type available to the configuration
+func registerNotifier(notifierType string, factory NotifierFactory) {
+	notifierRegistry[strings.ToLower(notifierType)] = factory
+}
+
+// legacyNotifierConfigs maps the top level notify_url and telegram settings to notifiers
+func legacyNotifierConfigs(cfg Config) []NotifierConfig {
+	var configs []NotifierConfig
+	if cfg.NotifyURL != "" {
+		configs = append(configs, NotifierConfig{
+			Name:    "webhook",
+			Type:    "webhook",
+			Enabled: true,
+			URL:     cfg.NotifyURL,
+		})
+	}
+	if cfg.TelegramEnabled && cfg.TelegramToken != "" && cfg.TelegramChatID != "" {
+		configs = append(configs, NotifierConfig{
+			Name:           "telegram",
+			Type:           "telegram",
+			Enabled:        true,
+			TelegramToken:  cfg.TelegramToken,
+			TelegramChatID: cfg.TelegramChatID,
+		})
+	}
+	return configs
+}
+
+// buildNotifiers creates all enabled notifiers from the configuration
+func buildNotifiers(cfg Config) ([]Notifier, error) {
+	configs := append(legacyNotifierConfigs(cfg), cfg.Notifiers...)
+
+	var notifiers []Notifier
+	names := map[string]bool{}
+	for _, notifierCfg := range configs {
+		if !notifierCfg.Enabled {
+			continue
+		}
+		if notifierCfg.Name == "" {
+			notifierCfg.Name = notifierCfg.Type
+		}
+		if names[notifierCfg.Name] {
+			return nil, fmt.Errorf("duplicate notifier name %q", notifierCfg.Name)
+		}
+		names[notifierCfg.Name] = true
+
+		factory, ok := notifierRegistry[strings.ToLower(notifierCfg.Type)]
+		if !ok {
+			return nil, fmt.Errorf("unknown notifier type %q for notifier %q", notifierCfg.Type, notifierCfg.Name)
+		}
+
+		notifier, err := factory(notifierCfg)
+		if err != nil {
+			return nil, fmt.Errorf("error creating notifier %q: %v", notifierCfg.Name, err)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	return notifiers, nil
+}
+
+// findNotifier returns the configured notifier with the given name
+func findNotifier(name string) Notifier {
+	return findNotifierIn(state.Notifiers, name)
+}
+
+// findNotifierIn returns the notifier with the given name from the list
+func findNotifierIn(notifiers []Notifier, name string) Notifier {
+	for _, notifier := range notifiers {
+		if notifier.Name() == name {
+			return notifier
+		}
+	}
+	return nil
+}
+
+// notifyAll queues the event for every configured notifier
+func notifyAll(event *Event) {
+	for _, notifier := range state.Notifiers {
+		queueNotification(notifier, event)
+	}
+}
+
+// sendNotification delivers the event to one notifier and logs the outcome
+func sendNotification(ctx context.Context, notifier Notifier, event *Event) error {
+	started := time.Now()
+	err := notifier.Notify(ctx, event)
+	notifierDuration.observe(time.Since(started).Seconds(), notifier.Name(), notifier.Type())
+	if err != nil {
+		notifierFailures.inc(notifier.Name(), notifier.Type())
+		event.logger().Error("Error sending notification",
+			"notifier", notifier.Name(), "notifierType", notifier.Type(), "error", err)
+		return err
+	}
+	notifierSends.inc(notifier.Name(), notifier.Type())
+	event.logger().Info("Notification sent", "notifier", notifier.Name(), "notifierType", notifier.Type())
+	return nil
+}
+
+// handleListNotifiers lists the configured notifiers
+func handleListNotifiers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+
+	notifiers := make([]map[string]interface{}, 0, len(state.Notifiers))
+	for _, notifier := range state.Notifiers {
+		info := map[string]interface{}{
+			"name": notifier.Name(),
+			"type": notifier.Type(),
+		}
+		if queue, ok := dispatchQueues[notifier.Name()]; ok {
+			info["queued"] = len(queue.deliveries)
+			info["queueSize"] = cap(queue.deliveries)
+			info["retrying"] = queue.retrying()
+			info["overload"] = queue.overload
+		}
+		notifiers = append(notifiers, info)
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		return notifiers[i]["name"].(string) < notifiers[j]["name"].(string)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"notifiers": notifiers})
+}
+
+// handleTestNotifier sends a synthetic test event to a single notifier
+func handleTestNotifier(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only POST method is supported"))
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	notifier := findNotifier(name)
+	if notifier == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Notifier %q not found", name)))
+		return
+	}
+
+	event := Event{
+		Vendor:    "Test",
+		EventType: "TestNotification",
+		DeviceID:  "nvr-notify-api",
+		ChannelID: "test",
+		EventDetails: map[string]interface{}{
+			"description": fmt.Sprintf("Test notification for %s", notifier.Name()),
+		},
+	}
+	normalizeEvent(&event)
+	event.CorrelationID = newCorrelationID()
+
+	response := map[string]interface{}{
+		"status":   "success",
+		"notifier": notifier.Name(),
+		"time":     time.Now(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// The test bypasses the queue to report the outcome
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	if err := sendNotification(ctx, notifier, &event); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response["status"] = "error"
+		response["error"] = err.Error()
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ONVIFSimpleItem is a name/value pair inside an ONVIF message Source, Key or Data block
+type ONVIFSimpleItem struct {
+	Name  string `xml:"Name,attr" json:"name"`
+	Value string `xml:"Value,attr" json:"value"`
+}
+
+// ONVIFItemList holds the SimpleItems of a Source, Key or Data block
+type ONVIFItemList struct {
+	SimpleItems []ONVIFSimpleItem `xml:"SimpleItem"`
+}
+
+// ONVIFMessage is the tt:Message payload of a notification
+type ONVIFMessage struct {
+	UtcTime           string        `xml:"UtcTime,attr"`
+	PropertyOperation string        `xml:"PropertyOperation,attr"`
+	Source            ONVIFItemList `xml:"Source"`
+	Key               ONVIFItemList `xml:"Key"`
+	Data              ONVIFItemList `xml:"Data"`
+}
+
+// ONVIFNotificationMessage is a wsnt:NotificationMessage as used by ONVIF event
+// services and by Axis VAPIX event streams
+type ONVIFNotificationMessage struct {
+	Topic             string `xml:"Topic"`
+	ProducerReference struct {
+		Address string `xml:"Address"`
+	} `xml:"ProducerReference"`
+	Message struct {
+		Message ONVIFMessage `xml:"Message"`
+	} `xml:"Message"`
+}
+
+// onvifTopicTypes maps ONVIF and vendor topics, without namespace prefixes, to our
+// standardized types. Topics match exactly or by path prefix.
+var onvifTopicTypes = []struct {
+	topic     string
+	eventType string
+}{
+	{"VideoSource/MotionAlarm", "MotionDetection"},
+	{"RuleEngine/CellMotionDetector/Motion", "MotionDetection"},
+	{"RuleEngine/MotionRegionDetector/Motion", "MotionDetection"},
+	{"CameraApplicationPlatform/VMD", "MotionDetection"},
+	{"VideoSource/GlobalSceneChange", "TamperDetection"},
+	{"VideoSource/ImageTooBlurry", "TamperDetection"},
+	{"VideoSource/ImageTooDark", "TamperDetection"},
+	{"VideoSource/ImageTooBright", "TamperDetection"},
+	{"RuleEngine/TamperDetector/Tamper", "TamperDetection"},
+	{"VideoSource/Tampering", "TamperDetection"},
+	{"VideoSource/SignalLoss", "VideoLoss"},
+	{"VideoSource/ABR", "VideoLoss"},
+	{"RuleEngine/LineDetector/Crossed", "LineCrossing"},
+	{"CameraApplicationPlatform/CrossLineDetection", "LineCrossing"},
+	{"RuleEngine/FieldDetector/ObjectsInside", "IntrusionDetection"},
+	{"CameraApplicationPlatform/FenceGuard", "IntrusionDetection"},
+	{"RuleEngine/MyRuleDetector/FaceDetect", "FaceDetection"},
+	{"Device/Trigger/DigitalInput", "IOAlarm"},
+	{"Device/IO/Port", "IOAlarm"},
+	{"Device/IO/VirtualInput", "IOAlarm"},
+	{"Device/Trigger/Relay", "IOAlarm"},
+	{"Device/HardwareFailure/StorageFailure", "StorageFailure"},
+	{"Storage/Disruption", "StorageFailure"},
+}
+
+// onvifStateItems lists the Data items that carry the on/off state of a topic
+var onvifStateItems = []string{"State", "IsMotion", "active", "LogicalState", "IsTamper", "IsInside", "Triggered", "Signal"}
+
+// onvifChannelItems lists the Source items that identify the video source or input
+var onvifChannelItems = []string{"VideoSourceConfigurationToken", "VideoSourceToken", "VideoSource", "Source", "channel", "InputToken", "port"}
+
+// stripTopicPrefixes removes namespace prefixes like tns1: or tnsaxis: from every topic segment
+func stripTopicPrefixes(topic string) string {
+	segments := strings.Split(strings.TrimSpace(topic), "/")
+	for i, segment := range segments {
+		if _, local, ok := strings.Cut(segment, ":"); ok {
+			segments[i] = local
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// mapONVIFTopic converts an ONVIF topic to our standardized types
+func mapONVIFTopic(topic string) string {
+	stripped := stripTopicPrefixes(topic)
+	for _, entry := range onvifTopicTypes {
+		if strings.EqualFold(stripped, entry.topic) || strings.HasPrefix(strings.ToLower(stripped), strings.ToLower(entry.topic)+"/") {
+			return entry.eventType
+		}
+	}
+	return "UnknownEvent_" + strings.ToLower(stripped)
+}
+
+// onvifItemValue returns the value of the first matching SimpleItem
+func onvifItemValue(items []ONVIFSimpleItem, names ...string) (string, bool) {
+	for _, name := range names {
+		for _, item := range items {
+			if strings.EqualFold(item.Name, name) {
+				return item.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// onvifBool interprets ONVIF boolean-like values ("true", "1", "active")
+func onvifBool(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1", "active", "on":
+		return true
+	}
+	return false
+}
+
+// onvifChannelID builds our channel ID from a source token
+func onvifChannelID(token string) string {
+	if token == "" {
+		return "Channel1"
+	}
+	if n, err := strconv.Atoi(token); err == nil {
+		return fmt.Sprintf("Channel%d", n)
+	}
+	return token
+}
+
+// decodeONVIFNotifications extracts every NotificationMessage from an XML document,
+// regardless of the envelope (SOAP Notify, PullMessages response, VAPIX MetadataStream)
+func decodeONVIFNotifications(body []byte) ([]ONVIFNotificationMessage, error) {
+	var messages []ONVIFNotificationMessage
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing notification XML: %v", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "NotificationMessage" {
+			continue
+		}
+
+		var msg ONVIFNotificationMessage
+		if err := decoder.DecodeElement(&msg, &start); err != nil {
+			return nil, fmt.Errorf("error parsing NotificationMessage: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// convertONVIFNotification converts an ONVIF notification message to our standard event format
+func convertONVIFNotification(msg ONVIFNotificationMessage, vendor, deviceID, rawPayload string) Event {
+	message := msg.Message.Message
+
+	eventTime, err := time.Parse(time.RFC3339, message.UtcTime)
+	if err != nil {
+		eventTime = time.Now()
+	}
+
+	eventDetails := map[string]interface{}{
+		"source":       vendor,
+		"originalType": strings.TrimSpace(msg.Topic),
+	}
+	if message.PropertyOperation != "" {
+		eventDetails["propertyOperation"] = message.PropertyOperation
+	}
+	if msg.ProducerReference.Address != "" {
+		eventDetails["producer"] = msg.ProducerReference.Address
+	}
+	for _, items := range [][]ONVIFSimpleItem{message.Source.SimpleItems, message.Key.SimpleItems, message.Data.SimpleItems} {
+		for _, item := range items {
+			eventDetails[item.Name] = item.Value
+		}
+	}
+
+	// Without a state item the notification itself is the trigger
+	eventState := EventStateActive
+	if value, ok := onvifItemValue(message.Data.SimpleItems, onvifStateItems...); ok && !onvifBool(value) {
+		eventState = EventStateInactive
+	}
+
+	token, _ := onvifItemValue(message.Source.SimpleItems, onvifChannelItems...)
+
+	return Event{
+		Vendor:       vendor,
+		EventType:    mapONVIFTopic(msg.Topic),
+		EventTime:    eventTime,
+		ReceivedAt:   time.Now(),
+		DeviceID:     deviceID,
+		ChannelID:    onvifChannelID(token),
+		State:        eventState,
+		EventDetails: eventDetails,
+		Raw:          rawPayload,
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Vendor name for events received through the generic ONVIF event service
+const VendorONVIF = "ONVIF"
+
+// ONVIF camera modes
+const (
+	ONVIFModePull = "pull"
+	ONVIFModePush = "push"
+)
+
+// ONVIFCameraConfig configures one camera subscribed through the ONVIF event service
+type ONVIFCameraConfig struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Mode is "pull" (PullPoint subscription, default) or "push" (WS-BaseNotification Subscribe)
+	Mode string `json:"mode,omitempty"`
+	// ConsumerURL is the URL of our /onvif/notify endpoint as reachable by the camera, push mode only
+	ConsumerURL string `json:"consumer_url,omitempty"`
+	// DeviceID used for events, defaults to ONVIF_<host>
+	DeviceID string `json:"device_id,omitempty"`
+	// EventServiceURL is the event service XAddr, e.g. http://192.168.1.10/onvif/event_service
+	EventServiceURL string `json:"event_service_url"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	// SubscriptionTime is the requested subscription lifetime, defaults to 60s
+	SubscriptionTime string `json:"subscription_time,omitempty"`
+	// PullTimeout is how long a PullMessages call may wait for events, defaults to 10s
+	PullTimeout  string `json:"pull_timeout,omitempty"`
+	MessageLimit int    `json:"message_limit,omitempty"`
+}
+
+// onvifSubscriptionResponse holds the fields of CreatePullPointSubscriptionResponse and RenewResponse
+type onvifSubscriptionResponse struct {
+	SubscriptionReference soapEndpointReference `xml:"SubscriptionReference"`
+	CurrentTime           string                `xml:"CurrentTime"`
+	TerminationTime       string                `xml:"TerminationTime"`
+}
+
+// onvifPullClient keeps a PullPoint subscription alive and feeds its messages into the event pipeline
+type onvifPullClient struct {
+	cfg              ONVIFCameraConfig
+	deviceID         string
+	host             string
+	soap             *soapClient
+	subscriptionTime time.Duration
+	pullTimeout      time.Duration
+}
+
+// startONVIFClients starts a background pull client or push subscriber for every enabled camera
+func startONVIFClients(ctx context.Context, configs []ONVIFCameraConfig) error {
+	for _, cfg := range configs {
+		if !cfg.Enabled {
+			continue
+		}
+
+		switch strings.ToLower(cfg.Mode) {
+		case "", ONVIFModePull:
+			client, err := newONVIFPullClient(cfg)
+			if err != nil {
+				return fmt.Errorf("error creating ONVIF client %q: %v", cfg.Name, err)
+			}
+
+			state.Logger.Info("Starting ONVIF pull client", "client", cfg.Name, "url", cfg.EventServiceURL)
+			go client.run(ctx)
+
+		case ONVIFModePush:
+			subscriber, err := newONVIFPushSubscriber(cfg)
+			if err != nil {
+				return fmt.Errorf("error creating ONVIF subscriber %q: %v", cfg.Name, err)
+			}
+
+			state.Logger.Info("Starting ONVIF push subscriber", "client", cfg.Name, "url", cfg.EventServiceURL)
+			go subscriber.run(ctx)
+
+		default:
+			return fmt.Errorf("unknown mode %q for ONVIF camera %q", cfg.Mode, cfg.Name)
+		}
+	}
+	return nil
+}
+
+// newONVIFPullClient validates the camera configuration and creates its client
+func newONVIFPullClient(cfg ONVIFCameraConfig) (*onvifPullClient, error) {
+	serviceURL, err := url.Parse(cfg.EventServiceURL)
+	if err != nil || serviceURL.Host == "" {
+		return nil, fmt.Errorf("invalid event_service_url %q", cfg.EventServiceURL)
+	}
+
+	subscriptionTime, err := parseDurationDefault(cfg.SubscriptionTime, 60*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription_time: %v", err)
+	}
+	pullTimeout, err := parseDurationDefault(cfg.PullTimeout, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pull_timeout: %v", err)
+	}
+	if cfg.MessageLimit <= 0 {
+		cfg.MessageLimit = 100
+	}
+
+	deviceID := cfg.DeviceID
+	if deviceID == "" {
+		deviceID = fmt.Sprintf("ONVIF_%s", serviceURL.Hostname())
+	}
+
+	return &onvifPullClient{
+		cfg:      cfg,
+		deviceID: deviceID,
+		host:     serviceURL.Hostname(),
+		soap: &soapClient{
+			// PullMessages blocks on the device for up to pullTimeout
+			httpClient: &http.Client{Timeout: pullTimeout + 10*time.Second},
+			username:   cfg.Username,
+			password:   cfg.Password,
+		},
+		subscriptionTime: subscriptionTime,
+		pullTimeout:      pullTimeout,
+	}, nil
+}
+
+// parseDurationDefault parses a Go duration string, returning def when empty
+func parseDurationDefault(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// run subscribes and pulls until the context ends, resubscribing with backoff on errors
+func (c *onvifPullClient) run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := c.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A session that ran for a while was healthy, start over with a short backoff
+		if time.Since(started) > c.subscriptionTime {
+			backoff = time.Second
+		}
+		state.Logger.Warn("ONVIF pull client failed, resubscribing", "client", c.cfg.Name, "error", err,
+			"backoff", backoff.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// session runs one subscription from creation until the first error
+func (c *onvifPullClient) session(ctx context.Context) error {
+	subscription, terminationTime, err := c.createSubscription()
+	if err != nil {
+		return fmt.Errorf("CreatePullPointSubscription failed: %v", err)
+	}
+	defer c.unsubscribe(subscription)
+	state.Logger.Info("ONVIF pull client subscribed", "client", c.cfg.Name, "address", subscription.Address)
+
+	for ctx.Err() == nil {
+		// Renew once half of the subscription lifetime has passed
+		if time.Until(terminationTime) < c.subscriptionTime/2 {
+			terminationTime, err = c.renew(subscription)
+			if err != nil {
+				return fmt.Errorf("Renew failed: %v", err)
+			}
+		}
+
+		messages, raw, err := c.pullMessages(subscription)
+		if err != nil {
+			return fmt.Errorf("PullMessages failed: %v", err)
+		}
+		// A successful pull proves the camera is alive, even when it returned nothing
+		recordHeartbeat(&Event{Vendor: VendorONVIF, DeviceID: c.deviceID})
+
+		for _, msg := range messages {
+			// Initialized messages only report the current state after (re)subscribing
+			if strings.EqualFold(msg.Message.Message.PropertyOperation, "Initialized") {
+				continue
+			}
+			event := convertONVIFNotification(msg, VendorONVIF, c.deviceID, raw)
+			setEventIP(&event, c.host)
+			ingestEvent(VendorONVIF, &event)
+		}
+	}
+	return nil
+}
+
+// createSubscription creates a PullPoint subscription on the event service
+func (c *onvifPullClient) createSubscription() (soapEndpointReference, time.Time, error) {
+	body := fmt.Sprintf(`<tev:CreatePullPointSubscription>`+
+		`<tev:InitialTerminationTime>%s</tev:InitialTerminationTime>`+
+		`</tev:CreatePullPointSubscription>`, onvifDuration(c.subscriptionTime))
+
+	service := soapEndpointReference{Address: c.cfg.EventServiceURL}
+	respBody, err := c.soap.call(service,
+		"http://www.onvif.org/ver10/events/wsdl/EventPortType/CreatePullPointSubscriptionRequest", body)
+	if err != nil {
+		return soapEndpointReference{}, time.Time{}, err
+	}
+
+	var resp onvifSubscriptionResponse
+	if err := xml.Unmarshal(respBody, &resp); err != nil {
+		return soapEndpointReference{}, time.Time{}, fmt.Errorf("error parsing response: %v", err)
+	}
+	if resp.SubscriptionReference.Address == "" {
+		return soapEndpointReference{}, time.Time{}, fmt.Errorf("response has no subscription address")
+	}
+
+	return resp.SubscriptionReference, c.terminationTime(resp), nil
+}
+
+// renew extends the subscription lifetime
+func (c *onvifPullClient) renew(subscription soapEndpointReference) (time.Time, error) {
+	return onvifRenew(c.soap, subscription, c.subscriptionTime)
+}
+
+// pullMessages waits for pending notifications on the subscription
+func (c *onvifPullClient) pullMessages(subscription soapEndpointReference) ([]ONVIFNotificationMessage, string, error) {
+	body := fmt.Sprintf(`<tev:PullMessages>`+
+		`<tev:Timeout>%s</tev:Timeout>`+
+		`<tev:MessageLimit>%d</tev:MessageLimit>`+
+		`</tev:PullMessages>`, onvifDuration(c.pullTimeout), c.cfg.MessageLimit)
+
+	respBody, err := c.soap.call(subscription,
+		"http://www.onvif.org/ver10/events/wsdl/PullPointSubscription/PullMessagesRequest", body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	messages, err := decodeONVIFNotifications(respBody)
+	if err != nil {
+		return nil, "", err
+	}
+	return messages, string(respBody), nil
+}
+
+// unsubscribe releases the subscription on the device, errors are only logged
+func (c *onvifPullClient) unsubscribe(subscription soapEndpointReference) {
+	if err := onvifUnsubscribe(c.soap, subscription); err != nil {
+		state.Logger.Warn("ONVIF pull client Unsubscribe failed", "client", c.cfg.Name, "error", err)
+	}
+}
+
+// terminationTime converts the device termination time to local time
+func (c *onvifPullClient) terminationTime(resp onvifSubscriptionResponse) time.Time {
+	return localTerminationTime(resp, c.subscriptionTime)
+}
+
+// onvifRenew extends a subscription by lifetime and returns the new local termination time
+func onvifRenew(soap *soapClient, subscription soapEndpointReference, lifetime time.Duration) (time.Time, error) {
+	body := fmt.Sprintf(`<wsnt:Renew><wsnt:TerminationTime>%s</wsnt:TerminationTime></wsnt:Renew>`,
+		onvifDuration(lifetime))
+
+	respBody, err := soap.call(subscription, "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/RenewRequest", body)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var resp onvifSubscriptionResponse
+	if err := xml.Unmarshal(respBody, &resp); err != nil {
+		return time.Time{}, fmt.Errorf("error parsing response: %v", err)
+	}
+	return localTerminationTime(resp, lifetime), nil
+}
+
+// onvifUnsubscribe releases a subscription on the device
+func onvifUnsubscribe(soap *soapClient, subscription soapEndpointReference) error {
+	_, err := soap.call(subscription, "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/UnsubscribeRequest",
+		`<wsnt:Unsubscribe/>`)
+	return err
+}
+
+// localTerminationTime converts the device termination time to local time, so clock
+// drift between the device and this server does not matter
+func localTerminationTime(resp onvifSubscriptionResponse, lifetime time.Duration) time.Time {
+	current, errCurrent := time.Parse(time.RFC3339, strings.TrimSpace(resp.CurrentTime))
+	termination, errTermination := time.Parse(time.RFC3339, strings.TrimSpace(resp.TerminationTime))
+	if errCurrent != nil || errTermination != nil || !termination.After(current) {
+		return time.Now().Add(lifetime)
+	}
+	return time.Now().Add(termination.Sub(current))
+}
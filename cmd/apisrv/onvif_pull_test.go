@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// soapRequest is the part of a request envelope the stand-in checks
+type soapRequest struct {
+	Header struct {
+		Security struct {
+			UsernameToken struct {
+				Username string `xml:"Username"`
+				Password string `xml:"Password"`
+				Nonce    string `xml:"Nonce"`
+				Created  string `xml:"Created"`
+			} `xml:"UsernameToken"`
+		} `xml:"Security"`
+		Action         string `xml:"Action"`
+		SubscriptionID string `xml:"SubscriptionId"`
+	} `xml:"Header"`
+}
+
+// onvifStandIn is a local ONVIF event service with one PullPoint subscription
+type onvifStandIn struct {
+	server   *httptest.Server
+	username string
+	password string
+	// messages are returned by the first PullMessages, later pulls fail
+	messages string
+
+	mu      sync.Mutex
+	actions []string
+	pulls   int
+}
+
+func newONVIFStandIn(t *testing.T, username, password, messages string) *onvifStandIn {
+	standIn := &onvifStandIn{username: username, password: password, messages: messages}
+	standIn.server = httptest.NewServer(http.HandlerFunc(standIn.serve))
+	t.Cleanup(standIn.server.Close)
+	return standIn
+}
+
+// calls returns the actions received so far, without their namespace
+func (s *onvifStandIn) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.actions...)
+}
+
+func (s *onvifStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req soapRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		s.fault(w, "env:Sender", fmt.Sprintf("invalid envelope: %v", err))
+		return
+	}
+
+	// PasswordDigest = Base64(SHA1(nonce + created + password))
+	token := req.Header.Security.UsernameToken
+	nonce, _ := base64.StdEncoding.DecodeString(token.Nonce)
+	hash := sha1.New()
+	hash.Write(nonce)
+	hash.Write([]byte(token.Created))
+	hash.Write([]byte(s.password))
+	if token.Username != s.username || token.Password != base64.StdEncoding.EncodeToString(hash.Sum(nil)) {
+		s.fault(w, "ter:NotAuthorized", "Sender not authorized")
+		return
+	}
+
+	action := req.Header.Action[strings.LastIndex(req.Header.Action, "/")+1:]
+	s.mu.Lock()
+	s.actions = append(s.actions, action)
+	pulls := s.pulls
+	if action == "PullMessagesRequest" {
+		s.pulls++
+	}
+	s.mu.Unlock()
+
+	// Requests to the subscription must echo its reference parameters
+	if r.URL.Path == "/subscription" && req.Header.SubscriptionID != "42" {
+		s.fault(w, "env:Sender", "unknown subscription")
+		return
+	}
+
+	now := time.Now().UTC()
+	switch action {
+	case "CreatePullPointSubscriptionRequest":
+		// A short lifetime makes the client renew before its first pull
+		s.respond(w, fmt.Sprintf(`<tev:CreatePullPointSubscriptionResponse>`+
+			`<tev:SubscriptionReference><wsa:Address>%s/subscription</wsa:Address>`+
+			`<wsa:ReferenceParameters><dom0:SubscriptionId xmlns:dom0="http://example.com/standin">42</dom0:SubscriptionId></wsa:ReferenceParameters>`+
+			`</tev:SubscriptionReference>`+
+			`<wsnt:CurrentTime>%s</wsnt:CurrentTime><wsnt:TerminationTime>%s</wsnt:TerminationTime>`+
+			`</tev:CreatePullPointSubscriptionResponse>`,
+			s.server.URL, now.Format(time.RFC3339), now.Add(10*time.Second).Format(time.RFC3339)))
+	case "RenewRequest":
+		s.respond(w, fmt.Sprintf(`<wsnt:RenewResponse>`+
+			`<wsnt:TerminationTime>%s</wsnt:TerminationTime><wsnt:CurrentTime>%s</wsnt:CurrentTime>`+
+			`</wsnt:RenewResponse>`, now.Add(time.Minute).Format(time.RFC3339), now.Format(time.RFC3339)))
+	case "PullMessagesRequest":
+		if pulls > 0 {
+			s.fault(w, "env:Receiver", "subscription gone")
+			return
+		}
+		s.respond(w, `<tev:PullMessagesResponse>`+s.messages+`</tev:PullMessagesResponse>`)
+	case "UnsubscribeRequest":
+		s.respond(w, `<wsnt:UnsubscribeResponse/>`)
+	default:
+		s.fault(w, "env:Sender", "unknown action "+action)
+	}
+}
+
+func (s *onvifStandIn) respond(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<env:Envelope xmlns:env="%s" xmlns:wsa="%s" xmlns:wsnt="%s" xmlns:tev="%s" xmlns:tt="http://www.onvif.org/ver10/schema" xmlns:tns1="http://www.onvif.org/ver10/topics">`+
+		`<env:Body>%s</env:Body></env:Envelope>`, soapEnvelopeNS, wsaNS, wsntNS, tevNS, body)
+}
+
+func (s *onvifStandIn) fault(w http.ResponseWriter, subcode, reason string) {
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<env:Envelope xmlns:env="%s" xmlns:ter="http://www.onvif.org/ver10/error"><env:Body><env:Fault>`+
+		`<env:Code><env:Value>env:Sender</env:Value><env:Subcode><env:Value>%s</env:Value></env:Subcode></env:Code>`+
+		`<env:Reason><env:Text xml:lang="en">%s</env:Text></env:Reason>`+
+		`</env:Fault></env:Body></env:Envelope>`, soapEnvelopeNS, subcode, reason)
+}
+
+// onvifMotionMessage returns a cell motion NotificationMessage
+func onvifMotionMessage(operation string, motion bool) string {
+	return fmt.Sprintf(`<wsnt:NotificationMessage>`+
+		`<wsnt:Topic Dialect="http://www.onvif.org/ver10/tev/topicExpression/ConcreteSet">tns1:RuleEngine/CellMotionDetector/Motion</wsnt:Topic>`+
+		`<wsnt:Message><tt:Message UtcTime="2026-03-01T08:00:00Z" PropertyOperation="%s">`+
+		`<tt:Source><tt:SimpleItem Name="VideoSourceConfigurationToken" Value="2"/></tt:Source>`+
+		`<tt:Data><tt:SimpleItem Name="IsMotion" Value="%t"/></tt:Data>`+
+		`</tt:Message></wsnt:Message>`+
+		`</wsnt:NotificationMessage>`, operation, motion)
+}
+
+func TestONVIFPullSession(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	standIn := newONVIFStandIn(t, "admin", "secret",
+		onvifMotionMessage("Initialized", true)+onvifMotionMessage("Changed", true))
+
+	client, err := newONVIFPullClient(ONVIFCameraConfig{
+		Name:            "standin",
+		DeviceID:        "ONVIF_standin",
+		EventServiceURL: standIn.server.URL + "/onvif/event_service",
+		Username:        "admin",
+		Password:        "secret",
+		PullTimeout:     "1s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.session(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "PullMessages failed") {
+		t.Fatalf("got session error %v, want the failed second pull", err)
+	}
+
+	want := []string{"CreatePullPointSubscriptionRequest", "RenewRequest", "PullMessagesRequest",
+		"PullMessagesRequest", "UnsubscribeRequest"}
+	if got := standIn.calls(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got calls %v, want %v", got, want)
+	}
+
+	// The Initialized message only reports the state after subscribing
+	events := notifier.received()
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want only the Changed one: %+v", len(events), events)
+	}
+	event := events[0]
+	if event.Vendor != VendorONVIF || event.DeviceID != "ONVIF_standin" || event.EventType != "MotionDetection" ||
+		event.State != EventStateActive || event.ChannelID != "Channel2" {
+		t.Errorf("got event %s/%s/%s/%s/%s", event.Vendor, event.DeviceID, event.EventType, event.State, event.ChannelID)
+	}
+}
+
+func TestONVIFPullWrongPassword(t *testing.T) {
+	standIn := newONVIFStandIn(t, "admin", "secret", "")
+
+	client, err := newONVIFPullClient(ONVIFCameraConfig{
+		Name:            "standin",
+		EventServiceURL: standIn.server.URL + "/onvif/event_service",
+		Username:        "admin",
+		Password:        "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = client.createSubscription()
+	if err == nil || !strings.Contains(err.Error(), "NotAuthorized") {
+		t.Fatalf("got %v, want a NotAuthorized fault", err)
+	}
+	if calls := standIn.calls(); len(calls) != 0 {
+		t.Errorf("got calls %v, want none accepted", calls)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// onvifPushStatus is the bookkeeping record of one push subscription
+type onvifPushStatus struct {
+	Camera              string    `json:"camera"`
+	DeviceID            string    `json:"deviceId"`
+	EventServiceURL     string    `json:"eventServiceUrl,omitempty"`
+	ConsumerURL         string    `json:"consumerUrl,omitempty"`
+	SubscriptionAddress string    `json:"subscriptionAddress,omitempty"`
+	Subscribed          bool      `json:"subscribed"`
+	TerminationTime     time.Time `json:"terminationTime,omitempty"`
+	LastRenewal         time.Time `json:"lastRenewal,omitempty"`
+	LastNotify          time.Time `json:"lastNotify,omitempty"`
+	NotifyCount         int       `json:"notifyCount"`
+	LastError           string    `json:"lastError,omitempty"`
+	// token authenticates the Notify requests of the subscription
+	token string
+}
+
+// onvifPushRegistry keeps the push subscription status per device ID
+var onvifPushRegistry = struct {
+	sync.Mutex
+	byDevice map[string]*onvifPushStatus
+}{byDevice: map[string]*onvifPushStatus{}}
+
+// updateONVIFPushStatus applies a change to the status record of a device
+func updateONVIFPushStatus(deviceID string, update func(status *onvifPushStatus)) {
+	onvifPushRegistry.Lock()
+	defer onvifPushRegistry.Unlock()
+
+	status, ok := onvifPushRegistry.byDevice[deviceID]
+	if !ok {
+		status = &onvifPushStatus{DeviceID: deviceID}
+		onvifPushRegistry.byDevice[deviceID] = status
+	}
+	update(status)
+}
+
+// validONVIFPushToken reports whether the token belongs to the push subscription of the device
+func validONVIFPushToken(deviceID, token string) bool {
+	if token == "" {
+		return false
+	}
+	onvifPushRegistry.Lock()
+	defer onvifPushRegistry.Unlock()
+
+	status, ok := onvifPushRegistry.byDevice[deviceID]
+	return ok && subtle.ConstantTimeCompare([]byte(status.token), []byte(token)) == 1
+}
+
+func init() {
+	registerAdapter("onvif", newONVIFAdapter)
+}
+
+// onvifAdapter is a WS-BaseNotification consumer receiving Notify messages
+type onvifAdapter struct {
+	cfg AdapterConfig
+}
+
+// newONVIFAdapter creates the ONVIF notification consumer adapter
+func newONVIFAdapter(cfg AdapterConfig) (IngestAdapter, error) {
+	return &onvifAdapter{cfg: cfg}, nil
+}
+
+func (a *onvifAdapter) Name() string { return VendorONVIF }
+
+func (a *onvifAdapter) Routes() []string {
+	return adapterRoutes(a.cfg, "/onvif/notify")
+}
+
+func (a *onvifAdapter) Methods() []string { return []string{http.MethodPost} }
+
+// AuthenticatesItself keeps the Notify route out of the API basic auth, which cameras cannot send
+func (a *onvifAdapter) AuthenticatesItself() bool { return true }
+
+// Authenticate accepts the token of a push subscription or the API credentials
+func (a *onvifAdapter) Authenticate(r *http.Request) bool {
+	if !checkAdapterAuth(r, a.cfg.Username, a.cfg.Password) {
+		return false
+	}
+	if state.Config.AuthUsername == "" || state.Config.AuthPassword == "" {
+		return true
+	}
+	query := r.URL.Query()
+	if validONVIFPushToken(query.Get("device"), query.Get("token")) {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	return ok && username == state.Config.AuthUsername && password == state.Config.AuthPassword
+}
+
+// Parse decodes the NotificationMessages of a SOAP Notify request
+func (a *onvifAdapter) Parse(r *http.Request, body []byte) ([]Event, error) {
+	messages, err := decodeONVIFNotifications(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("no NotificationMessage found in Notify request")
+	}
+
+	deviceID := requestDeviceID(r, "ONVIF")
+	updateONVIFPushStatus(deviceID, func(status *onvifPushStatus) {
+		status.LastNotify = time.Now()
+		status.NotifyCount += len(messages)
+	})
+
+	events := make([]Event, 0, len(messages))
+	for _, msg := range messages {
+		// Initialized messages only report the current state after subscribing
+		if strings.EqualFold(msg.Message.Message.PropertyOperation, "Initialized") {
+			continue
+		}
+		events = append(events, convertONVIFNotification(msg, VendorONVIF, deviceID, string(body)))
+	}
+	return events, nil
+}
+
+// Respond acknowledges the Notify with an empty SOAP envelope
+func (a *onvifAdapter) Respond(w http.ResponseWriter, events []Event, eventNumber int) {
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><s:Envelope xmlns:s="%s"><s:Body/></s:Envelope>`, soapEnvelopeNS)
+}
+
+// onvifPushSubscriber subscribes our Notify endpoint on a camera and keeps the subscription renewed
+type onvifPushSubscriber struct {
+	cfg         ONVIFCameraConfig
+	deviceID    string
+	consumerURL string
+	// subscribeURL is the consumer URL including the token of the subscription
+	subscribeURL string
+	token        string
+	soap         *soapClient
+	lifetime     time.Duration
+}
+
+// newONVIFPushSubscriber validates the camera configuration and creates its subscriber
+func newONVIFPushSubscriber(cfg ONVIFCameraConfig) (*onvifPushSubscriber, error) {
+	serviceURL, err := url.Parse(cfg.EventServiceURL)
+	if err != nil || serviceURL.Host == "" {
+		return nil, fmt.Errorf("invalid event_service_url %q", cfg.EventServiceURL)
+	}
+
+	consumerURL, err := url.Parse(cfg.ConsumerURL)
+	if err != nil || consumerURL.Host == "" {
+		return nil, fmt.Errorf("push mode requires a valid consumer_url, got %q", cfg.ConsumerURL)
+	}
+
+	lifetime, err := parseDurationDefault(cfg.SubscriptionTime, 60*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription_time: %v", err)
+	}
+
+	deviceID := cfg.DeviceID
+	if deviceID == "" {
+		deviceID = fmt.Sprintf("ONVIF_%s", serviceURL.Hostname())
+	}
+
+	// The device ID travels in the consumer URL, so Notify requests can be attributed
+	query := consumerURL.Query()
+	query.Set("device", deviceID)
+	consumerURL.RawQuery = query.Encode()
+	displayURL := consumerURL.String()
+
+	// Notify requests cannot carry our credentials, a random token in the URL authenticates them
+	token, err := newUUID()
+	if err != nil {
+		return nil, fmt.Errorf("error creating consumer token: %v", err)
+	}
+	query.Set("token", token)
+	consumerURL.RawQuery = query.Encode()
+
+	return &onvifPushSubscriber{
+		cfg:          cfg,
+		deviceID:     deviceID,
+		consumerURL:  displayURL,
+		subscribeURL: consumerURL.String(),
+		token:        token,
+		soap: &soapClient{
+			httpClient: &http.Client{Timeout: 15 * time.Second},
+			username:   cfg.Username,
+			password:   cfg.Password,
+		},
+		lifetime: lifetime,
+	}, nil
+}
+
+// run subscribes and renews until the context ends, resubscribing with backoff on errors
+func (s *onvifPushSubscriber) run(ctx context.Context) {
+	updateONVIFPushStatus(s.deviceID, func(status *onvifPushStatus) {
+		status.Camera = s.cfg.Name
+		status.EventServiceURL = s.cfg.EventServiceURL
+		status.ConsumerURL = s.consumerURL
+		status.token = s.token
+	})
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := s.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		updateONVIFPushStatus(s.deviceID, func(status *onvifPushStatus) {
+			status.Subscribed = false
+			status.LastError = err.Error()
+		})
+
+		// A session that ran for a while was healthy, start over with a short backoff
+		if time.Since(started) > s.lifetime {
+			backoff = time.Second
+		}
+		state.Logger.Warn("ONVIF push subscriber failed, resubscribing", "client", s.cfg.Name, "error", err,
+			"backoff", backoff.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// session runs one subscription from Subscribe until the first renewal error
+func (s *onvifPushSubscriber) session(ctx context.Context) error {
+	subscription, terminationTime, err := s.subscribe()
+	if err != nil {
+		return fmt.Errorf("Subscribe failed: %v", err)
+	}
+	defer func() {
+		if err := onvifUnsubscribe(s.soap, subscription); err != nil {
+			state.Logger.Warn("ONVIF push subscriber Unsubscribe failed", "client", s.cfg.Name, "error", err)
+		}
+	}()
+	state.Logger.Info("ONVIF push subscriber subscribed", "client", s.cfg.Name,
+		"address", subscription.Address, "consumer", s.consumerURL)
+
+	updateONVIFPushStatus(s.deviceID, func(status *onvifPushStatus) {
+		status.Subscribed = true
+		status.SubscriptionAddress = subscription.Address
+		status.TerminationTime = terminationTime
+		status.LastRenewal = time.Now()
+		status.LastError = ""
+	})
+
+	for {
+		// Renew once half of the subscription lifetime has passed
+		wait := time.Until(terminationTime) - s.lifetime/2
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		terminationTime, err = onvifRenew(s.soap, subscription, s.lifetime)
+		if err != nil {
+			return fmt.Errorf("Renew failed: %v", err)
+		}
+		updateONVIFPushStatus(s.deviceID, func(status *onvifPushStatus) {
+			status.TerminationTime = terminationTime
+			status.LastRenewal = time.Now()
+		})
+	}
+}
+
+// subscribe registers our consumer URL on the camera's notification producer
+func (s *onvifPushSubscriber) subscribe() (soapEndpointReference, time.Time, error) {
+	body := fmt.Sprintf(`<wsnt:Subscribe>`+
+		`<wsnt:ConsumerReference><wsa:Address>%s</wsa:Address></wsnt:ConsumerReference>`+
+		`<wsnt:InitialTerminationTime>%s</wsnt:InitialTerminationTime>`+
+		`</wsnt:Subscribe>`, html.EscapeString(s.subscribeURL), onvifDuration(s.lifetime))
+
+	service := soapEndpointReference{Address: s.cfg.EventServiceURL}
+	respBody, err := s.soap.call(service, "http://docs.oasis-open.org/wsn/bw-2/NotificationProducer/SubscribeRequest", body)
+	if err != nil {
+		return soapEndpointReference{}, time.Time{}, err
+	}
+
+	var resp onvifSubscriptionResponse
+	if err := xml.Unmarshal(respBody, &resp); err != nil {
+		return soapEndpointReference{}, time.Time{}, fmt.Errorf("error parsing response: %v", err)
+	}
+	if resp.SubscriptionReference.Address == "" {
+		return soapEndpointReference{}, time.Time{}, fmt.Errorf("response has no subscription address")
+	}
+
+	return resp.SubscriptionReference, localTerminationTime(resp, s.lifetime), nil
+}
+
+// handleONVIFSubscriptions lists the push subscription bookkeeping
+func handleONVIFSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+
+	onvifPushRegistry.Lock()
+	subscriptions := make([]onvifPushStatus, 0, len(onvifPushRegistry.byDevice))
+	for _, status := range onvifPushRegistry.byDevice {
+		subscriptions = append(subscriptions, *status)
+	}
+	onvifPushRegistry.Unlock()
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].DeviceID < subscriptions[j].DeviceID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"subscriptions": subscriptions})
+}
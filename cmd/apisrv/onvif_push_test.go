@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestONVIFNotifyAuth(t *testing.T) {
+	useRecordingNotifier(t)
+	previous := state.Config
+	state.Config.AuthUsername = "api"
+	state.Config.AuthPassword = "secret"
+	t.Cleanup(func() { state.Config = previous })
+
+	subscriber, err := newONVIFPushSubscriber(ONVIFCameraConfig{
+		Name:            "gate",
+		DeviceID:        "ONVIF_gate",
+		EventServiceURL: "http://192.168.1.21/onvif/event_service",
+		ConsumerURL:     "http://192.168.1.5:8080/onvif/notify",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered the way run does before subscribing
+	updateONVIFPushStatus(subscriber.deviceID, func(status *onvifPushStatus) {
+		status.token = subscriber.token
+	})
+	t.Cleanup(func() {
+		onvifPushRegistry.Lock()
+		delete(onvifPushRegistry.byDevice, subscriber.deviceID)
+		onvifPushRegistry.Unlock()
+	})
+	if strings.Contains(subscriber.consumerURL, subscriber.token) {
+		t.Errorf("got the token in the reported consumer URL %s", subscriber.consumerURL)
+	}
+	consumerURL, err := url.Parse(subscriber.subscribeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapters, err := buildAdapters([]AdapterConfig{{Type: "onvif", Enabled: true}, {Type: "vivotek", Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mountAdapters(mux, adapters)
+
+	notify := fmt.Sprintf(`<env:Envelope xmlns:env="%s" xmlns:wsnt="%s" xmlns:tt="http://www.onvif.org/ver10/schema"><env:Body><wsnt:Notify>%s</wsnt:Notify></env:Body></env:Envelope>`,
+		soapEnvelopeNS, wsntNS, onvifMotionMessage("Changed", true))
+	wrongToken := consumerURL.Query()
+	wrongToken.Set("token", "guessed")
+
+	tests := []struct {
+		name      string
+		target    string
+		basicAuth bool
+		status    int
+	}{
+		{"subscription token", consumerURL.RequestURI(), false, http.StatusOK},
+		{"wrong token", "/onvif/notify?" + wrongToken.Encode(), false, http.StatusUnauthorized},
+		{"no token", "/onvif/notify?device=ONVIF_gate", false, http.StatusUnauthorized},
+		{"API credentials", "/onvif/notify?device=ONVIF_gate", true, http.StatusOK},
+		// Other adapters still require the API credentials
+		{"other adapter", "/event", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(notify))
+			if tt.basicAuth {
+				req.SetBasicAuth("api", "secret")
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// delivery is one notification for one notifier. It is kept in the outbox
+// until it is sent, and moved to the dead letters once all attempts failed.
+type delivery struct {
+	ID       string `json:"id"`
+	Notifier string `json:"notifier"`
+	Event    *Event `json:"event"`
+	// AttachmentData holds the data of the event attachments, which Event does not serialize
+	AttachmentData [][]byte  `json:"attachmentData,omitempty"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"lastError,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	// NextAttempt is when a failed delivery is retried
+	NextAttempt time.Time `json:"nextAttempt"`
+	// DeadLetteredAt is set once the delivery gave up
+	DeadLetteredAt *time.Time `json:"deadLetteredAt,omitempty"`
+}
+
+// newDelivery creates the delivery of an event to a notifier
+func newDelivery(notifier Notifier, event *Event) *delivery {
+	id, err := newUUID()
+	if err != nil {
+		id = fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	d := &delivery{
+		ID:        id,
+		Notifier:  notifier.Name(),
+		Event:     event,
+		CreatedAt: time.Now(),
+	}
+	for _, attachment := range event.Attachments {
+		d.AttachmentData = append(d.AttachmentData, attachment.Data)
+	}
+	return d
+}
+
+// restoreAttachments puts the attachment data back into the event after loading
+func (d *delivery) restoreAttachments() {
+	for i := range d.Event.Attachments {
+		if i < len(d.AttachmentData) {
+			d.Event.Attachments[i].Data = d.AttachmentData[i]
+		}
+	}
+}
+
+// outbox persists pending deliveries and dead letters as one JSON file per
+// delivery, in the pending and dead directories of dir
+var outbox = struct {
+	sync.Mutex
+	dir string
+	// deadLetterMax limits the number of dead letters, 0 keeps all
+	deadLetterMax int
+}{}
+
+// outboxEnabled reports whether deliveries are persisted
+func outboxEnabled() bool {
+	outbox.Lock()
+	defer outbox.Unlock()
+	return outbox.dir != ""
+}
+
+// openOutbox creates the outbox directories, an empty dir keeps deliveries in memory only
+func openOutbox(dir string, deadLetterMax int) error {
+	if dir == "" {
+		return nil
+	}
+	for _, sub := range []string{"pending", "dead"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	outbox.Lock()
+	defer outbox.Unlock()
+	outbox.dir = dir
+	outbox.deadLetterMax = deadLetterMax
+	return nil
+}
+
+// deliveryPath returns the file of a delivery in the pending or dead directory.
+// The caller must hold outbox.
+func deliveryPath(sub, id string) string {
+	return filepath.Join(outbox.dir, sub, id+".json")
+}
+
+// writeDelivery writes a delivery file. The caller must hold outbox.
+func writeDelivery(sub string, d *delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated file
+	path := deliveryPath(sub, d.ID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// saveDelivery persists a pending delivery
+func saveDelivery(d *delivery) error {
+	outbox.Lock()
+	defer outbox.Unlock()
+	if outbox.dir == "" {
+		return nil
+	}
+	return writeDelivery("pending", d)
+}
+
+// removeDelivery deletes a pending delivery once it was sent or discarded
+func removeDelivery(d *delivery) error {
+	outbox.Lock()
+	defer outbox.Unlock()
+	if outbox.dir == "" {
+		return nil
+	}
+	err := os.Remove(deliveryPath("pending", d.ID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// deadLetter moves a pending delivery to the dead letters
+func deadLetter(d *delivery) error {
+	outbox.Lock()
+	defer outbox.Unlock()
+	if outbox.dir == "" {
+		return nil
+	}
+	now := time.Now()
+	d.DeadLetteredAt = &now
+
+	// Attachments are not kept, a replayed dead letter is sent without them
+	dead := *d
+	dead.AttachmentData = nil
+	if err := writeDelivery("dead", &dead); err != nil {
+		return err
+	}
+	if err := pruneDeadLetters(); err != nil {
+		state.Logger.Error("Error pruning dead letters", "error", err)
+	}
+	err := os.Remove(deliveryPath("pending", d.ID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// pruneDeadLetters deletes the oldest dead letters beyond the configured maximum.
+// The caller must hold outbox.
+func pruneDeadLetters() error {
+	if outbox.deadLetterMax <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join(outbox.dir, "dead"))
+	if err != nil {
+		return err
+	}
+
+	type deadFile struct {
+		name    string
+		modTime time.Time
+	}
+	var files []deadFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, deadFile{name: entry.Name(), modTime: info.ModTime()})
+	}
+	if len(files) <= outbox.deadLetterMax {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, file := range files[:len(files)-outbox.deadLetterMax] {
+		if err := os.Remove(filepath.Join(outbox.dir, "dead", file.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	state.Logger.Warn("Deleted the oldest dead letters", "count", len(files)-outbox.deadLetterMax,
+		"max", outbox.deadLetterMax)
+	return nil
+}
+
+// readDeliveries loads the deliveries of the pending or dead directory, oldest first.
+// The caller must hold outbox.
+func readDeliveries(sub string) ([]*delivery, error) {
+	entries, err := os.ReadDir(filepath.Join(outbox.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []*delivery
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(outbox.dir, sub, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var d delivery
+		if err := json.Unmarshal(data, &d); err != nil || d.Event == nil {
+			// Leave the file for inspection rather than losing the delivery silently
+			state.Logger.Error("Skipping unreadable outbox file", "file", path, "error", err)
+			continue
+		}
+		d.restoreAttachments()
+		deliveries = append(deliveries, &d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+// loadPendingDeliveries returns the deliveries left over from the last run
+func loadPendingDeliveries() ([]*delivery, error) {
+	outbox.Lock()
+	defer outbox.Unlock()
+	if outbox.dir == "" {
+		return nil, nil
+	}
+	return readDeliveries("pending")
+}
+
+// selectDeadLetters returns the dead letters with the given ID and notifier, empty values match all
+func selectDeadLetters(id, notifier string) ([]*delivery, error) {
+	outbox.Lock()
+	defer outbox.Unlock()
+	deliveries, err := readDeliveries("dead")
+	if err != nil {
+		return nil, err
+	}
+	var selected []*delivery
+	for _, d := range deliveries {
+		if (id == "" || d.ID == id) && (notifier == "" || d.Notifier == notifier) {
+			selected = append(selected, d)
+		}
+	}
+	return selected, nil
+}
+
+// removeDeadLetter deletes a dead letter
+func removeDeadLetter(d *delivery) error {
+	outbox.Lock()
+	defer outbox.Unlock()
+	return os.Remove(deliveryPath("dead", d.ID))
+}
+
+// retryDeadLetter moves a dead letter back to the pending deliveries with fresh attempts
+func retryDeadLetter(d *delivery) error {
+	outbox.Lock()
+	defer outbox.Unlock()
+	d.Attempts = 0
+	d.LastError = ""
+	d.NextAttempt = time.Time{}
+	d.DeadLetteredAt = nil
+	if err := writeDelivery("pending", d); err != nil {
+		return err
+	}
+	return os.Remove(deliveryPath("dead", d.ID))
+}
+
+// handleDeadLetters lists (GET), retries (POST) and discards (DELETE) dead letters.
+// POST and DELETE select them by ?id= or ?notifier=.
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET, POST and DELETE methods are supported"))
+		return
+	}
+	if !outboxEnabled() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Outbox is not enabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	id, notifier := query.Get("id"), query.Get("notifier")
+	if r.Method != http.MethodGet && id == "" && notifier == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Either id or notifier is required"))
+		return
+	}
+
+	deadLetters, err := selectDeadLetters(id, notifier)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error reading dead letters: %v", err)))
+		return
+	}
+	if id != "" && len(deadLetters) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Dead letter %q not found", id)))
+		return
+	}
+
+	response := map[string]interface{}{"status": "success"}
+	switch r.Method {
+	case http.MethodGet:
+		// The attachment data is only needed to deliver
+		for _, d := range deadLetters {
+			d.AttachmentData = nil
+		}
+		if deadLetters == nil {
+			deadLetters = []*delivery{}
+		}
+		response["deadLetters"] = deadLetters
+
+	case http.MethodPost:
+		retried, skipped := 0, 0
+		rejected := []string{}
+		for _, d := range deadLetters {
+			queue, ok := dispatchQueues[d.Notifier]
+			if !ok {
+				skipped++
+				continue
+			}
+			if err := retryDeadLetter(d); err != nil {
+				state.Logger.Error("Error retrying dead letter", "deliveryId", d.ID, "error", err)
+				skipped++
+				continue
+			}
+			// The overload policy applies as to any new notification
+			if !queue.push(d) {
+				// Keep it as a dead letter rather than losing it
+				if err := deadLetter(d); err != nil {
+					state.Logger.Error("Error moving delivery back to the dead letters", "deliveryId", d.ID, "error", err)
+				}
+				rejected = append(rejected, d.ID)
+				continue
+			}
+			d.Event.logger().Info("Retrying dead letter", "notifier", d.Notifier, "deliveryId", d.ID)
+			retried++
+		}
+		response["retried"] = retried
+		response["skipped"] = skipped
+		response["rejected"] = rejected
+
+	case http.MethodDelete:
+		discarded := 0
+		for _, d := range deadLetters {
+			if err := removeDeadLetter(d); err != nil {
+				state.Logger.Error("Error discarding dead letter", "deliveryId", d.ID, "error", err)
+				continue
+			}
+			d.Event.logger().Info("Discarded dead letter", "notifier", d.Notifier, "deliveryId", d.ID)
+			discarded++
+		}
+		response["discarded"] = discarded
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useOutbox persists deliveries to a temporary outbox for the test
+func useOutbox(t *testing.T, deadLetterMax int) string {
+	dir := t.TempDir()
+	if err := openOutbox(dir, deadLetterMax); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		outbox.Lock()
+		outbox.dir = ""
+		outbox.deadLetterMax = 0
+		outbox.Unlock()
+	})
+	return dir
+}
+
+func TestDeadLetterRetention(t *testing.T) {
+	dir := useOutbox(t, 2)
+
+	notifier := &recordingNotifier{}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		event := &Event{Vendor: "HIKVision", EventType: "LineCrossing", DeviceID: "cam1",
+			Attachments: []Attachment{{Name: "snapshot.jpg", ContentType: "image/jpeg", Data: []byte("jpeg"), Size: 4}}}
+		d := newDelivery(notifier, event)
+		if err := saveDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := deadLetter(d); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, d.ID)
+		// Distinct modification times keep the order of the dead letters
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dead, err := selectDeadLetters("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 2 || dead[0].ID != ids[1] || dead[1].ID != ids[2] {
+		t.Fatalf("got %d dead letters, want the newest 2", len(dead))
+	}
+	for _, d := range dead {
+		if len(d.AttachmentData) != 0 || len(d.Event.Attachments) != 1 {
+			t.Errorf("got %d attachment data for %d attachments, want the metadata only",
+				len(d.AttachmentData), len(d.Event.Attachments))
+		}
+	}
+
+	pending, err := os.ReadDir(filepath.Join(dir, "pending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("got %d pending deliveries, want none", len(pending))
+	}
+}
+
+func TestDeadLetterRetryOverload(t *testing.T) {
+	useOutbox(t, 0)
+	notifier := &recordingNotifier{}
+	queue, err := newNotifierQueue(notifier, QueueConfig{Size: 2, Overload: OverloadReject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := dispatchQueues
+	dispatchQueues = map[string]*notifierQueue{notifier.Name(): queue}
+	t.Cleanup(func() { dispatchQueues = previous })
+
+	queue.push(newDelivery(notifier, &Event{Vendor: "HIKVision", EventType: "VideoLoss", DeviceID: "cam1"}))
+	var ids []string
+	for i := 0; i < 2; i++ {
+		d := newDelivery(notifier, &Event{Vendor: "HIKVision", EventType: "LineCrossing", DeviceID: "cam2"})
+		d.CreatedAt = d.CreatedAt.Add(time.Duration(i) * time.Second)
+		if err := deadLetter(d); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, d.ID)
+	}
+
+	// The queue has room for one of them, the other is rejected
+	rec := httptest.NewRecorder()
+	handleDeadLetters(rec, httptest.NewRequest(http.MethodPost, "/api/admin/deadletters?notifier="+notifier.Name(), nil))
+	var response struct {
+		Retried  int      `json:"retried"`
+		Rejected []string `json:"rejected"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Retried != 1 || len(response.Rejected) != 1 || response.Rejected[0] != ids[1] {
+		t.Fatalf("got %+v, want %s rejected", response, ids[1])
+	}
+	if len(queue.deliveries) != 2 {
+		t.Errorf("got %d queued, want 2", len(queue.deliveries))
+	}
+
+	dead, err := selectDeadLetters("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != ids[1] {
+		t.Errorf("got %d dead letters, want the rejected one kept", len(dead))
+	}
+}
+
+func TestOutboxFailure(t *testing.T) {
+	dir := useOutbox(t, 0)
+	// Without the pending directory no delivery can be saved
+	if err := os.RemoveAll(filepath.Join(dir, "pending")); err != nil {
+		t.Fatal(err)
+	}
+	notifier := &recordingNotifier{}
+	queue, err := newNotifierQueue(notifier, QueueConfig{Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := dispatchQueues
+	dispatchQueues = map[string]*notifierQueue{notifier.Name(): queue}
+	t.Cleanup(func() { dispatchQueues = previous })
+
+	failures := func() float64 {
+		outboxFailures.mu.Lock()
+		defer outboxFailures.mu.Unlock()
+		if value, ok := outboxFailures.values[notifier.Name()]; ok {
+			return value.value
+		}
+		return 0
+	}
+	before := failures()
+	queueNotification(notifier, &Event{Vendor: "HIKVision", EventType: "VideoLoss", DeviceID: "cam1"})
+
+	// The notification is still delivered, the failure is counted
+	if len(queue.deliveries) != 1 {
+		t.Errorf("got %d queued, want 1", len(queue.deliveries))
+	}
+	if got := failures() - before; got != 1 {
+		t.Errorf("got %v outbox failures, want 1", got)
+	}
+}
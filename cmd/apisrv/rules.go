@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// RuleConfig routes matching events to notifiers. All match fields are optional;
+// vendor, device_id, channel_id and event_type accept glob patterns.
+type RuleConfig struct {
+	Name      string `json:"name"`
+	Vendor    string `json:"vendor,omitempty"`
+	DeviceID  string `json:"device_id,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+	EventType string `json:"event_type,omitempty"`
+	State     string `json:"state,omitempty"`
+	// Details are conditions on EventDetails fields that must all hold, e.g. "confidence >= 80"
+	Details []string `json:"details,omitempty"`
+	// Time restricts the rule to a time of day range, e.g. "22:00-06:00"
+	Time string `json:"time,omitempty"`
+	// Notifiers names the notifiers to send to, all notifiers when empty
+	Notifiers []string `json:"notifiers,omitempty"`
+	// Template is a text/template rendered with the event as message text, and
+	// with html/template for notifiers sending HTML
+	Template string `json:"template,omitempty"`
+	// Stop ends rule evaluation when this rule matches
+	Stop bool `json:"stop,omitempty"`
+}
+
+// eventRule is a parsed routing rule
+type eventRule struct {
+	cfg        RuleConfig
+	conditions []detailCondition
+	// from and until are minutes since midnight, until < from wraps past midnight
+	from, until int
+	hasTime     bool
+	notifiers   []Notifier
+	template    *template.Template
+	// htmlTemplate is parsed from the same text and escapes the event fields
+	htmlTemplate *htmltemplate.Template
+	matched      atomic.Int64
+}
+
+// detailCondition compares one EventDetails field with a value
+type detailCondition struct {
+	field    string
+	operator string
+	value    string
+}
+
+// conditionPattern splits "field op value"; the field may be a dotted path into nested details
+var conditionPattern = regexp.MustCompile(`^\s*([\w.]+)\s*(==|!=|>=|<=|>|<)\s*(.*?)\s*$`)
+
+// buildRules parses the routing rules and resolves their notifiers
+func buildRules(configs []RuleConfig, notifiers []Notifier) ([]*eventRule, error) {
+	var rules []*eventRule
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		rule := &eventRule{cfg: cfg}
+
+		for _, pattern := range []string{cfg.Vendor, cfg.DeviceID, cfg.ChannelID, cfg.EventType} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %q: invalid pattern %q", cfg.Name, pattern)
+			}
+		}
+
+		for _, condition := range cfg.Details {
+			parts := conditionPattern.FindStringSubmatch(condition)
+			if parts == nil {
+				return nil, fmt.Errorf("rule %q: invalid details condition %q", cfg.Name, condition)
+			}
+			rule.conditions = append(rule.conditions, detailCondition{
+				field:    parts[1],
+				operator: parts[2],
+				value:    strings.Trim(parts[3], `"'`),
+			})
+		}
+
+		if cfg.Time != "" {
+			from, until, err := parseTimeRange(cfg.Time)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", cfg.Name, err)
+			}
+			rule.from, rule.until, rule.hasTime = from, until, true
+		}
+
+		for _, name := range cfg.Notifiers {
+			notifier := findNotifierIn(notifiers, name)
+			if notifier == nil {
+				return nil, fmt.Errorf("rule %q: unknown notifier %q", cfg.Name, name)
+			}
+			rule.notifiers = append(rule.notifiers, notifier)
+		}
+
+		if cfg.Template != "" {
+			tmpl, err := template.New(cfg.Name).Parse(cfg.Template)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid template: %v", cfg.Name, err)
+			}
+			rule.template = tmpl
+			rule.htmlTemplate, err = htmltemplate.New(cfg.Name).Parse(cfg.Template)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid template: %v", cfg.Name, err)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseTimeRange parses "HH:MM-HH:MM" into minutes since midnight. The end
+// may be "24:00" for a range up to midnight.
+func parseTimeRange(value string) (int, int, error) {
+	fromText, untilText, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", value)
+	}
+	from, err := time.Parse("15:04", strings.TrimSpace(fromText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", value)
+	}
+	if strings.TrimSpace(untilText) == "24:00" {
+		return from.Hour()*60 + from.Minute(), 24 * 60, nil
+	}
+	until, err := time.Parse("15:04", strings.TrimSpace(untilText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", value)
+	}
+	return from.Hour()*60 + from.Minute(), until.Hour()*60 + until.Minute(), nil
+}
+
+// matches reports whether the event satisfies every condition of the rule
+func (r *eventRule) matches(event *Event) bool {
+	if !globMatch(r.cfg.Vendor, event.Vendor) ||
+		!globMatch(r.cfg.DeviceID, event.DeviceID) ||
+		!globMatch(r.cfg.ChannelID, event.ChannelID) ||
+		!globMatch(r.cfg.EventType, event.EventType) {
+		return false
+	}
+	if r.cfg.State != "" && !strings.EqualFold(r.cfg.State, event.State) {
+		return false
+	}
+
+	for _, condition := range r.conditions {
+		if !condition.holds(event.EventDetails) {
+			return false
+		}
+	}
+
+	// Device clocks are not trusted, the time of day is taken from the server
+	if r.hasTime {
+		received := event.ReceivedAt.Local()
+		minute := received.Hour()*60 + received.Minute()
+		if r.from <= r.until {
+			if minute < r.from || minute >= r.until {
+				return false
+			}
+		} else if minute < r.from && minute >= r.until {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch matches value against a glob pattern, an empty pattern matches everything
+func globMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+// holds evaluates the condition; numbers are compared numerically, everything else as text
+func (c detailCondition) holds(details map[string]interface{}) bool {
+	actual, ok := lookupDetail(details, c.field)
+	if !ok {
+		return c.operator == "!="
+	}
+	actualText := fmt.Sprint(actual)
+
+	actualNumber, errActual := strconv.ParseFloat(actualText, 64)
+	expectedNumber, errExpected := strconv.ParseFloat(c.value, 64)
+	if errActual == nil && errExpected == nil {
+		switch c.operator {
+		case "==":
+			return actualNumber == expectedNumber
+		case "!=":
+			return actualNumber != expectedNumber
+		case ">=":
+			return actualNumber >= expectedNumber
+		case "<=":
+			return actualNumber <= expectedNumber
+		case ">":
+			return actualNumber > expectedNumber
+		case "<":
+			return actualNumber < expectedNumber
+		}
+	}
+
+	switch c.operator {
+	case "==":
+		return strings.EqualFold(actualText, c.value)
+	case "!=":
+		return !strings.EqualFold(actualText, c.value)
+	}
+	return false
+}
+
+// lookupDetail resolves a dotted path such as "line.direction" in the event details
+func lookupDetail(details map[string]interface{}, field string) (interface{}, bool) {
+	var current interface{} = details
+	for _, key := range strings.Split(field, ".") {
+		values, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = values[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// render executes the rule template as plain text and as HTML, an empty message
+// keeps the notifier's own format
+func (r *eventRule) render(event *Event) (string, string) {
+	if r.template == nil {
+		return "", ""
+	}
+	var message, htmlMessage strings.Builder
+	if err := r.template.Execute(&message, event); err != nil {
+		event.logger().Error("Error rendering rule template", "rule", r.cfg.Name, "error", err)
+		return "", ""
+	}
+	if err := r.htmlTemplate.Execute(&htmlMessage, event); err != nil {
+		event.logger().Error("Error rendering rule template as HTML", "rule", r.cfg.Name, "error", err)
+		return message.String(), ""
+	}
+	return message.String(), htmlMessage.String()
+}
+
+// routeEvent queues the event for the notifiers of every matching rule. Without
+// rules every notifier receives every event. A notifier receives an event at
+// most once, with the template of the first rule that selected it.
+func routeEvent(event *Event) {
+	if len(state.Rules) == 0 {
+		notifyAll(event)
+		return
+	}
+
+	sent := map[string]bool{}
+	matched := false
+	for _, rule := range state.Rules {
+		if !rule.matches(event) {
+			continue
+		}
+		matched = true
+		rule.matched.Add(1)
+
+		notifiers := rule.notifiers
+		if len(rule.cfg.Notifiers) == 0 {
+			notifiers = state.Notifiers
+		}
+
+		message, htmlMessage := rule.render(event)
+		for _, notifier := range notifiers {
+			if sent[notifier.Name()] {
+				continue
+			}
+			sent[notifier.Name()] = true
+
+			routed := *event
+			routed.Message = message
+			if htmlNotifier, ok := notifier.(HTMLNotifier); ok && htmlNotifier.SendsHTML() {
+				routed.Message = htmlMessage
+			}
+			queueNotification(notifier, &routed)
+		}
+
+		if rule.cfg.Stop {
+			break
+		}
+	}
+
+	if !matched {
+		event.logger().Info("No rule matched")
+	}
+}
+
+// handleListRules lists the routing rules with their match counts
+func handleListRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+
+	rules := make([]map[string]interface{}, 0, len(state.Rules))
+	for _, rule := range state.Rules {
+		notifiers := rule.cfg.Notifiers
+		if len(notifiers) == 0 {
+			notifiers = []string{"*"}
+		}
+		rules = append(rules, map[string]interface{}{
+			"name":      rule.cfg.Name,
+			"notifiers": notifiers,
+			"stop":      rule.cfg.Stop,
+			"matched":   rule.matched.Load(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": rules})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+// htmlRecordingNotifier is a recording notifier that asks for HTML messages
+type htmlRecordingNotifier struct {
+	recordingNotifier
+}
+
+func (n *htmlRecordingNotifier) Name() string    { return "html-recorder" }
+func (n *htmlRecordingNotifier) SendsHTML() bool { return true }
+
+func TestRuleTemplateEscaping(t *testing.T) {
+	plain := useRecordingNotifier(t)
+	htmlNotifier := &htmlRecordingNotifier{}
+	state.Notifiers = append(state.Notifiers, htmlNotifier)
+
+	rules, err := buildRules([]RuleConfig{{
+		Name:     "all",
+		Template: "<b>{{.EventType}}</b> on {{.DeviceID}}",
+	}}, state.Notifiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := state.Rules
+	state.Rules = rules
+	t.Cleanup(func() { state.Rules = previous })
+
+	routeEvent(&Event{Vendor: "Vivotek", EventType: "MotionDetection", DeviceID: `<a href="x">cam</a> & co`})
+
+	want := map[Notifier]string{
+		plain:        `<b>MotionDetection</b> on <a href="x">cam</a> & co`,
+		htmlNotifier: `<b>MotionDetection</b> on &lt;a href=&#34;x&#34;&gt;cam&lt;/a&gt; &amp; co`,
+	}
+	for notifier, message := range want {
+		events := notifier.(interface{ received() []Event }).received()
+		if len(events) != 1 || events[0].Message != message {
+			t.Errorf("%s: got %+v, want message %q", notifier.Name(), events, message)
+		}
+	}
+}
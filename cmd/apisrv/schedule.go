@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// The alpine runtime image has no zoneinfo, embed it for schedule timezones
+	_ "time/tzdata"
+)
+
+// ScheduleConfig arms a site, i.e. a group of devices and channels, on a weekly
+// schedule. Events of a disarmed site are only logged. Empty match lists match everything.
+type ScheduleConfig struct {
+	Name string `json:"name"`
+	// Timezone of the schedule, e.g. "Europe/Berlin", defaults to the server timezone
+	Timezone string `json:"timezone,omitempty"`
+	// Sites selects devices by their site in the device inventory
+	Sites []string `json:"sites,omitempty"`
+	// Devices, Channels and EventTypes are glob patterns selecting the events of the site
+	Devices    []string `json:"devices,omitempty"`
+	Channels   []string `json:"channels,omitempty"`
+	EventTypes []string `json:"event_types,omitempty"`
+	// Armed lists the weekly periods during which the site is armed
+	Armed []ArmPeriod `json:"armed"`
+	// Holidays lists dates (YYYY-MM-DD) that ignore the weekly periods
+	Holidays []string `json:"holidays,omitempty"`
+	// HolidayMode is "armed" (default) to arm the site all day on holidays, or "disarmed"
+	HolidayMode string `json:"holiday_mode,omitempty"`
+}
+
+// ArmPeriod is a daily time range on the given weekdays
+type ArmPeriod struct {
+	// Days are weekday abbreviations (mon, tue, ...), every day when empty
+	Days []string `json:"days,omitempty"`
+	// Time is a range such as "18:00-07:00", all day when empty. Ranges
+	// past midnight belong to the day they start on.
+	Time string `json:"time,omitempty"`
+}
+
+// armSchedule is a parsed schedule
+type armSchedule struct {
+	cfg      ScheduleConfig
+	location *time.Location
+	periods  []armPeriod
+	holidays map[string]bool
+	// holidayArmed is the arm state on holidays
+	holidayArmed bool
+}
+
+// armPeriod is a parsed ArmPeriod; from and until are minutes since midnight
+type armPeriod struct {
+	days        map[time.Weekday]bool
+	from, until int
+}
+
+// armOverride is a manual arm or disarm, Until is zero when it does not expire
+type armOverride struct {
+	Armed bool      `json:"armed"`
+	Until time.Time `json:"until,omitempty"`
+}
+
+// armOverrides holds the manual overrides, for all events and per schedule
+var armOverrides = struct {
+	sync.Mutex
+	global     *armOverride
+	bySchedule map[string]*armOverride
+}{bySchedule: map[string]*armOverride{}}
+
+// weekdays maps the accepted day names to weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// buildSchedules parses the arm schedules
+func buildSchedules(configs []ScheduleConfig) ([]*armSchedule, error) {
+	var schedules []*armSchedule
+	names := map[string]bool{}
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("schedule%d", i+1)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicate schedule name %q", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		schedule := &armSchedule{cfg: cfg, location: time.Local, holidays: map[string]bool{}}
+		switch strings.ToLower(cfg.HolidayMode) {
+		case "", "armed":
+			schedule.holidayArmed = true
+		case "disarmed":
+		default:
+			return nil, fmt.Errorf("schedule %q: invalid holiday_mode %q, expected armed or disarmed", cfg.Name, cfg.HolidayMode)
+		}
+		if cfg.Timezone != "" {
+			location, err := time.LoadLocation(cfg.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("schedule %q: invalid timezone %q", cfg.Name, cfg.Timezone)
+			}
+			schedule.location = location
+		}
+
+		for _, period := range cfg.Armed {
+			parsed := armPeriod{days: map[time.Weekday]bool{}, from: 0, until: 24 * 60}
+			for _, day := range period.Days {
+				weekday, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+				if !ok {
+					return nil, fmt.Errorf("schedule %q: invalid day %q", cfg.Name, day)
+				}
+				parsed.days[weekday] = true
+			}
+			if len(parsed.days) == 0 {
+				for _, weekday := range weekdays {
+					parsed.days[weekday] = true
+				}
+			}
+			if period.Time != "" {
+				from, until, err := parseTimeRange(period.Time)
+				if err != nil {
+					return nil, fmt.Errorf("schedule %q: %v", cfg.Name, err)
+				}
+				parsed.from, parsed.until = from, until
+			}
+			schedule.periods = append(schedule.periods, parsed)
+		}
+
+		for _, holiday := range cfg.Holidays {
+			if _, err := time.Parse("2006-01-02", holiday); err != nil {
+				return nil, fmt.Errorf("schedule %q: invalid holiday %q, expected YYYY-MM-DD", cfg.Name, holiday)
+			}
+			schedule.holidays[holiday] = true
+		}
+
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+// findSchedule returns the schedule with the given name
+func findSchedule(name string) *armSchedule {
+	for _, schedule := range state.Schedules {
+		if schedule.cfg.Name == name {
+			return schedule
+		}
+	}
+	return nil
+}
+
+// matches reports whether the event belongs to the site of the schedule
+func (s *armSchedule) matches(event *Event) bool {
+	if len(s.cfg.Sites) > 0 && (event.Device == nil || !globMatchAny(s.cfg.Sites, event.Device.Site)) {
+		return false
+	}
+	return globMatchAny(s.cfg.Devices, event.DeviceID) &&
+		globMatchAny(s.cfg.Channels, event.ChannelID) &&
+		globMatchAny(s.cfg.EventTypes, event.EventType)
+}
+
+// globMatchAny matches value against a list of glob patterns, an empty list matches everything
+func globMatchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if globMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// armedAt evaluates the weekly schedule and the holidays at the given time
+func (s *armSchedule) armedAt(now time.Time) (bool, string) {
+	local := now.In(s.location)
+	if s.holidays[local.Format("2006-01-02")] {
+		return s.holidayArmed, "holiday"
+	}
+
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := local.AddDate(0, 0, -1).Weekday()
+	for _, period := range s.periods {
+		if period.from < period.until {
+			if period.days[today] && minute >= period.from && minute < period.until {
+				return true, "schedule"
+			}
+			continue
+		}
+		// The range wraps past midnight and belongs to the day it starts on
+		if (period.days[today] && minute >= period.from) || (period.days[yesterday] && minute < period.until) {
+			return true, "schedule"
+		}
+	}
+	return false, "schedule"
+}
+
+// activeOverride returns the override unless it has expired.
+// The caller must hold armOverrides.
+func activeOverride(override *armOverride, now time.Time) *armOverride {
+	if override == nil || (!override.Until.IsZero() && now.After(override.Until)) {
+		return nil
+	}
+	return override
+}
+
+// isArmed reports whether the event should raise notifications, and why. A
+// manual override of the site wins over a global override, which wins over
+// the schedule. Events outside every schedule are armed.
+func isArmed(event *Event) (bool, string) {
+	now := time.Now()
+
+	var schedule *armSchedule
+	for _, candidate := range state.Schedules {
+		if candidate.matches(event) {
+			schedule = candidate
+			break
+		}
+	}
+
+	armOverrides.Lock()
+	defer armOverrides.Unlock()
+
+	if schedule != nil {
+		if override := activeOverride(armOverrides.bySchedule[schedule.cfg.Name], now); override != nil {
+			return override.Armed, "override of " + schedule.cfg.Name
+		}
+	}
+	if override := activeOverride(armOverrides.global, now); override != nil {
+		return override.Armed, "global override"
+	}
+	if schedule == nil {
+		return true, "no schedule"
+	}
+
+	armed, reason := schedule.armedAt(now)
+	return armed, reason + " " + schedule.cfg.Name
+}
+
+// armStatus describes the current arm state of a schedule
+func armStatus(schedule *armSchedule, now time.Time) map[string]interface{} {
+	armed, source := schedule.armedAt(now)
+	status := map[string]interface{}{
+		"name":     schedule.cfg.Name,
+		"timezone": schedule.location.String(),
+	}
+	override := activeOverride(armOverrides.bySchedule[schedule.cfg.Name], now)
+	if override == nil {
+		override = activeOverride(armOverrides.global, now)
+	}
+	if override != nil {
+		armed, source = override.Armed, "override"
+		if !override.Until.IsZero() {
+			status["overrideUntil"] = override.Until
+		}
+	}
+	status["armed"] = armed
+	status["source"] = source
+	return status
+}
+
+// handleArm returns the handler of /api/arm or /api/disarm. POST sets a manual
+// override of the given schedule, or of all events, with an optional duration.
+// DELETE removes the override and GET reports the arm state.
+func handleArm(armed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("schedule")
+		if name != "" && findSchedule(name) == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("Schedule %q not found", name)))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			override := &armOverride{Armed: armed}
+			if value := r.URL.Query().Get("duration"); value != "" {
+				duration, err := time.ParseDuration(value)
+				if err != nil || duration <= 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(fmt.Sprintf("Invalid duration %q", value)))
+					return
+				}
+				override.Until = time.Now().Add(duration)
+			}
+			setArmOverride(name, override)
+		case http.MethodDelete:
+			setArmOverride(name, nil)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("Only GET, POST and DELETE methods are supported"))
+			return
+		}
+
+		now := time.Now()
+		armOverrides.Lock()
+		schedules := make([]map[string]interface{}, 0, len(state.Schedules))
+		for _, schedule := range state.Schedules {
+			schedules = append(schedules, armStatus(schedule, now))
+		}
+		response := map[string]interface{}{
+			"status":    "success",
+			"schedules": schedules,
+		}
+		if global := activeOverride(armOverrides.global, now); global != nil {
+			response["global"] = global
+		}
+		armOverrides.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// setArmOverride sets or, with a nil override, removes the override of a schedule or of all events
+func setArmOverride(name string, override *armOverride) {
+	armOverrides.Lock()
+	defer armOverrides.Unlock()
+
+	target := "all events"
+	if name == "" {
+		armOverrides.global = override
+	} else {
+		target = "schedule " + name
+		if override == nil {
+			delete(armOverrides.bySchedule, name)
+		} else {
+			armOverrides.bySchedule[name] = override
+		}
+	}
+
+	switch {
+	case override == nil:
+		state.Logger.Info("Arm override removed", "target", target)
+	case override.Until.IsZero():
+		state.Logger.Info("Manual override", "target", target, "state", armWord(override.Armed))
+	default:
+		state.Logger.Info("Manual override", "target", target, "state", armWord(override.Armed),
+			"until", override.Until)
+	}
+}
+
+// armWord returns "armed" or "disarmed"
+func armWord(armed bool) string {
+	if armed {
+		return "armed"
+	}
+	return "disarmed"
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArmedAt(t *testing.T) {
+	schedules, err := buildSchedules([]ScheduleConfig{{
+		Name:     "office",
+		Timezone: "Europe/Berlin",
+		Armed: []ArmPeriod{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Time: "18:00-07:00"},
+			{Days: []string{"sunday"}},
+			{Days: []string{"sat"}, Time: "22:00-24:00"},
+		},
+		Holidays: []string{"2026-03-11"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := schedules[0]
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2026-03-06 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.March, day, hour, minute, 0, 0, berlin)
+	}
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		armed  bool
+		reason string
+	}{
+		{"weekday evening", at(6, 19, 0), true, "schedule"},
+		{"start of the range", at(2, 18, 0), true, "schedule"},
+		{"weekday afternoon", at(4, 12, 0), false, "schedule"},
+		{"past midnight after a weekday", at(7, 6, 59), true, "schedule"},
+		{"end of the range", at(7, 7, 0), false, "schedule"},
+		{"saturday evening", at(7, 19, 0), false, "schedule"},
+		{"saturday until midnight", at(7, 23, 59), true, "schedule"},
+		{"sunday all day", at(8, 12, 0), true, "schedule"},
+		// Sunday is armed all day, but the weekday range starts on Monday evening
+		{"monday early morning", at(9, 3, 0), false, "schedule"},
+		{"holiday", at(11, 12, 0), true, "holiday"},
+		// Evaluated in the timezone of the schedule, 17:30 UTC is 18:30 in Berlin
+		{"other timezone", time.Date(2026, time.March, 6, 17, 30, 0, 0, time.UTC), true, "schedule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			armed, reason := schedule.armedAt(tt.now)
+			if armed != tt.armed || reason != tt.reason {
+				t.Errorf("got %t/%s, want %t/%s", armed, reason, tt.armed, tt.reason)
+			}
+		})
+	}
+}
+
+func TestBuildSchedulesInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ScheduleConfig
+	}{
+		{"day", ScheduleConfig{Armed: []ArmPeriod{{Days: []string{"someday"}}}}},
+		{"time range", ScheduleConfig{Armed: []ArmPeriod{{Time: "18:00"}}}},
+		{"time range from 24:00", ScheduleConfig{Armed: []ArmPeriod{{Time: "24:00-07:00"}}}},
+		{"holiday mode", ScheduleConfig{HolidayMode: "off"}},
+		{"holiday", ScheduleConfig{Holidays: []string{"01.03.2026"}}},
+		{"timezone", ScheduleConfig{Timezone: "Mars/Olympus"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildSchedules([]ScheduleConfig{tt.cfg}); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestArmedAtHolidayMode(t *testing.T) {
+	tests := []struct {
+		mode  string
+		armed bool
+	}{
+		{"", true},
+		{"armed", true},
+		{"disarmed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			schedules, err := buildSchedules([]ScheduleConfig{{
+				Name:        "shop",
+				Timezone:    "UTC",
+				Armed:       []ArmPeriod{{Time: "20:00-08:00"}},
+				Holidays:    []string{"2026-12-25"},
+				HolidayMode: tt.mode,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The weekly periods do not apply on the holiday, day or night
+			for _, hour := range []int{12, 22} {
+				armed, reason := schedules[0].armedAt(time.Date(2026, time.December, 25, hour, 0, 0, 0, time.UTC))
+				if armed != tt.armed || reason != "holiday" {
+					t.Errorf("%d:00: got %t/%s, want %t/holiday", hour, armed, reason, tt.armed)
+				}
+			}
+		})
+	}
+}
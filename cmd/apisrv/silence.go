@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Silence states reported by the API
+const (
+	SilenceStatePending = "pending"
+	SilenceStateActive  = "active"
+	SilenceStateExpired = "expired"
+)
+
+// silenceRetention is how long expired silences are kept for reference
+const silenceRetention = 7 * 24 * time.Hour
+
+// SilenceMatcher matches one event field, in the style of Alertmanager. Name is
+// vendor, deviceId, channelId, eventType, state, severity, site, camera or an
+// event details field, nested fields use dots.
+type SilenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	// IsEqual defaults to true, false negates the matcher
+	IsEqual *bool `json:"isEqual,omitempty"`
+}
+
+// Silence mutes the notifications of matching events between StartsAt and EndsAt
+type Silence struct {
+	ID        string           `json:"id"`
+	Matchers  []SilenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy,omitempty"`
+	Comment   string           `json:"comment,omitempty"`
+	CreatedAt time.Time        `json:"createdAt"`
+
+	// regexps holds the compiled regex matchers by matcher index
+	regexps map[int]*regexp.Regexp
+}
+
+// silences holds all silences and the file they are persisted to
+var silences = struct {
+	sync.Mutex
+	file string
+	byID map[string]*Silence
+}{byID: map[string]*Silence{}}
+
+// loadSilences reads the persisted silences, a missing file is not an error
+func loadSilences(file string) error {
+	silences.Lock()
+	defer silences.Unlock()
+	silences.file = file
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*Silence
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("error parsing silences file %s: %v", file, err)
+	}
+	for _, silence := range list {
+		if err := silence.compile(); err != nil {
+			return fmt.Errorf("silence %s: %v", silence.ID, err)
+		}
+		silences.byID[silence.ID] = silence
+	}
+	state.Logger.Info("Loaded silences", "count", len(list), "file", file)
+	return nil
+}
+
+// saveSilences persists the silences, dropping those expired beyond the retention.
+// The caller must hold silences.
+func saveSilences() error {
+	cutoff := time.Now().Add(-silenceRetention)
+	list := make([]*Silence, 0, len(silences.byID))
+	for id, silence := range silences.byID {
+		if silence.EndsAt.Before(cutoff) {
+			delete(silences.byID, id)
+			continue
+		}
+		list = append(list, silence)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmp := silences.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, silences.file)
+}
+
+// compile validates the matchers and compiles the regex ones
+func (s *Silence) compile() error {
+	if len(s.Matchers) == 0 {
+		return fmt.Errorf("at least one matcher is required")
+	}
+	s.regexps = map[int]*regexp.Regexp{}
+	for i, matcher := range s.Matchers {
+		if matcher.Name == "" {
+			return fmt.Errorf("matcher %d has no name", i+1)
+		}
+		if !matcher.IsRegex {
+			continue
+		}
+		// Regex matchers are anchored like in Alertmanager
+		re, err := regexp.Compile("^(?:" + matcher.Value + ")$")
+		if err != nil {
+			return fmt.Errorf("matcher %q: invalid regex: %v", matcher.Name, err)
+		}
+		s.regexps[i] = re
+	}
+	return nil
+}
+
+// status returns whether the silence is pending, active or expired
+func (s *Silence) status(now time.Time) string {
+	switch {
+	case now.Before(s.StartsAt):
+		return SilenceStatePending
+	case now.Before(s.EndsAt):
+		return SilenceStateActive
+	default:
+		return SilenceStateExpired
+	}
+}
+
+// matches reports whether every matcher of the silence matches the event
+func (s *Silence) matches(event *Event) bool {
+	for i, matcher := range s.Matchers {
+		value := silenceField(event, matcher.Name)
+
+		var matched bool
+		if re, ok := s.regexps[i]; ok {
+			matched = re.MatchString(value)
+		} else {
+			matched = value == matcher.Value
+		}
+
+		if matcher.IsEqual != nil && !*matcher.IsEqual {
+			matched = !matched
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// silenceField returns the value of an event field for matching
+func silenceField(event *Event, name string) string {
+	switch name {
+	case "vendor":
+		return event.Vendor
+	case "deviceId":
+		return event.DeviceID
+	case "channelId":
+		return event.ChannelID
+	case "eventType":
+		return event.EventType
+	case "state":
+		return event.State
+	case "severity":
+		return event.Severity
+	case "site", "camera":
+		if event.Device == nil {
+			return ""
+		}
+		if name == "site" {
+			return event.Device.Site
+		}
+		return event.Device.Camera
+	}
+	if value, ok := lookupDetail(event.EventDetails, name); ok {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// checkSilences tags the event with the IDs of all active silences matching
+// it and reports whether it was silenced
+func checkSilences(event *Event) bool {
+	silences.Lock()
+	defer silences.Unlock()
+
+	now := time.Now()
+	for id, silence := range silences.byID {
+		if silence.status(now) == SilenceStateActive && silence.matches(event) {
+			event.SilencedBy = append(event.SilencedBy, id)
+		}
+	}
+	sort.Strings(event.SilencedBy)
+	return len(event.SilencedBy) > 0
+}
+
+// newUUID returns a random UUID (version 4)
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32]), nil
+}
+
+// silenceResponse is a silence with its current status
+type silenceResponse struct {
+	*Silence
+	Status string `json:"status"`
+}
+
+// handleSilences lists (GET), creates (POST) and expires (DELETE ?id=) silences
+func handleSilences(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listSilences(w)
+	case http.MethodPost:
+		createSilence(w, r)
+	case http.MethodDelete:
+		expireSilence(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET, POST and DELETE methods are supported"))
+	}
+}
+
+// listSilences writes all silences, newest first
+func listSilences(w http.ResponseWriter) {
+	silences.Lock()
+	now := time.Now()
+	list := make([]silenceResponse, 0, len(silences.byID))
+	for _, silence := range silences.byID {
+		list = append(list, silenceResponse{Silence: silence, Status: silence.status(now)})
+	}
+	silences.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"silences": list})
+}
+
+// createSilence validates and stores a new silence
+func createSilence(w http.ResponseWriter, r *http.Request) {
+	var silence Silence
+	if err := json.NewDecoder(r.Body).Decode(&silence); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid silence: %v", err)))
+		return
+	}
+
+	now := time.Now()
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = now
+	}
+	if silence.EndsAt.IsZero() || !silence.EndsAt.After(silence.StartsAt) || !silence.EndsAt.After(now) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid silence: endsAt must be in the future and after startsAt"))
+		return
+	}
+	if err := silence.compile(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid silence: %v", err)))
+		return
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error creating silence ID: %v", err)))
+		return
+	}
+	silence.ID = id
+	silence.CreatedAt = now
+
+	// The silence only takes effect once it is persisted
+	silences.Lock()
+	silences.byID[id] = &silence
+	err = saveSilences()
+	if err != nil {
+		delete(silences.byID, id)
+	}
+	silences.Unlock()
+	if err != nil {
+		state.Logger.Error("Error saving silences", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error saving silence: %v", err)))
+		return
+	}
+
+	state.Logger.Info("Silence created", "silenceId", id, "createdBy", silence.CreatedBy,
+		"endsAt", silence.EndsAt, "comment", silence.Comment)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"silenceId": id,
+	})
+}
+
+// expireSilence ends a silence immediately, it stays listed as expired
+func expireSilence(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	silences.Lock()
+	silence, ok := silences.byID[id]
+	var err error
+	if ok {
+		startsAt, endsAt := silence.StartsAt, silence.EndsAt
+		now := time.Now()
+		if silence.EndsAt.After(now) {
+			silence.EndsAt = now
+		}
+		if silence.StartsAt.After(now) {
+			silence.StartsAt = now
+		}
+		// Keep the silence active if the expiry cannot be persisted
+		if err = saveSilences(); err != nil {
+			silence.StartsAt, silence.EndsAt = startsAt, endsAt
+		}
+	}
+	silences.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Silence %q not found", id)))
+		return
+	}
+	if err != nil {
+		state.Logger.Error("Error saving silences", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error saving silence: %v", err)))
+		return
+	}
+	state.Logger.Info("Silence expired", "silenceId", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"silenceId": id,
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSilenceWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		silences.Lock()
+		silences.file = ""
+		silences.byID = map[string]*Silence{}
+		silences.Unlock()
+	})
+	// setWritable points the silences at a file that can or cannot be written
+	setWritable := func(writable bool) {
+		silences.Lock()
+		defer silences.Unlock()
+		silences.file = filepath.Join(dir, "silences.json")
+		if !writable {
+			silences.file = filepath.Join(dir, "missing", "silences.json")
+		}
+	}
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleSilences(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	body := fmt.Sprintf(`{"matchers": [{"name": "deviceId", "value": "cam1"}], "endsAt": %q}`,
+		time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	setWritable(false)
+	if rec := serve(http.MethodPost, "/api/silences", body); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for an unsaved silence, want 500", rec.Code)
+	}
+	if checkSilences(&Event{DeviceID: "cam1"}) {
+		t.Error("got the unsaved silence applied")
+	}
+
+	setWritable(true)
+	rec := serve(http.MethodPost, "/api/silences", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		SilenceID string `json:"silenceId"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	setWritable(false)
+	if rec := serve(http.MethodDelete, "/api/silences?id="+created.SilenceID, ""); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for an unsaved expiry, want 500", rec.Code)
+	}
+	if !checkSilences(&Event{DeviceID: "cam1"}) {
+		t.Error("got the silence expired although the expiry was not saved")
+	}
+
+	setWritable(true)
+	if rec := serve(http.MethodDelete, "/api/silences?id="+created.SilenceID, ""); rec.Code != http.StatusOK {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
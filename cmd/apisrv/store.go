@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStoreConfig configures the persistent event history
+type EventStoreConfig struct {
+	Enabled bool `json:"enabled"`
+	// Dir holds the daily segment files, defaults to "events"
+	Dir string `json:"dir,omitempty"`
+	// Retention limits how long and how many events are kept, events are kept forever by default
+	Retention RetentionConfig `json:"retention"`
+	// PurgeInterval is how often the retention is enforced, defaults to 1h
+	PurgeInterval string `json:"purge_interval,omitempty"`
+}
+
+// RetentionConfig limits the stored events by age, count and event type.
+// Ages accept Go durations and days, e.g. "36h" or "30d".
+type RetentionConfig struct {
+	// MaxAge is how long events are kept unless their type has its own age
+	MaxAge string `json:"max_age,omitempty"`
+	// MaxEvents caps the number of stored events, the oldest are purged first
+	MaxEvents int `json:"max_events,omitempty"`
+	// EventTypes sets the age per event type, e.g. {"MotionDetection": "30d"}
+	EventTypes map[string]string `json:"event_types,omitempty"`
+}
+
+// Events are stored as JSON lines in one segment file per UTC day
+const (
+	segmentPrefix = "events-"
+	segmentSuffix = ".jsonl"
+	segmentLayout = "2006-01-02"
+)
+
+// maxStoredLine bounds the size of one stored event, raw payloads included
+const maxStoredLine = 16 << 20
+
+// storedEvent is one line of a segment file; unlike the event itself it keeps the raw payload
+type storedEvent struct {
+	ID int64 `json:"id"`
+	*Event
+	Raw string `json:"raw,omitempty"`
+}
+
+// segmentEntry is the part of a stored event needed to enforce the retention
+type segmentEntry struct {
+	EventType  string    `json:"eventType"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// purgeResult reports what a purge removed
+type purgeResult struct {
+	At              time.Time `json:"at"`
+	Removed         int       `json:"removed"`
+	Remaining       int       `json:"remaining"`
+	SegmentsDeleted int       `json:"segmentsDeleted"`
+	Duration        string    `json:"duration"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// eventStore appends events to the segment of the day they were received
+var eventStore = struct {
+	sync.Mutex
+	enabled   bool
+	dir       string
+	maxAge    time.Duration
+	maxEvents int
+	typeAges  map[string]time.Duration
+	nextID    int64
+	file      *os.File
+	day       string
+	// rewriting is the day of the segment being purged, appends to it wait for rewritten
+	rewriting string
+	rewritten *sync.Cond
+}{}
+
+// eventPurge serializes purges and usage reports. They read every segment
+// without holding eventStore, so ingest is not held up by a scan of the history.
+var eventPurge = struct {
+	sync.Mutex
+	lastPurge *purgeResult
+	// counts caches the number of events per segment, valid while its size is unchanged
+	counts map[string]segmentCount
+}{counts: map[string]segmentCount{}}
+
+// segmentCount is the cached number of events of a segment file of the given size
+type segmentCount struct {
+	size   int64
+	events int
+}
+
+// openEventStore prepares the store directory, resumes the event IDs and starts the purge job
+func openEventStore(ctx context.Context, cfg EventStoreConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "events"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	maxAge, err := parseRetentionAge(cfg.Retention.MaxAge)
+	if err != nil {
+		return fmt.Errorf("invalid max_age: %v", err)
+	}
+	typeAges := map[string]time.Duration{}
+	for eventType, value := range cfg.Retention.EventTypes {
+		typeAges[eventType], err = parseRetentionAge(value)
+		if err != nil {
+			return fmt.Errorf("invalid retention of %s: %v", eventType, err)
+		}
+	}
+	purgeInterval, err := parseDurationDefault(cfg.PurgeInterval, time.Hour)
+	if err != nil {
+		return fmt.Errorf("invalid purge_interval: %v", err)
+	}
+
+	eventStore.Lock()
+	defer eventStore.Unlock()
+	eventStore.enabled = true
+	eventStore.rewritten = sync.NewCond(&eventStore.Mutex)
+	eventStore.dir = dir
+	eventStore.maxAge = maxAge
+	eventStore.maxEvents = cfg.Retention.MaxEvents
+	eventStore.typeAges = typeAges
+
+	// Continue after the last ID of the newest segment
+	segments, err := listSegments()
+	if err != nil {
+		return err
+	}
+	for i := len(segments) - 1; i >= 0 && eventStore.nextID == 0; i-- {
+		err := readSegment(segments[i], func(stored *storedEvent) bool {
+			eventStore.nextID = max(eventStore.nextID, stored.ID)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	eventStore.nextID++
+
+	state.Logger.Info("Storing events", "dir", dir, "segments", len(segments),
+		"purgeInterval", purgeInterval.String())
+	go runPurge(ctx, purgeInterval)
+	return nil
+}
+
+// parseRetentionAge parses a Go duration or a number of days such as "30d", empty means no limit
+func parseRetentionAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// storeEvent appends the event to the store, failures are logged and do not stop the pipeline
+func storeEvent(event *Event) {
+	eventStore.Lock()
+	defer eventStore.Unlock()
+	if !eventStore.enabled {
+		return
+	}
+
+	stored := storedEvent{ID: eventStore.nextID, Event: event, Raw: event.Raw}
+	line, err := json.Marshal(stored)
+	if err != nil {
+		event.logger().Error("Error storing event", "error", err)
+		return
+	}
+
+	day := event.ReceivedAt.UTC().Format(segmentLayout)
+	for eventStore.rewriting == day {
+		eventStore.rewritten.Wait()
+	}
+	if eventStore.file == nil || eventStore.day != day {
+		closeSegment()
+		file, err := os.OpenFile(segmentPath(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			event.logger().Error("Error storing event", "error", err)
+			return
+		}
+		eventStore.file = file
+		eventStore.day = day
+	}
+
+	if _, err := eventStore.file.Write(append(line, '\n')); err != nil {
+		event.logger().Error("Error storing event", "error", err)
+		return
+	}
+	eventStore.nextID++
+}
+
+// closeSegment closes the segment being appended to. The caller must hold eventStore.
+func closeSegment() {
+	if eventStore.file != nil {
+		eventStore.file.Close()
+		eventStore.file = nil
+		eventStore.day = ""
+	}
+}
+
+// segmentPath returns the segment file of the given day
+func segmentPath(day string) string {
+	return filepath.Join(eventStore.dir, segmentPrefix+day+segmentSuffix)
+}
+
+// segmentDay returns the day a segment file covers
+func segmentDay(file string) (time.Time, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), segmentPrefix), segmentSuffix)
+	return time.Parse(segmentLayout, name)
+}
+
+// listSegments returns the segment files, oldest first
+func listSegments() ([]string, error) {
+	entries, err := os.ReadDir(eventStore.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		if _, err := segmentDay(name); err != nil {
+			continue
+		}
+		segments = append(segments, filepath.Join(eventStore.dir, name))
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// readSegment calls fn for every event of a segment until it returns false.
+// Lines that cannot be decoded, e.g. cut short by a crash, are skipped.
+func readSegment(file string, fn func(stored *storedEvent) bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxStoredLine)
+	for scanner.Scan() {
+		var stored storedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &stored); err != nil || stored.Event == nil {
+			continue
+		}
+		if !fn(&stored) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// eventQuery selects stored events; empty fields match everything
+type eventQuery struct {
+	from, to                                      time.Time
+	vendor, deviceID, channelID, eventType, state string
+	limit, offset                                 int
+	ascending                                     bool
+}
+
+// matches reports whether a stored event is selected by the query
+func (q *eventQuery) matches(event *Event) bool {
+	if !q.from.IsZero() && event.ReceivedAt.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && !event.ReceivedAt.Before(q.to) {
+		return false
+	}
+	if q.state != "" && !strings.EqualFold(q.state, event.State) {
+		return false
+	}
+	return globMatch(q.vendor, event.Vendor) &&
+		globMatch(q.deviceID, event.DeviceID) &&
+		globMatch(q.channelID, event.ChannelID) &&
+		globMatch(q.eventType, event.EventType)
+}
+
+// queryEvents returns one page of matching events ordered by the time they were
+// received, and whether more follow. Only the segments of the time range are read.
+func queryEvents(q eventQuery) ([]storedEvent, bool, error) {
+	eventStore.Lock()
+	segments, err := listSegments()
+	eventStore.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	if !q.ascending {
+		sort.Sort(sort.Reverse(sort.StringSlice(segments)))
+	}
+
+	wanted := q.offset + q.limit + 1
+	var matched []storedEvent
+	for _, segment := range segments {
+		day, err := segmentDay(segment)
+		if err != nil {
+			continue
+		}
+		if (!q.to.IsZero() && !day.Before(q.to)) || (!q.from.IsZero() && !day.Add(24*time.Hour).After(q.from)) {
+			continue
+		}
+
+		var inSegment []storedEvent
+		err = readSegment(segment, func(stored *storedEvent) bool {
+			if q.matches(stored.Event) {
+				inSegment = append(inSegment, *stored)
+			}
+			return true
+		})
+		if os.IsNotExist(err) {
+			// Deleted by a purge meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Events are appended as they arrive, so a segment is already in ascending order
+		if !q.ascending {
+			for i, j := 0, len(inSegment)-1; i < j; i, j = i+1, j-1 {
+				inSegment[i], inSegment[j] = inSegment[j], inSegment[i]
+			}
+		}
+		matched = append(matched, inSegment...)
+		if len(matched) >= wanted {
+			break
+		}
+	}
+
+	if q.offset >= len(matched) {
+		return []storedEvent{}, false, nil
+	}
+	page := matched[q.offset:]
+	hasMore := len(page) > q.limit
+	if hasMore {
+		page = page[:q.limit]
+	}
+	return page, hasMore, nil
+}
+
+// handleListEvents queries the event history. Parameters: from and to (RFC 3339,
+// on the time received), vendor, device, channel and type (glob patterns), state,
+// limit (default 100, at most 1000), offset and sort (desc by default, or asc).
+func handleListEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+	if !eventStoreEnabled() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Event store is not enabled"))
+		return
+	}
+
+	params := r.URL.Query()
+	q := eventQuery{
+		vendor:    params.Get("vendor"),
+		deviceID:  params.Get("device"),
+		channelID: params.Get("channel"),
+		eventType: params.Get("type"),
+		state:     params.Get("state"),
+		limit:     100,
+	}
+
+	var err error
+	for name, target := range map[string]*time.Time{"from": &q.from, "to": &q.to} {
+		if value := params.Get(name); value != "" {
+			if *target, err = time.Parse(time.RFC3339, value); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Invalid %s %q, expected RFC 3339", name, value)))
+				return
+			}
+		}
+	}
+	for name, target := range map[string]*int{"limit": &q.limit, "offset": &q.offset} {
+		if value := params.Get(name); value != "" {
+			if *target, err = strconv.Atoi(value); err != nil || *target < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Invalid %s %q", name, value)))
+				return
+			}
+		}
+	}
+	if q.limit == 0 || q.limit > 1000 {
+		q.limit = 1000
+	}
+	switch strings.ToLower(params.Get("sort")) {
+	case "", "desc":
+	case "asc":
+		q.ascending = true
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid sort, expected asc or desc"))
+		return
+	}
+
+	events, hasMore, err := queryEvents(q)
+	if err != nil {
+		state.Logger.Error("Error querying events", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error querying events: %v", err)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events":  events,
+		"count":   len(events),
+		"offset":  q.offset,
+		"limit":   q.limit,
+		"hasMore": hasMore,
+	})
+}
+
+// eventStoreEnabled reports whether events are being stored
+func eventStoreEnabled() bool {
+	eventStore.Lock()
+	defer eventStore.Unlock()
+	return eventStore.enabled
+}
+
+// runPurge enforces the retention at startup and then periodically until the context ends
+func runPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result := purgeEvents(time.Now())
+		if result.Error != "" {
+			state.Logger.Error("Error purging events", "error", result.Error)
+		} else if result.Removed > 0 {
+			state.Logger.Info("Purged events", "removed", result.Removed,
+				"segmentsDeleted", result.SegmentsDeleted, "remaining", result.Remaining)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeEvents removes the events beyond their retention age, then the oldest
+// events beyond the maximum count. Segments are rewritten in place and deleted
+// once empty; only appending to the segment being rewritten waits.
+func purgeEvents(now time.Time) (result purgeResult) {
+	started := time.Now()
+	result.At = now
+
+	eventPurge.Lock()
+	defer eventPurge.Unlock()
+	defer func() {
+		result.Duration = time.Since(started).Round(time.Millisecond).String()
+		eventPurge.lastPurge = &result
+	}()
+
+	segments, err := listSegments()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// Segments newer than the shortest age cannot hold expired events, and
+	// unless some events are kept forever those older than the longest age
+	// hold nothing else
+	shortest, longest := eventStore.maxAge, eventStore.maxAge
+	forever := eventStore.maxAge == 0
+	for _, age := range eventStore.typeAges {
+		if age == 0 {
+			forever = true
+			continue
+		}
+		if shortest == 0 || age < shortest {
+			shortest = age
+		}
+		longest = max(longest, age)
+	}
+
+	var kept []string
+	counts := map[string]int{}
+	for _, segment := range segments {
+		day, err := segmentDay(segment)
+		if err != nil {
+			continue
+		}
+		end := day.Add(24 * time.Hour)
+
+		var remaining, removed int
+		switch {
+		case shortest == 0 || end.After(now.Add(-shortest)):
+			remaining, err = countSegment(segment)
+		case !forever && !end.After(now.Add(-longest)):
+			remaining, removed, err = purgeSegment(segment, func(segmentEntry, int) bool { return false })
+		default:
+			remaining, removed, err = purgeSegment(segment, func(entry segmentEntry, _ int) bool {
+				age, ok := eventStore.typeAges[entry.EventType]
+				if !ok {
+					age = eventStore.maxAge
+				}
+				return age == 0 || entry.ReceivedAt.After(now.Add(-age))
+			})
+		}
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		result.Removed += removed
+		if remaining == 0 {
+			if removed > 0 {
+				result.SegmentsDeleted++
+			}
+			continue
+		}
+		kept = append(kept, segment)
+		counts[segment] = remaining
+		result.Remaining += remaining
+	}
+
+	// Drop the oldest events beyond the maximum count
+	excess := 0
+	if eventStore.maxEvents > 0 {
+		excess = result.Remaining - eventStore.maxEvents
+	}
+	for _, segment := range kept {
+		if excess <= 0 {
+			break
+		}
+		drop := excess
+		remaining, removed, err := purgeSegment(segment, func(_ segmentEntry, index int) bool { return index >= drop })
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if remaining == 0 {
+			result.SegmentsDeleted++
+		}
+		excess -= removed
+		result.Removed += removed
+		result.Remaining -= removed
+	}
+	return result
+}
+
+// purgeSegment rewrites a segment while appends to it wait, appends to the
+// other segments go on. The caller must hold eventPurge.
+func purgeSegment(segment string, keep func(entry segmentEntry, index int) bool) (int, int, error) {
+	day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(segment), segmentPrefix), segmentSuffix)
+	eventStore.Lock()
+	eventStore.rewriting = day
+	if eventStore.day == day {
+		// The segment is reopened by the next event once it was rewritten
+		closeSegment()
+	}
+	eventStore.Unlock()
+
+	defer func() {
+		eventStore.Lock()
+		eventStore.rewriting = ""
+		eventStore.rewritten.Broadcast()
+		eventStore.Unlock()
+	}()
+	delete(eventPurge.counts, segment)
+	return rewriteSegment(segment, keep)
+}
+
+// countSegment returns the number of events of a segment, scanning it only when
+// it changed since the last count. The caller must hold eventPurge.
+func countSegment(segment string) (int, error) {
+	info, err := os.Stat(segment)
+	if err != nil {
+		return 0, err
+	}
+	if cached, ok := eventPurge.counts[segment]; ok && cached.size == info.Size() {
+		return cached.events, nil
+	}
+	events, _, err := rewriteSegment(segment, nil)
+	if err != nil {
+		return 0, err
+	}
+	eventPurge.counts[segment] = segmentCount{size: info.Size(), events: events}
+	return events, nil
+}
+
+// rewriteSegment keeps the events of a segment for which keep returns true, a
+// nil keep only counts them. The segment is replaced through a temporary file
+// and deleted when nothing remains. Lines that cannot be decoded are dropped.
+func rewriteSegment(file string, keep func(entry segmentEntry, index int) bool) (int, int, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	var out *bufio.Writer
+	var tmp *os.File
+	if keep != nil {
+		tmp, err = os.Create(file + ".tmp")
+		if err != nil {
+			return 0, 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		out = bufio.NewWriter(tmp)
+	}
+
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), maxStoredLine)
+	remaining, removed, index := 0, 0, 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if keep == nil {
+			remaining++
+			continue
+		}
+
+		var entry segmentEntry
+		if err := json.Unmarshal(line, &entry); err != nil || !keep(entry, index) {
+			removed++
+			index++
+			continue
+		}
+		index++
+		remaining++
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if keep == nil || removed == 0 {
+		return remaining, removed, nil
+	}
+
+	if remaining == 0 {
+		src.Close()
+		return 0, removed, os.Remove(file)
+	}
+	if err := out.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, 0, err
+	}
+	return remaining, removed, os.Rename(tmp.Name(), file)
+}
+
+// storageUsage reports the size of the store. The caller must hold eventPurge.
+func storageUsage() (map[string]interface{}, error) {
+	segments, err := listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	events := 0
+	for _, segment := range segments {
+		count, err := countSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		size += eventPurge.counts[segment].size
+		events += count
+	}
+	// Forget the segments deleted meanwhile
+	for segment := range eventPurge.counts {
+		if !slices.Contains(segments, segment) {
+			delete(eventPurge.counts, segment)
+		}
+	}
+
+	usage := map[string]interface{}{
+		"dir":      eventStore.dir,
+		"segments": len(segments),
+		"bytes":    size,
+		"events":   events,
+	}
+	if len(segments) > 0 {
+		oldest, _ := segmentDay(segments[0])
+		newest, _ := segmentDay(segments[len(segments)-1])
+		usage["oldestDay"] = oldest.Format(segmentLayout)
+		usage["newestDay"] = newest.Format(segmentLayout)
+	}
+	if eventPurge.lastPurge != nil {
+		usage["lastPurge"] = eventPurge.lastPurge
+	}
+	return usage, nil
+}
+
+// handleStorage reports the storage usage of the event store (GET) or purges it now (POST)
+func handleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET and POST methods are supported"))
+		return
+	}
+	if !eventStoreEnabled() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Event store is not enabled"))
+		return
+	}
+
+	response := map[string]interface{}{"status": "success"}
+	if r.Method == http.MethodPost {
+		result := purgeEvents(time.Now())
+		state.Logger.Info("Manual purge", "removed", result.Removed,
+			"segmentsDeleted", result.SegmentsDeleted, "remaining", result.Remaining)
+		if result.Error != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("Error purging events: %s", result.Error)))
+			return
+		}
+		response["purge"] = result
+	}
+
+	eventPurge.Lock()
+	usage, err := storageUsage()
+	eventPurge.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error reading event store: %v", err)))
+		return
+	}
+	response["usage"] = usage
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestEventStore points the event store at a temporary directory
+func openTestEventStore(t *testing.T, maxAge time.Duration, maxEvents int, typeAges map[string]time.Duration) string {
+	dir := t.TempDir()
+	eventStore.Lock()
+	eventStore.enabled = true
+	eventStore.rewritten = sync.NewCond(&eventStore.Mutex)
+	eventStore.dir = dir
+	eventStore.maxAge = maxAge
+	eventStore.maxEvents = maxEvents
+	eventStore.typeAges = typeAges
+	eventStore.nextID = 1
+	eventStore.Unlock()
+
+	t.Cleanup(func() {
+		eventStore.Lock()
+		closeSegment()
+		eventStore.enabled = false
+		eventStore.Unlock()
+		eventPurge.Lock()
+		eventPurge.counts = map[string]segmentCount{}
+		eventPurge.lastPurge = nil
+		eventPurge.Unlock()
+	})
+	return dir
+}
+
+// storeTestEvent stores an event received at the given time
+func storeTestEvent(eventType string, receivedAt time.Time) {
+	storeEvent(&Event{Vendor: "Test", EventType: eventType, DeviceID: "cam1", ReceivedAt: receivedAt})
+}
+
+// segmentEvents returns the number of events per segment day
+func segmentEvents(t *testing.T, dir string) map[string]int {
+	segments, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, segment := range segments {
+		day, _ := segmentDay(segment)
+		err := readSegment(segment, func(*storedEvent) bool {
+			counts[day.Format(segmentLayout)]++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return counts
+}
+
+func TestPurgeEventsByAge(t *testing.T) {
+	dir := openTestEventStore(t, 7*24*time.Hour, 0, map[string]time.Duration{"MotionDetection": 24 * time.Hour})
+	now := time.Date(2026, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 1, 8, 0, 0, 0, time.UTC))
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 5, 8, 0, 0, 0, time.UTC))
+	storeTestEvent("MotionDetection", time.Date(2026, time.March, 8, 8, 0, 0, 0, time.UTC))
+	storeTestEvent("MotionDetection", time.Date(2026, time.March, 10, 10, 0, 0, 0, time.UTC))
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 10, 11, 0, 0, 0, time.UTC))
+
+	result := purgeEvents(now)
+	if result.Error != "" {
+		t.Fatal(result.Error)
+	}
+	if result.Removed != 2 || result.Remaining != 3 || result.SegmentsDeleted != 2 {
+		t.Errorf("got removed %d, remaining %d, segments deleted %d, want 2, 3, 2",
+			result.Removed, result.Remaining, result.SegmentsDeleted)
+	}
+
+	got := segmentEvents(t, dir)
+	want := map[string]int{"2026-03-05": 1, "2026-03-10": 2}
+	if len(got) != len(want) || got["2026-03-05"] != 1 || got["2026-03-10"] != 2 {
+		t.Errorf("got segments %v, want %v", got, want)
+	}
+}
+
+func TestPurgeEventsByCount(t *testing.T) {
+	dir := openTestEventStore(t, 0, 3, nil)
+	now := time.Date(2026, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 9, 8, 0, 0, 0, time.UTC))
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 9, 9, 0, 0, 0, time.UTC))
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 10, 8, 0, 0, 0, time.UTC))
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 10, 9, 0, 0, 0, time.UTC))
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 10, 10, 0, 0, 0, time.UTC))
+
+	// The segment being appended to is rewritten as well
+	if result := purgeEvents(now); result.Removed != 2 || result.Remaining != 3 || result.SegmentsDeleted != 1 {
+		t.Errorf("got %+v, want 2 removed, 3 remaining and 1 segment deleted", result)
+	}
+	if result := purgeEvents(now); result.Removed != 0 || result.Remaining != 3 {
+		t.Errorf("got %+v on the second purge, want nothing removed", result)
+	}
+
+	// Appending continues in the rewritten segment
+	storeTestEvent("VideoLoss", time.Date(2026, time.March, 10, 11, 0, 0, 0, time.UTC))
+	if got := segmentEvents(t, dir); len(got) != 1 || got["2026-03-10"] != 4 {
+		t.Errorf("got segments %v, want 4 events on 2026-03-10", got)
+	}
+}
+
+func TestStorageUsageCountsChangedSegments(t *testing.T) {
+	dir := openTestEventStore(t, 0, 0, nil)
+	receivedAt := time.Date(2026, time.March, 10, 8, 0, 0, 0, time.UTC)
+	storeTestEvent("VideoLoss", receivedAt)
+
+	usage := func() map[string]interface{} {
+		eventPurge.Lock()
+		defer eventPurge.Unlock()
+		usage, err := storageUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return usage
+	}
+	if events := usage()["events"]; events != 1 {
+		t.Errorf("got %v events, want 1", events)
+	}
+
+	// The cached count is not used once the segment grew
+	storeTestEvent("VideoLoss", receivedAt.Add(time.Hour))
+	if events := usage()["events"]; events != 2 {
+		t.Errorf("got %v events, want 2", events)
+	}
+
+	if err := os.Remove(filepath.Join(dir, segmentPrefix+"2026-03-10"+segmentSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if got := usage(); got["events"] != 0 || got["segments"] != 0 {
+		t.Errorf("got %v, want an empty store", got)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	registerNotifier("telegram", newTelegramNotifier)
+}
+
+// telegramNotifier sends event information to a Telegram chat/bot
+type telegramNotifier struct {
+	cfg NotifierConfig
+}
+
+// newTelegramNotifier creates a Telegram notifier
+func newTelegramNotifier(cfg NotifierConfig) (Notifier, error) {
+	if cfg.TelegramToken == "" || cfg.TelegramChatID == "" {
+		return nil, fmt.Errorf("telegram notifier requires telegram_token and telegram_chat_id")
+	}
+	return &telegramNotifier{cfg: cfg}, nil
+}
+
+func (n *telegramNotifier) Name() string { return n.cfg.Name }
+
+func (n *telegramNotifier) Type() string { return "telegram" }
+
+// SendsHTML has rule templates escape the event fields, messages are sent with parse_mode HTML
+func (n *telegramNotifier) SendsHTML() bool { return true }
+
+// Notify sends the formatted event to the configured chat. Attached images are
+// sent as photos, with the message as caption when it fits.
+func (n *telegramNotifier) Notify(ctx context.Context, event *Event) error {
+	// Format the message based on event type, unless a rule template rendered one
+	message := event.Message
+	if message == "" {
+		message = formatTelegramMessage(event)
+	}
+
+	images := event.images()
+	if len(images) > 0 && len(message) <= telegramCaptionLimit {
+		if err := n.sendPhoto(ctx, images[0], message); err != nil {
+			return err
+		}
+		for _, image := range images[1:] {
+			if err := n.sendPhoto(ctx, image, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := n.sendMessage(ctx, message); err != nil {
+		return err
+	}
+	for _, image := range images {
+		if err := n.sendPhoto(ctx, image, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// telegramCaptionLimit is the maximum length of a photo caption
+const telegramCaptionLimit = 1024
+
+// sendMessage sends a text message to the configured chat
+func (n *telegramNotifier) sendMessage(ctx context.Context, message string) error {
+	// Construct the Telegram Bot API URL
+	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", n.cfg.TelegramToken)
+
+	// Prepare the request data
+	data := url.Values{}
+	data.Set("chat_id", n.cfg.TelegramChatID)
+	data.Set("text", message)
+	data.Set("parse_mode", "HTML") // Enable HTML formatting
+
+	// Send the request
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkTelegramResponse(resp)
+}
+
+// sendPhoto uploads an image to the configured chat with an optional caption
+func (n *telegramNotifier) sendPhoto(ctx context.Context, image Attachment, caption string) error {
+	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendPhoto", n.cfg.TelegramToken)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("chat_id", n.cfg.TelegramChatID)
+	if caption != "" {
+		writer.WriteField("caption", caption)
+		writer.WriteField("parse_mode", "HTML")
+	}
+
+	name := image.Name
+	if name == "" {
+		name = "snapshot.jpg"
+	}
+	photo, err := writer.CreateFormFile("photo", name)
+	if err != nil {
+		return err
+	}
+	photo.Write(image.Data)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkTelegramResponse(resp)
+}
+
+// checkTelegramResponse turns an error status of the Bot API into an error
+func checkTelegramResponse(resp *http.Response) error {
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("telegram API error: status=%d, response=%s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// formatTelegramMessage creates a human-readable message for Telegram
+func formatTelegramMessage(event *Event) string {
+	// Vivotek keeps the generic NVR header, other vendors get their own
+	title := "🚨 NVR Alert"
+	if event.Vendor != "" && event.Vendor != VendorVivotek {
+		title = fmt.Sprintf("🔔 %s Alarm", html.EscapeString(event.Vendor))
+	}
+
+	// Basic message with event details, all fields from the payload are escaped for parse_mode HTML
+	message := fmt.Sprintf("<b>%s</b>\n\n"+
+		"<b>Event:</b> %s\n"+
+		"<b>Time:</b> %s\n"+
+		"<b>Device:</b> %s\n"+
+		"<b>Channel:</b> %s\n",
+		title,
+		html.EscapeString(event.EventType),
+		event.EventTime.Format("2006-01-02 15:04:05"),
+		telegramDeviceName(event),
+		html.EscapeString(event.ChannelID))
+
+	// Add the site from the device inventory
+	if event.Device != nil && event.Device.Site != "" {
+		site := html.EscapeString(event.Device.Site)
+		if event.Device.Location != "" {
+			site += " / " + html.EscapeString(event.Device.Location)
+		}
+		message += fmt.Sprintf("<b>Site:</b> %s\n", site)
+	}
+
+	// Add description if available
+	if desc, ok := event.EventDetails["description"].(string); ok && desc != "" {
+		message += fmt.Sprintf("<b>Description:</b> %s\n", html.EscapeString(desc))
+	}
+
+	// Name the camera and the region that triggered, preferring the inventory name
+	camera, _ := event.EventDetails["channelName"].(string)
+	if event.Device != nil && event.Device.Camera != "" {
+		camera = event.Device.Camera
+	}
+	if camera != "" {
+		message += fmt.Sprintf("<b>Camera:</b> %s\n", html.EscapeString(camera))
+	}
+	if region, ok := event.EventDetails["regionId"]; ok {
+		message += fmt.Sprintf("<b>Region:</b> %s\n", html.EscapeString(fmt.Sprint(region)))
+	}
+	if target, ok := event.EventDetails["targetType"].(string); ok && target != "" {
+		message += fmt.Sprintf("<b>Target:</b> %s\n", html.EscapeString(target))
+	}
+
+	if event.Suppressed > 0 {
+		message += fmt.Sprintf("<i>+%d similar events suppressed</i>\n", event.Suppressed)
+	}
+
+	// The end of an incident only needs its duration
+	if event.Incident != nil && event.Incident.Phase == IncidentEnded {
+		message += fmt.Sprintf("✅ <b>Ended</b> after %s (%d events)", event.Incident.Duration, event.Incident.EventCount)
+		return message
+	}
+
+	// Add custom message based on event type
+	switch event.EventType {
+	case "MotionDetection":
+		message += "📹 <b>Motion detected!</b>"
+
+		// Add zone info if available
+		if zone, ok := event.EventDetails["zoneId"].(string); ok {
+			message += fmt.Sprintf(" (Zone: %s)", html.EscapeString(zone))
+		}
+
+	case "LineCrossing":
+		message += "🚷 <b>Line crossing detected!</b>"
+
+	case "IntrusionDetection":
+		message += "🚨 <b>Intrusion detected!</b>"
+
+	case "FaceDetection":
+		message += "👤 <b>Face detected!</b>"
+
+	case "IOAlarm":
+		message += "🔌 <b>I/O Alarm triggered!</b>"
+
+	case "TamperDetection":
+		message += "⚠️ <b>Camera tampering detected!</b>"
+
+	case "VideoLoss":
+		message += "⚠️ <b>Video signal lost!</b> Please check camera connection."
+
+	case "StorageFailure":
+		message += "💾 <b>Storage failure!</b> Check NVR hard drive."
+
+	case "LicensePlateRecognition":
+		message += "🚗 <b>Vehicle detected!</b>"
+
+	case "IllegalAccess":
+		message += "🔐 <b>Illegal login attempt!</b>"
+
+	case "NetworkFailure":
+		message += "🌐 <b>Network failure!</b> Check cabling and IP configuration."
+
+	case "DeviceConnection":
+		if event.State == EventStateInactive {
+			message += "❌ <b>Device disconnected!</b> Network issue possible."
+		} else {
+			message += "✅ <b>Device connected</b> and operating normally."
+		}
+
+	default:
+		// Add any available details for unknown event types
+		message += fmt.Sprintf("\n<b>State:</b> %s", html.EscapeString(event.State))
+		detailsJSON, _ := json.Marshal(event.EventDetails)
+		if len(detailsJSON) > 0 {
+			message += fmt.Sprintf("\n<pre>%s</pre>", html.EscapeString(string(detailsJSON)))
+		}
+	}
+
+	return message
+}
+
+// telegramDeviceName returns the inventory name with the device ID, or just the ID
+func telegramDeviceName(event *Event) string {
+	if event.Device == nil || event.Device.Name == "" {
+		return html.EscapeString(event.DeviceID)
+	}
+	return fmt.Sprintf("%s (%s)", html.EscapeString(event.Device.Name), html.EscapeString(event.DeviceID))
+}
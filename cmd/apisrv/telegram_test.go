@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatTelegramMessageEscapes(t *testing.T) {
+	message := formatTelegramMessage(&Event{
+		Vendor:    "HIKVision",
+		EventType: "Custom<Event>",
+		EventTime: time.Date(2026, time.March, 1, 8, 0, 0, 0, time.UTC),
+		DeviceID:  "cam<1>",
+		ChannelID: "Channel&1",
+		State:     "active</b>",
+		Device:    &DeviceInfo{Name: "Gate & Yard"},
+		EventDetails: map[string]interface{}{
+			"description": "<i>open</i>",
+			"regionId":    "<2>",
+		},
+	})
+
+	for _, raw := range []string{"<Event>", "<1>", "&1", "active</b>", "<i>open</i>", "<2>", "Gate & Yard"} {
+		if strings.Contains(message, raw) {
+			t.Errorf("got unescaped %q in %s", raw, message)
+		}
+	}
+	for _, escaped := range []string{"Custom&lt;Event&gt;", "Gate &amp; Yard (cam&lt;1&gt;)", "Channel&amp;1",
+		"&lt;i&gt;open&lt;/i&gt;", "active&lt;/b&gt;"} {
+		if !strings.Contains(message, escaped) {
+			t.Errorf("got no %q in %s", escaped, message)
+		}
+	}
+}
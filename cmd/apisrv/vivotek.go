@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// VivotekEvent represents the event data structure from Vivotek NVR
+type VivotekEvent struct {
+	EventType    string                 `json:"eventType"`
+	EventTime    time.Time              `json:"eventTime"`
+	DeviceID     string                 `json:"deviceId"`
+	ChannelID    string                 `json:"channelId"`
+	EventDetails map[string]interface{} `json:"eventDetails"`
+	// Add more fields as needed based on Vivotek's event structure
+}
+
+func init() {
+	registerAdapter("vivotek", newVivotekAdapter)
+}
+
+// vivotekAdapter receives JSON event notifications from Vivotek NVRs
+type vivotekAdapter struct {
+	cfg AdapterConfig
+}
+
+// newVivotekAdapter creates the Vivotek ingest adapter
+func newVivotekAdapter(cfg AdapterConfig) (IngestAdapter, error) {
+	return &vivotekAdapter{cfg: cfg}, nil
+}
+
+func (a *vivotekAdapter) Name() string { return VendorVivotek }
+
+func (a *vivotekAdapter) Routes() []string {
+	return adapterRoutes(a.cfg, "/event", "/events")
+}
+
+func (a *vivotekAdapter) Methods() []string { return []string{http.MethodPost} }
+
+func (a *vivotekAdapter) Authenticate(r *http.Request) bool {
+	return checkAdapterAuth(r, a.cfg.Username, a.cfg.Password)
+}
+
+// Parse decodes a Vivotek JSON event
+func (a *vivotekAdapter) Parse(r *http.Request, body []byte) ([]Event, error) {
+	var vivotekEvent VivotekEvent
+	if err := json.Unmarshal(body, &vivotekEvent); err != nil {
+		return nil, fmt.Errorf("error parsing event JSON: %v", err)
+	}
+
+	return []Event{convertVivotekEvent(vivotekEvent, string(body))}, nil
+}
+
+// convertVivotekEvent converts a Vivotek event to our standard event format
+func convertVivotekEvent(vivotekEvent VivotekEvent, rawJSON string) Event {
+	eventState := EventStateActive
+	if vivotekEvent.EventType == "DeviceConnection" {
+		// Vivotek reports connection state through the status detail
+		if status, ok := vivotekEvent.EventDetails["status"].(string); ok && status == "disconnected" {
+			eventState = EventStateInactive
+		}
+	}
+
+	return Event{
+		Vendor:       VendorVivotek,
+		EventType:    vivotekEvent.EventType,
+		EventTime:    vivotekEvent.EventTime,
+		ReceivedAt:   time.Now(),
+		DeviceID:     vivotekEvent.DeviceID,
+		ChannelID:    vivotekEvent.ChannelID,
+		State:        eventState,
+		EventDetails: vivotekEvent.EventDetails,
+		Raw:          rawJSON,
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Probe types used in ProbeConfig.Type
+const (
+	ProbeTCP   = "tcp"
+	ProbeHTTP  = "http"
+	ProbeISAPI = "isapi"
+)
+
+// WatchdogConfig configures the detection of devices that went silent
+type WatchdogConfig struct {
+	Enabled bool `json:"enabled"`
+	// OfflineAfter is how long a device may stay silent before it is reported offline, defaults to 10m
+	OfflineAfter string `json:"offline_after,omitempty"`
+	// CheckInterval is how often devices are checked and probed, defaults to 30s
+	CheckInterval string `json:"check_interval,omitempty"`
+}
+
+// ProbeConfig actively checks that a device is alive
+type ProbeConfig struct {
+	// Type is "tcp", "http" or "isapi"
+	Type string `json:"type"`
+	// Address is host:port for tcp, or the URL (base URL for isapi) otherwise
+	Address  string `json:"address"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// watchedDevice is the last-seen record of one device
+type watchedDevice struct {
+	DeviceID     string     `json:"deviceId"`
+	Vendor       string     `json:"vendor,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	LastSeen     time.Time  `json:"lastSeen"`
+	Online       bool       `json:"online"`
+	OfflineSince *time.Time `json:"offlineSince,omitempty"`
+	LastProbe    *time.Time `json:"lastProbe,omitempty"`
+	ProbeError   string     `json:"probeError,omitempty"`
+
+	offlineAfter time.Duration
+	probe        *ProbeConfig
+}
+
+// watchdog tracks when every device was last seen
+var watchdog = struct {
+	sync.Mutex
+	enabled      bool
+	offlineAfter time.Duration
+	devices      map[string]*watchedDevice
+}{devices: map[string]*watchedDevice{}}
+
+// startWatchdog registers the inventory devices and starts the periodic check
+func startWatchdog(ctx context.Context, cfg WatchdogConfig, devices []DeviceConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	offlineAfter, err := parseDurationDefault(cfg.OfflineAfter, 10*time.Minute)
+	if err != nil {
+		return fmt.Errorf("invalid offline_after: %v", err)
+	}
+	checkInterval, err := parseDurationDefault(cfg.CheckInterval, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("invalid check_interval: %v", err)
+	}
+
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	watchdog.enabled = true
+	watchdog.offlineAfter = offlineAfter
+
+	// Inventory devices are watched from the start, even if they never send anything
+	now := time.Now()
+	for i := range devices {
+		device := &devices[i]
+		if device.ID == "" {
+			if device.Probe != nil {
+				return fmt.Errorf("device %q: probe requires an id", device.Name)
+			}
+			continue
+		}
+
+		watched := &watchedDevice{
+			DeviceID:     device.ID,
+			Name:         device.Name,
+			LastSeen:     now,
+			Online:       true,
+			offlineAfter: offlineAfter,
+			probe:        device.Probe,
+		}
+		if device.OfflineAfter != "" {
+			watched.offlineAfter, err = time.ParseDuration(device.OfflineAfter)
+			if err != nil {
+				return fmt.Errorf("device %q: invalid offline_after: %v", device.ID, err)
+			}
+		}
+		if probe := device.Probe; probe != nil {
+			probe.Type = strings.ToLower(probe.Type)
+			if probe.Type != ProbeTCP && probe.Type != ProbeHTTP && probe.Type != ProbeISAPI {
+				return fmt.Errorf("device %q: unknown probe type %q", device.ID, probe.Type)
+			}
+			if probe.Address == "" {
+				return fmt.Errorf("device %q: probe requires an address", device.ID)
+			}
+		}
+		watchdog.devices[strings.ToLower(device.ID)] = watched
+	}
+
+	state.Logger.Info("Starting device watchdog", "offlineAfter", offlineAfter.String(),
+		"checkInterval", checkInterval.String())
+	go runWatchdog(ctx, checkInterval)
+	return nil
+}
+
+// recordSeen marks the device of the event as seen and reports a reconnect if it
+// was offline. Only inventory devices and devices sending heartbeats are watched,
+// devices that post on motion only would otherwise go offline whenever it is quiet.
+func recordSeen(event *Event) {
+	markSeen(event, false)
+}
+
+// recordHeartbeat marks the device as seen for heartbeats and empty pulls, which
+// prove the device is alive without being dispatched. Unknown devices are watched
+// from their first heartbeat on.
+func recordHeartbeat(event *Event) {
+	markSeen(event, true)
+}
+
+// markSeen updates the last-seen record of the event's device, adding it if asked to
+func markSeen(event *Event, add bool) {
+	// A device reporting its own disconnect has not been seen
+	if event.EventType == "DeviceConnection" && event.State == EventStateInactive {
+		return
+	}
+
+	// Inventory devices are watched under their inventory ID, which events
+	// identified by MAC or IP address do not carry
+	deviceID, name := event.DeviceID, ""
+	if state.Devices != nil {
+		if device := state.Devices.lookup(event); device != nil {
+			name = device.Name
+			if device.ID != "" {
+				deviceID = device.ID
+			}
+		}
+	}
+
+	watchdog.Lock()
+	if !watchdog.enabled || deviceID == "" {
+		watchdog.Unlock()
+		return
+	}
+
+	key := strings.ToLower(deviceID)
+	watched, ok := watchdog.devices[key]
+	if !ok {
+		if !add {
+			watchdog.Unlock()
+			return
+		}
+		watched = &watchedDevice{
+			DeviceID:     deviceID,
+			Name:         name,
+			Online:       true,
+			offlineAfter: watchdog.offlineAfter,
+		}
+		watchdog.devices[key] = watched
+	}
+	watched.LastSeen = time.Now()
+	watched.Vendor = event.Vendor
+
+	reconnected := !watched.Online
+	watched.Online = true
+	watched.OfflineSince = nil
+	snapshot := *watched
+	watchdog.Unlock()
+
+	// Devices that report their own reconnect do not need a synthetic one
+	if reconnected && event.EventType != "DeviceConnection" {
+		reportWatchdogConnection(snapshot, EventStateActive, "connected", "device is sending again")
+	}
+}
+
+// runWatchdog probes and checks the devices until the context ends
+func runWatchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkDevices(ctx)
+		}
+	}
+}
+
+// checkDevices probes the devices that have a probe and reports those silent for too long
+func checkDevices(ctx context.Context) {
+	watchdog.Lock()
+	devices := make([]*watchedDevice, 0, len(watchdog.devices))
+	for _, watched := range watchdog.devices {
+		devices = append(devices, watched)
+	}
+	watchdog.Unlock()
+
+	// Probe concurrently so one hanging device does not delay the others
+	var wg sync.WaitGroup
+	for _, watched := range devices {
+		if watched.probe == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(watched *watchedDevice) {
+			defer wg.Done()
+			err := probeDevice(ctx, watched.probe)
+
+			watchdog.Lock()
+			probed := time.Now()
+			watched.LastProbe = &probed
+			watched.ProbeError = ""
+			if err != nil {
+				watched.ProbeError = err.Error()
+			}
+			watchdog.Unlock()
+
+			if err == nil {
+				recordProbe(watched)
+			}
+		}(watched)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	for _, watched := range devices {
+		watchdog.Lock()
+		silentFor := now.Sub(watched.LastSeen)
+		goneOffline := watched.Online && watched.offlineAfter > 0 && silentFor > watched.offlineAfter
+		if goneOffline {
+			watched.Online = false
+			watched.OfflineSince = &now
+		}
+		snapshot := *watched
+		watchdog.Unlock()
+
+		if goneOffline {
+			reason := fmt.Sprintf("no events for %s", silentFor.Round(time.Second))
+			if snapshot.ProbeError != "" {
+				reason += ", probe failed: " + snapshot.ProbeError
+			}
+			reportWatchdogConnection(snapshot, EventStateInactive, "disconnected", reason)
+		}
+	}
+}
+
+// recordProbe marks a device as seen after a successful probe
+func recordProbe(watched *watchedDevice) {
+	watchdog.Lock()
+	watched.LastSeen = time.Now()
+	reconnected := !watched.Online
+	watched.Online = true
+	watched.OfflineSince = nil
+	snapshot := *watched
+	watchdog.Unlock()
+
+	if reconnected {
+		reportWatchdogConnection(snapshot, EventStateActive, "connected", "device answers the probe again")
+	}
+}
+
+// probeDevice checks that the device answers
+func probeDevice(ctx context.Context, probe *ProbeConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	switch probe.Type {
+	case ProbeTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", probe.Address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case ProbeHTTP, ProbeISAPI:
+		target := probe.Address
+		if probe.Type == ProbeISAPI {
+			target = strings.TrimRight(target, "/") + "/ISAPI/System/deviceInfo"
+		}
+		resp, err := doDigestRequest(http.DefaultClient, func() (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		}, probe.Username, probe.Password)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		// Any HTTP answer proves the device is alive, deviceInfo must succeed
+		if probe.Type == ProbeISAPI && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("deviceInfo returned status %d", resp.StatusCode)
+		}
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("probe returned status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown probe type %q", probe.Type)
+}
+
+// reportWatchdogConnection sends a synthetic DeviceConnection event through the pipeline
+func reportWatchdogConnection(watched watchedDevice, eventState, status, reason string) {
+	vendor := watched.Vendor
+	if vendor == "" {
+		vendor = "Watchdog"
+	}
+
+	event := Event{
+		Vendor:    vendor,
+		EventType: "DeviceConnection",
+		DeviceID:  watched.DeviceID,
+		State:     eventState,
+		EventDetails: map[string]interface{}{
+			"source":      "watchdog",
+			"status":      status,
+			"description": reason,
+			"lastSeen":    watched.LastSeen,
+		},
+	}
+	ingestEvent("Watchdog", &event)
+}
+
+// handleListDevices lists the watched devices with their last-seen time
+func handleListDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET method is supported"))
+		return
+	}
+
+	watchdog.Lock()
+	devices := make([]watchedDevice, 0, len(watchdog.devices))
+	for _, watched := range watchdog.devices {
+		devices = append(devices, *watched)
+	}
+	enabled := watchdog.enabled
+	watchdog.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": enabled,
+		"devices": devices,
+	})
+}
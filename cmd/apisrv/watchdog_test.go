@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useWatchdog starts the watchdog for the inventory without its periodic check
+func useWatchdog(t *testing.T, devices []DeviceConfig) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := startWatchdog(ctx, WatchdogConfig{Enabled: true, OfflineAfter: "1m"}, devices); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		watchdog.Lock()
+		watchdog.enabled = false
+		watchdog.devices = map[string]*watchedDevice{}
+		watchdog.Unlock()
+	})
+}
+
+// silenceDevice moves the last-seen time of a watched device into the past
+func silenceDevice(t *testing.T, deviceID string, silentFor time.Duration) {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	watched, ok := watchdog.devices[deviceID]
+	if !ok {
+		t.Fatalf("device %s is not watched", deviceID)
+	}
+	watched.LastSeen = time.Now().Add(-silentFor)
+}
+
+// isWatched reports whether the device has a last-seen record
+func isWatched(deviceID string) bool {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	_, ok := watchdog.devices[deviceID]
+	return ok
+}
+
+// connectionEvents returns the status of the DeviceConnection events received
+func connectionEvents(events []Event) []string {
+	var statuses []string
+	for _, event := range events {
+		if event.EventType == "DeviceConnection" {
+			statuses = append(statuses, event.DeviceID+":"+event.State)
+		}
+	}
+	return statuses
+}
+
+func TestWatchdogOfflineAndReconnect(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useWatchdog(t, []DeviceConfig{{ID: "cam1", Name: "Gate", OfflineAfter: "1s"}})
+
+	// Still within the threshold
+	silenceDevice(t, "cam1", 500*time.Millisecond)
+	checkDevices(context.Background())
+	if events := notifier.received(); len(events) != 0 {
+		t.Fatalf("got %d events before the threshold", len(events))
+	}
+
+	silenceDevice(t, "cam1", 2*time.Second)
+	checkDevices(context.Background())
+	checkDevices(context.Background())
+	events := notifier.received()
+	if statuses := connectionEvents(events); len(statuses) != 1 || statuses[0] != "cam1:"+EventStateInactive {
+		t.Fatalf("got connection events %v, want one disconnect", statuses)
+	}
+	if events[0].EventDetails["source"] != "watchdog" || events[0].EventDetails["status"] != "disconnected" {
+		t.Errorf("got details %v", events[0].EventDetails)
+	}
+
+	// The next event of the device is preceded by a synthetic reconnect
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "cam1", ChannelID: "Channel1"})
+	events = notifier.received()
+	if len(events) != 3 || events[1].EventType != "DeviceConnection" || events[1].State != EventStateActive ||
+		events[1].Vendor != VendorVivotek || events[2].EventType != "MotionDetection" {
+		t.Errorf("got connection events %v of %d, want the reconnect before the motion event",
+			connectionEvents(events), len(events))
+	}
+}
+
+func TestWatchdogOwnReconnect(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+	useWatchdog(t, []DeviceConfig{{ID: "cam1", OfflineAfter: "1s"}})
+
+	silenceDevice(t, "cam1", 2*time.Second)
+	checkDevices(context.Background())
+
+	// The device reports its own reconnect, a synthetic one would repeat it
+	processEvent(&Event{Vendor: VendorHikVision, EventType: "DeviceConnection", DeviceID: "cam1", State: EventStateActive,
+		EventDetails: map[string]interface{}{"status": "connected"}})
+	events := notifier.received()
+	if statuses := connectionEvents(events); len(statuses) != 2 || statuses[1] != "cam1:"+EventStateActive {
+		t.Fatalf("got connection events %v, want the disconnect and the device's own reconnect", statuses)
+	}
+	if events[1].EventDetails["source"] == "watchdog" {
+		t.Error("got a synthetic reconnect")
+	}
+}
+
+func TestWatchdogWatchedDevices(t *testing.T) {
+	useRecordingNotifier(t)
+	useWatchdog(t, []DeviceConfig{{ID: "cam1"}})
+
+	// Devices that only push on motion are not watched
+	processEvent(&Event{Vendor: VendorVivotek, EventType: "MotionDetection", DeviceID: "push-only"})
+	if isWatched("push-only") {
+		t.Error("got a device watched from a pushed event")
+	}
+
+	recordHeartbeat(&Event{Vendor: VendorONVIF, DeviceID: "ONVIF_gate"})
+	if !isWatched("onvif_gate") {
+		t.Error("got no device watched from a heartbeat")
+	}
+}
+
+func TestWatchdogProbe(t *testing.T) {
+	notifier := useRecordingNotifier(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ISAPI/System/deviceInfo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name  string
+		probe ProbeConfig
+		ok    bool
+	}{
+		{"tcp", ProbeConfig{Type: ProbeTCP, Address: server.Listener.Addr().String()}, true},
+		{"tcp closed", ProbeConfig{Type: ProbeTCP, Address: closedAddress}, false},
+		// Any answer below 500 proves the device is alive
+		{"http", ProbeConfig{Type: ProbeHTTP, Address: server.URL + "/missing"}, true},
+		{"isapi", ProbeConfig{Type: ProbeISAPI, Address: server.URL}, true},
+		{"isapi without deviceInfo", ProbeConfig{Type: ProbeISAPI, Address: server.URL + "/nvr"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := probeDevice(context.Background(), &tt.probe); (err == nil) != tt.ok {
+				t.Errorf("got %v, want success %t", err, tt.ok)
+			}
+		})
+	}
+
+	// A device failing its probe goes offline and is reconnected once it answers again
+	useWatchdog(t, []DeviceConfig{{ID: "nvr1", OfflineAfter: "1s",
+		Probe: &ProbeConfig{Type: ProbeTCP, Address: closedAddress}}})
+	silenceDevice(t, "nvr1", 2*time.Second)
+	checkDevices(context.Background())
+
+	watchdog.Lock()
+	watchdog.devices["nvr1"].probe = &ProbeConfig{Type: ProbeTCP, Address: server.Listener.Addr().String()}
+	watchdog.Unlock()
+	checkDevices(context.Background())
+
+	events := notifier.received()
+	if statuses := connectionEvents(events); len(statuses) != 2 || statuses[0] != "nvr1:"+EventStateInactive ||
+		statuses[1] != "nvr1:"+EventStateActive {
+		t.Errorf("got connection events %v, want a disconnect and a reconnect", statuses)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func init() {
+	registerNotifier("webhook", newWebhookNotifier)
+}
+
+// webhookNotifier posts the normalized event as JSON to a URL
+type webhookNotifier struct {
+	cfg NotifierConfig
+}
+
+// newWebhookNotifier creates a webhook notifier
+func newWebhookNotifier(cfg NotifierConfig) (Notifier, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook notifier requires url")
+	}
+	return &webhookNotifier{cfg: cfg}, nil
+}
+
+func (n *webhookNotifier) Name() string { return n.cfg.Name }
+
+func (n *webhookNotifier) Type() string { return "webhook" }
+
+// Notify sends the event to the configured notification URL
+func (n *webhookNotifier) Notify(ctx context.Context, event *Event) error {
+	var payload interface{} = event
+	if n.cfg.IncludeAttachments && len(event.Attachments) > 0 {
+		payload = webhookPayloadWithAttachments(event)
+	}
+
+	eventJSON, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error serializing event: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewBuffer(eventJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range n.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("error response from notification URL: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookAttachment is an attachment with its data embedded as base64
+type webhookAttachment struct {
+	Attachment
+	Data string `json:"data"`
+}
+
+// webhookPayloadWithAttachments returns the event with base64 encoded attachment data
+func webhookPayloadWithAttachments(event *Event) interface{} {
+	attachments := make([]webhookAttachment, 0, len(event.Attachments))
+	for _, attachment := range event.Attachments {
+		attachments = append(attachments, webhookAttachment{
+			Attachment: attachment,
+			Data:       base64.StdEncoding.EncodeToString(attachment.Data),
+		})
+	}
+
+	// The outer Attachments field shadows the one of the embedded event
+	return struct {
+		*Event
+		Attachments []webhookAttachment `json:"attachments"`
+	}{event, attachments}
+}